@@ -19,11 +19,23 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	GodisService_SetKey_FullMethodName    = "/godis.GodisService/SetKey"
-	GodisService_GetKey_FullMethodName    = "/godis.GodisService/GetKey"
-	GodisService_ListKeys_FullMethodName  = "/godis.GodisService/ListKeys"
-	GodisService_SetStream_FullMethodName = "/godis.GodisService/SetStream"
-	GodisService_GetStream_FullMethodName = "/godis.GodisService/GetStream"
+	GodisService_SetKey_FullMethodName            = "/godis.GodisService/SetKey"
+	GodisService_GetKey_FullMethodName            = "/godis.GodisService/GetKey"
+	GodisService_DeleteKey_FullMethodName         = "/godis.GodisService/DeleteKey"
+	GodisService_ListKeys_FullMethodName          = "/godis.GodisService/ListKeys"
+	GodisService_SetStream_FullMethodName         = "/godis.GodisService/SetStream"
+	GodisService_GetStream_FullMethodName         = "/godis.GodisService/GetStream"
+	GodisService_Compact_FullMethodName           = "/godis.GodisService/Compact"
+	GodisService_Expire_FullMethodName            = "/godis.GodisService/Expire"
+	GodisService_Persist_FullMethodName           = "/godis.GodisService/Persist"
+	GodisService_TTL_FullMethodName               = "/godis.GodisService/TTL"
+	GodisService_ConsumeLog_FullMethodName        = "/godis.GodisService/ConsumeLog"
+	GodisService_GetMerkleTree_FullMethodName     = "/godis.GodisService/GetMerkleTree"
+	GodisService_ConsumeRange_FullMethodName      = "/godis.GodisService/ConsumeRange"
+	GodisService_AntiEntropy_FullMethodName       = "/godis.GodisService/AntiEntropy"
+	GodisService_StreamSnapshot_FullMethodName    = "/godis.GodisService/StreamSnapshot"
+	GodisService_GetServers_FullMethodName        = "/godis.GodisService/GetServers"
+	GodisService_ReplicationStatus_FullMethodName = "/godis.GodisService/ReplicationStatus"
 )
 
 // GodisServiceClient is the client API for GodisService service.
@@ -32,9 +44,28 @@ const (
 type GodisServiceClient interface {
 	SetKey(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
 	GetKey(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	DeleteKey(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
 	ListKeys(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
 	SetStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SetRequest, SetResponse], error)
 	GetStream(ctx context.Context, in *MultiGetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GetResponse], error)
+	Compact(ctx context.Context, in *CompactRequest, opts ...grpc.CallOption) (*CompactResponse, error)
+	Expire(ctx context.Context, in *ExpireRequest, opts ...grpc.CallOption) (*ExpireResponse, error)
+	Persist(ctx context.Context, in *PersistRequest, opts ...grpc.CallOption) (*PersistResponse, error)
+	TTL(ctx context.Context, in *TTLRequest, opts ...grpc.CallOption) (*TTLResponse, error)
+	ConsumeLog(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LogRecord], error)
+	GetMerkleTree(ctx context.Context, in *MerkleTreeRequest, opts ...grpc.CallOption) (*MerkleTreeResponse, error)
+	// The latest record for every key in the ranges, tombstones included
+	ConsumeRange(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LogRecord], error)
+	// Compare trees with every peer now, rather than waiting for the next
+	// round
+	AntiEntropy(ctx context.Context, in *AntiEntropyRequest, opts ...grpc.CallOption) (*AntiEntropyResponse, error)
+	// A point-in-time copy of the store's files, for a new node to start
+	// from
+	StreamSnapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SnapshotChunk], error)
+	// The members of the cluster, for clients to spread requests across
+	GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error)
+	// How far the node has replicated each of its peers
+	ReplicationStatus(ctx context.Context, in *ReplicationStatusRequest, opts ...grpc.CallOption) (*ReplicationStatusResponse, error)
 }
 
 type godisServiceClient struct {
@@ -65,6 +96,16 @@ func (c *godisServiceClient) GetKey(ctx context.Context, in *GetRequest, opts ..
 	return out, nil
 }
 
+func (c *godisServiceClient) DeleteKey(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, GodisService_DeleteKey_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *godisServiceClient) ListKeys(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	out := new(ListResponse)
@@ -107,15 +148,171 @@ func (c *godisServiceClient) GetStream(ctx context.Context, in *MultiGetRequest,
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type GodisService_GetStreamClient = grpc.ServerStreamingClient[GetResponse]
 
+func (c *godisServiceClient) Compact(ctx context.Context, in *CompactRequest, opts ...grpc.CallOption) (*CompactResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CompactResponse)
+	err := c.cc.Invoke(ctx, GodisService_Compact_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *godisServiceClient) Expire(ctx context.Context, in *ExpireRequest, opts ...grpc.CallOption) (*ExpireResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ExpireResponse)
+	err := c.cc.Invoke(ctx, GodisService_Expire_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *godisServiceClient) Persist(ctx context.Context, in *PersistRequest, opts ...grpc.CallOption) (*PersistResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PersistResponse)
+	err := c.cc.Invoke(ctx, GodisService_Persist_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *godisServiceClient) TTL(ctx context.Context, in *TTLRequest, opts ...grpc.CallOption) (*TTLResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TTLResponse)
+	err := c.cc.Invoke(ctx, GodisService_TTL_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *godisServiceClient) ConsumeLog(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LogRecord], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &GodisService_ServiceDesc.Streams[2], GodisService_ConsumeLog_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ConsumeRequest, LogRecord]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type GodisService_ConsumeLogClient = grpc.ServerStreamingClient[LogRecord]
+
+func (c *godisServiceClient) GetMerkleTree(ctx context.Context, in *MerkleTreeRequest, opts ...grpc.CallOption) (*MerkleTreeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MerkleTreeResponse)
+	err := c.cc.Invoke(ctx, GodisService_GetMerkleTree_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *godisServiceClient) ConsumeRange(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[LogRecord], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &GodisService_ServiceDesc.Streams[3], GodisService_ConsumeRange_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[RangeRequest, LogRecord]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type GodisService_ConsumeRangeClient = grpc.ServerStreamingClient[LogRecord]
+
+func (c *godisServiceClient) AntiEntropy(ctx context.Context, in *AntiEntropyRequest, opts ...grpc.CallOption) (*AntiEntropyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AntiEntropyResponse)
+	err := c.cc.Invoke(ctx, GodisService_AntiEntropy_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *godisServiceClient) StreamSnapshot(ctx context.Context, in *SnapshotRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SnapshotChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &GodisService_ServiceDesc.Streams[4], GodisService_StreamSnapshot_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SnapshotRequest, SnapshotChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type GodisService_StreamSnapshotClient = grpc.ServerStreamingClient[SnapshotChunk]
+
+func (c *godisServiceClient) GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetServersResponse)
+	err := c.cc.Invoke(ctx, GodisService_GetServers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *godisServiceClient) ReplicationStatus(ctx context.Context, in *ReplicationStatusRequest, opts ...grpc.CallOption) (*ReplicationStatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReplicationStatusResponse)
+	err := c.cc.Invoke(ctx, GodisService_ReplicationStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // GodisServiceServer is the server API for GodisService service.
 // All implementations must embed UnimplementedGodisServiceServer
 // for forward compatibility.
 type GodisServiceServer interface {
 	SetKey(context.Context, *SetRequest) (*SetResponse, error)
 	GetKey(context.Context, *GetRequest) (*GetResponse, error)
+	DeleteKey(context.Context, *DeleteRequest) (*DeleteResponse, error)
 	ListKeys(context.Context, *ListRequest) (*ListResponse, error)
 	SetStream(grpc.BidiStreamingServer[SetRequest, SetResponse]) error
 	GetStream(*MultiGetRequest, grpc.ServerStreamingServer[GetResponse]) error
+	Compact(context.Context, *CompactRequest) (*CompactResponse, error)
+	Expire(context.Context, *ExpireRequest) (*ExpireResponse, error)
+	Persist(context.Context, *PersistRequest) (*PersistResponse, error)
+	TTL(context.Context, *TTLRequest) (*TTLResponse, error)
+	ConsumeLog(*ConsumeRequest, grpc.ServerStreamingServer[LogRecord]) error
+	GetMerkleTree(context.Context, *MerkleTreeRequest) (*MerkleTreeResponse, error)
+	// The latest record for every key in the ranges, tombstones included
+	ConsumeRange(*RangeRequest, grpc.ServerStreamingServer[LogRecord]) error
+	// Compare trees with every peer now, rather than waiting for the next
+	// round
+	AntiEntropy(context.Context, *AntiEntropyRequest) (*AntiEntropyResponse, error)
+	// A point-in-time copy of the store's files, for a new node to start
+	// from
+	StreamSnapshot(*SnapshotRequest, grpc.ServerStreamingServer[SnapshotChunk]) error
+	// The members of the cluster, for clients to spread requests across
+	GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error)
+	// How far the node has replicated each of its peers
+	ReplicationStatus(context.Context, *ReplicationStatusRequest) (*ReplicationStatusResponse, error)
 	mustEmbedUnimplementedGodisServiceServer()
 }
 
@@ -132,6 +329,9 @@ func (UnimplementedGodisServiceServer) SetKey(context.Context, *SetRequest) (*Se
 func (UnimplementedGodisServiceServer) GetKey(context.Context, *GetRequest) (*GetResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetKey not implemented")
 }
+func (UnimplementedGodisServiceServer) DeleteKey(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteKey not implemented")
+}
 func (UnimplementedGodisServiceServer) ListKeys(context.Context, *ListRequest) (*ListResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListKeys not implemented")
 }
@@ -141,6 +341,39 @@ func (UnimplementedGodisServiceServer) SetStream(grpc.BidiStreamingServer[SetReq
 func (UnimplementedGodisServiceServer) GetStream(*MultiGetRequest, grpc.ServerStreamingServer[GetResponse]) error {
 	return status.Errorf(codes.Unimplemented, "method GetStream not implemented")
 }
+func (UnimplementedGodisServiceServer) Compact(context.Context, *CompactRequest) (*CompactResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Compact not implemented")
+}
+func (UnimplementedGodisServiceServer) Expire(context.Context, *ExpireRequest) (*ExpireResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Expire not implemented")
+}
+func (UnimplementedGodisServiceServer) Persist(context.Context, *PersistRequest) (*PersistResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Persist not implemented")
+}
+func (UnimplementedGodisServiceServer) TTL(context.Context, *TTLRequest) (*TTLResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TTL not implemented")
+}
+func (UnimplementedGodisServiceServer) ConsumeLog(*ConsumeRequest, grpc.ServerStreamingServer[LogRecord]) error {
+	return status.Errorf(codes.Unimplemented, "method ConsumeLog not implemented")
+}
+func (UnimplementedGodisServiceServer) GetMerkleTree(context.Context, *MerkleTreeRequest) (*MerkleTreeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMerkleTree not implemented")
+}
+func (UnimplementedGodisServiceServer) ConsumeRange(*RangeRequest, grpc.ServerStreamingServer[LogRecord]) error {
+	return status.Errorf(codes.Unimplemented, "method ConsumeRange not implemented")
+}
+func (UnimplementedGodisServiceServer) AntiEntropy(context.Context, *AntiEntropyRequest) (*AntiEntropyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AntiEntropy not implemented")
+}
+func (UnimplementedGodisServiceServer) StreamSnapshot(*SnapshotRequest, grpc.ServerStreamingServer[SnapshotChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamSnapshot not implemented")
+}
+func (UnimplementedGodisServiceServer) GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetServers not implemented")
+}
+func (UnimplementedGodisServiceServer) ReplicationStatus(context.Context, *ReplicationStatusRequest) (*ReplicationStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReplicationStatus not implemented")
+}
 func (UnimplementedGodisServiceServer) mustEmbedUnimplementedGodisServiceServer() {}
 func (UnimplementedGodisServiceServer) testEmbeddedByValue()                      {}
 
@@ -198,6 +431,24 @@ func _GodisService_GetKey_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _GodisService_DeleteKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GodisServiceServer).DeleteKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GodisService_DeleteKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GodisServiceServer).DeleteKey(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _GodisService_ListKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(ListRequest)
 	if err := dec(in); err != nil {
@@ -234,6 +485,183 @@ func _GodisService_GetStream_Handler(srv interface{}, stream grpc.ServerStream)
 // This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
 type GodisService_GetStreamServer = grpc.ServerStreamingServer[GetResponse]
 
+func _GodisService_Compact_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompactRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GodisServiceServer).Compact(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GodisService_Compact_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GodisServiceServer).Compact(ctx, req.(*CompactRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GodisService_Expire_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExpireRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GodisServiceServer).Expire(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GodisService_Expire_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GodisServiceServer).Expire(ctx, req.(*ExpireRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GodisService_Persist_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PersistRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GodisServiceServer).Persist(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GodisService_Persist_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GodisServiceServer).Persist(ctx, req.(*PersistRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GodisService_TTL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TTLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GodisServiceServer).TTL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GodisService_TTL_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GodisServiceServer).TTL(ctx, req.(*TTLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GodisService_ConsumeLog_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ConsumeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GodisServiceServer).ConsumeLog(m, &grpc.GenericServerStream[ConsumeRequest, LogRecord]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type GodisService_ConsumeLogServer = grpc.ServerStreamingServer[LogRecord]
+
+func _GodisService_GetMerkleTree_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MerkleTreeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GodisServiceServer).GetMerkleTree(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GodisService_GetMerkleTree_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GodisServiceServer).GetMerkleTree(ctx, req.(*MerkleTreeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GodisService_ConsumeRange_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RangeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GodisServiceServer).ConsumeRange(m, &grpc.GenericServerStream[RangeRequest, LogRecord]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type GodisService_ConsumeRangeServer = grpc.ServerStreamingServer[LogRecord]
+
+func _GodisService_AntiEntropy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AntiEntropyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GodisServiceServer).AntiEntropy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GodisService_AntiEntropy_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GodisServiceServer).AntiEntropy(ctx, req.(*AntiEntropyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GodisService_StreamSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SnapshotRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GodisServiceServer).StreamSnapshot(m, &grpc.GenericServerStream[SnapshotRequest, SnapshotChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type GodisService_StreamSnapshotServer = grpc.ServerStreamingServer[SnapshotChunk]
+
+func _GodisService_GetServers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetServersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GodisServiceServer).GetServers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GodisService_GetServers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GodisServiceServer).GetServers(ctx, req.(*GetServersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GodisService_ReplicationStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReplicationStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GodisServiceServer).ReplicationStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GodisService_ReplicationStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GodisServiceServer).ReplicationStatus(ctx, req.(*ReplicationStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // GodisService_ServiceDesc is the grpc.ServiceDesc for GodisService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -249,10 +677,46 @@ var GodisService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetKey",
 			Handler:    _GodisService_GetKey_Handler,
 		},
+		{
+			MethodName: "DeleteKey",
+			Handler:    _GodisService_DeleteKey_Handler,
+		},
 		{
 			MethodName: "ListKeys",
 			Handler:    _GodisService_ListKeys_Handler,
 		},
+		{
+			MethodName: "Compact",
+			Handler:    _GodisService_Compact_Handler,
+		},
+		{
+			MethodName: "Expire",
+			Handler:    _GodisService_Expire_Handler,
+		},
+		{
+			MethodName: "Persist",
+			Handler:    _GodisService_Persist_Handler,
+		},
+		{
+			MethodName: "TTL",
+			Handler:    _GodisService_TTL_Handler,
+		},
+		{
+			MethodName: "GetMerkleTree",
+			Handler:    _GodisService_GetMerkleTree_Handler,
+		},
+		{
+			MethodName: "AntiEntropy",
+			Handler:    _GodisService_AntiEntropy_Handler,
+		},
+		{
+			MethodName: "GetServers",
+			Handler:    _GodisService_GetServers_Handler,
+		},
+		{
+			MethodName: "ReplicationStatus",
+			Handler:    _GodisService_ReplicationStatus_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -266,6 +730,21 @@ var GodisService_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _GodisService_GetStream_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "ConsumeLog",
+			Handler:       _GodisService_ConsumeLog_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ConsumeRange",
+			Handler:       _GodisService_ConsumeRange_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamSnapshot",
+			Handler:       _GodisService_StreamSnapshot_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "api/godis.proto",
 }
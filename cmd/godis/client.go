@@ -8,12 +8,14 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	api "github.com/jscottransom/distributed_godis/api"
+	"github.com/jscottransom/distributed_godis/internal/loadbalance"
 )
 
 func main(){
 
 	opts := grpc.WithTransportCredentials(insecure.NewCredentials())
-	cc, err := grpc.Dial(":9001", opts)
+	// Any member of the cluster will do; the resolver finds the rest
+	cc, err := grpc.Dial(fmt.Sprintf("%s:///%s", loadbalance.Name, "localhost:9001"), opts)
 
 	if err != nil {
 		log.Fatalf("did not connect: %s", err)
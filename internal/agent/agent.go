@@ -3,9 +3,16 @@ package agent
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"github.com/soheilhy/cmux"
+	"go.opencensus.io/stats/view"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -14,15 +21,21 @@ import (
 	"github.com/jscottransom/distributed_godis/internal/auth"
 	"github.com/jscottransom/distributed_godis/internal/discovery"
 	"github.com/jscottransom/distributed_godis/internal/kvstore"
+	"github.com/jscottransom/distributed_godis/internal/ring"
 	"github.com/jscottransom/distributed_godis/internal/server"
 )
 
 type Agent struct {
 	Config
+	mux			cmux.CMux
 	kvstore 	*kvstore.KVstore
+	distributed	*kvstore.DistributedKVstore
 	server 		*grpc.Server
 	membership	*discovery.Membership
 	replicator	*kvstore.Replicator
+	ring		*ring.Ring
+	rebalancer	*kvstore.Rebalancer
+	hints		*kvstore.HintedHandoff
 	shutdown	bool
 	shutdowns	chan struct{}
 	shutdownLock sync.Mutex	
@@ -33,23 +46,78 @@ type Config struct {
 	PeerTLSConfig 	*tls.Config
 	DataDir			string
 	StoreName		string
+	StoreConfig		kvstore.Config
+	// Durability mode for the store: kvstore.SyncAlways, SyncInterval or
+	// SyncNone. Overrides StoreConfig.Sync when set.
+	SyncMode		string
+	SyncInterval	time.Duration
 	BindAddr		string
 	RPCPort			int
 	NodeName		string
 	StartJoinAddrs	[]string
 	ACLModelFile	string
 	ACLPolicyFile	string
+	// How writes reach the other nodes: ReplicationRaft or ReplicationAsync
+	Replication		string
+	// Start a new raft cluster with this node as its first member
+	Bootstrap		bool
+	// How often to run anti-entropy with the other nodes in async mode
+	AntiEntropyInterval	time.Duration
+	// Number of nodes each key is stored on in async mode, with the keyspace
+	// partitioned across the cluster by a consistent-hash ring. Zero stores
+	// every key on every node.
+	ReplicationFactor	int
+	// Number of points each node takes on the ring
+	VirtualNodes		int
+	// Most bytes a second to hand off to other nodes as keys move between
+	// them. Zero leaves it unthrottled.
+	RebalanceBytesPerSecond	int64
+	// How long to keep the writes for a node that has failed, to hand off
+	// once it is back
+	HintWindow		time.Duration
+	// What the node does in the cluster: RolePrimary or RoleReplica
+	Role			string
 }
 
+const (
+	// Writes go through a raft log, and are linearizable
+	ReplicationRaft = "raft"
+	// Nodes copy keys from each other as they join
+	ReplicationAsync = "async"
+)
+
+const (
+	// Takes writes from clients
+	RolePrimary = "primary"
+	// Receives replication and serves reads, but rejects writes from
+	// clients, pointing them at a primary instead
+	RoleReplica = discovery.RoleReplica
+)
+
 func New(config Config) (*Agent, error) {
 	a := &Agent{
 		Config: config,
 		shutdowns: make(chan struct{}),
 	}
 
+	if a.Config.Replication == "" {
+		a.Config.Replication = ReplicationRaft
+	}
+	if a.Config.AntiEntropyInterval == 0 {
+		a.Config.AntiEntropyInterval = time.Minute
+	}
+	if a.Config.HintWindow == 0 {
+		a.Config.HintWindow = 3 * time.Hour
+	}
+	if a.Config.Role == "" {
+		a.Config.Role = RolePrimary
+	}
+
 	setup := []func() error{
 		a.setupLogger,
+		a.setupMux,
 		a.setupKVStore,
+		a.setupReplicator,
 		a.setupServer,
 		a.setupMembership,
 	}
@@ -59,6 +127,7 @@ func New(config Config) (*Agent, error) {
 				return nil, err
 		}
 	}
+	go a.serve()
 
 	return a, nil
 }
@@ -81,13 +150,77 @@ func (a *Agent) setupLogger() error {
 }
 
 
+// Raft and gRPC share the RPC port, told apart by the first byte raft
+// connections send
+func (a *Agent) setupMux() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
+	a.mux = cmux.New(ln)
+	return nil
+}
+
 func (a *Agent) setupKVStore() error {
+	config := a.Config.StoreConfig
+	if config.NodeID == "" {
+		config.NodeID = a.Config.NodeName
+	}
+	if a.Config.SyncMode != "" {
+		config.Sync.Mode = a.Config.SyncMode
+	}
+	if a.Config.SyncInterval != 0 {
+		config.Sync.Interval = a.Config.SyncInterval
+	}
+
 	var err error
-	a.kvstore, err = kvstore.NewKVstore(
+	if a.Config.Replication == ReplicationAsync {
+		// A delete has reached every replica once the hint window has run
+		// out and anti-entropy has had a round since
+		if config.Tombstone.TTL == 0 {
+			config.Tombstone.TTL = a.Config.HintWindow + a.Config.AntiEntropyInterval
+		}
+		a.kvstore, err = kvstore.NewKVstore(
+			a.Config.DataDir,
+			a.Config.StoreName,
+			config,
+		)
+		return err
+	}
+
+	raftLn := a.mux.Match(func(reader io.Reader) bool {
+		b := make([]byte, 1)
+		if _, err := reader.Read(b); err != nil {
+			return false
+		}
+		return b[0] == byte(kvstore.RaftRPC)
+	})
+
+	distributedConfig := kvstore.DistributedConfig{Store: config}
+	distributedConfig.Raft.StreamLayer = kvstore.NewStreamLayer(
+		raftLn,
+		a.Config.ServerTLSConfig,
+		a.Config.PeerTLSConfig,
+	)
+	distributedConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
+	distributedConfig.Raft.Bootstrap = a.Config.Bootstrap
+	a.distributed, err = kvstore.NewDistributedKVstore(
 		a.Config.DataDir,
 		a.Config.StoreName,
+		distributedConfig,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	a.kvstore = a.distributed.KVstore
+	if a.Config.Bootstrap {
+		return a.distributed.WaitForLeader(3 * time.Second)
+	}
+	return nil
 }
 
 
@@ -100,7 +233,27 @@ func (a *Agent) setupServer() error {
 	)
 	serverConfig := &server.Config{
 		Store: a.kvstore,
-		Authorizer: authorizer}
+		Authorizer: authorizer,
+		ServerLister: a,
+		Replica: a.Config.Role == RoleReplica}
+	if a.replicator != nil {
+		serverConfig.Repairer = a.replicator
+		serverConfig.ReplicationReporter = a.replicator
+		serverConfig.Placement = a.ring
+	}
+	// Replicas serve every read themselves
+	if a.ring != nil && a.Config.Role != RoleReplica {
+		serverConfig.Router = a.ring
+		serverConfig.DialOptions = a.replicator.DialOptions
+		serverConfig.Hinter = a.hints
+	}
+	if a.distributed != nil {
+		serverConfig.Store = a.distributed
+		if a.Config.PeerTLSConfig != nil {
+			serverConfig.DialOptions = []grpc.DialOption{
+				grpc.WithTransportCredentials(credentials.NewTLS(a.Config.PeerTLSConfig))}
+		}
+	}
 	
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -114,21 +267,9 @@ func (a *Agent) setupServer() error {
 		return err
 	}
 
-	
-
-	rpcAddr, err := a.RPCAddr()
-	if err != nil {
-		return err
-	}
-
-
-	ln, err := net.Listen("tcp", rpcAddr)
-	if err != nil {
-		return err
-	}
-
+	grpcLn := a.mux.Match(cmux.Any())
 	go func() {
-		if err := a.server.Serve(ln); err != nil {
+		if err := a.server.Serve(grpcLn); err != nil {
 			_ = a.Shutdown()
 		}
 	}()
@@ -136,39 +277,145 @@ func (a *Agent) setupServer() error {
 
 }
 
-func (a *Agent) setupMembership() error {
+func (a *Agent) serve() error {
+	if err := a.mux.Serve(); err != nil {
+		_ = a.Shutdown()
+		return err
+	}
+	return nil
+}
+
+// In async mode a replicator copies the keys of the other nodes through the
+// local server
+func (a *Agent) setupReplicator() error {
+	if a.Config.Replication != ReplicationAsync {
+		return nil
+	}
 	rpcAddr, err := a.Config.RPCAddr()
 	if err != nil {
-			return err 
+		return err
 	}
 	var opts []grpc.DialOption
 	if a.Config.PeerTLSConfig != nil {
-		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(a.Config.PeerTLSConfig),),)
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(a.Config.PeerTLSConfig)))
 	}
 
 	conn, err := grpc.Dial(rpcAddr, opts...)
-	
 	if err != nil {
 		return err
 	}
 
 	client := api.NewGodisServiceClient(conn)
 	a.replicator = &kvstore.Replicator{
+		DialOptions:         opts,
+		LocalServer:         client,
+		NodeID:              a.Config.NodeName,
+		AntiEntropyInterval: a.Config.AntiEntropyInterval,
+		CursorDir:           filepath.Join(a.Config.DataDir, "replication"),
+	}
+
+	// The ring tells the server which nodes hold a key, and each node only
+	// keeps the keys the ring puts on it. Without a replication factor it
+	// puts every key on every node. Replicas stay off the ring, and keep
+	// every key to serve reads for.
+	replica := a.Config.Role == RoleReplica
+	a.ring = ring.New(ring.Config{
+		NodeName:          a.Config.NodeName,
+		RPCAddr:           rpcAddr,
+		ReplicationFactor: a.Config.ReplicationFactor,
+		VirtualNodes:      a.Config.VirtualNodes,
+		Replica:           replica,
+	})
+	if !replica {
+		a.replicator.Owns = a.ring.Owns
+	}
+	if a.Config.ReplicationFactor == 0 {
+		// A new node holds every key, so it can start from a copy of
+		// another's store
+		a.replicator.Store = a.kvstore
+	} else if !replica {
+		a.rebalancer = &kvstore.Rebalancer{
+			Store:          a.kvstore,
+			Ring:           a.ring,
+			DialOptions:    opts,
+			BytesPerSecond: a.Config.RebalanceBytesPerSecond,
+		}
+	}
+
+	// Writes for owners that have failed wait here until they are back
+	a.hints = &kvstore.HintedHandoff{
+		Dir:         filepath.Join(a.Config.DataDir, "hints"),
+		Ring:        a.ring,
 		DialOptions: opts,
-		LocalServer: client,
+		Window:      a.Config.HintWindow,
+		// Hints are as durable as the writes they carry
+		SyncMode:     a.kvstore.Config.Sync.Mode,
+		SyncInterval: a.kvstore.Config.Sync.Interval,
 	}
+	return view.Register(append(kvstore.HintViews, kvstore.ReplicationViews...)...)
+}
 
-	a.membership, err = discovery.New(a.replicator, discovery.Config{
+func (a *Agent) setupMembership() error {
+	rpcAddr, err := a.Config.RPCAddr()
+	if err != nil {
+			return err 
+	}
+
+	var handler discovery.Handler = a.distributed
+	if a.replicator != nil {
+		handler = a.replicator
+	}
+	if a.ring != nil {
+		// Ownership is settled before anything is copied or moved
+		handlers := discovery.Handlers{a.ring, a.replicator, a.hints}
+		if a.rebalancer != nil {
+			handlers = append(handlers, a.rebalancer)
+		}
+		handler = handlers
+	}
+
+	a.membership, err = discovery.New(handler, discovery.Config{
 		NodeName: a.Config.NodeName,
 		BindAddr: a.Config.BindAddr,
 		Tags: map[string]string{
 			"rpc_addr": rpcAddr,
+			discovery.RoleTag: a.Config.Role,
 		},
 		StartJoinAddrs: a.Config.StartJoinAddrs,
 	})
 	return err
 }
 
+// GetServers returns the members of the cluster that are up, and what each
+// does with writes
+func (a *Agent) GetServers() ([]*api.Server, error) {
+	var leader string
+	if a.distributed != nil {
+		leader = a.distributed.Leader()
+	}
+	var servers []*api.Server
+	for _, member := range a.membership.Members() {
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+		server := &api.Server{
+			Id:      member.Name,
+			RpcAddr: member.Tags["rpc_addr"],
+		}
+		switch {
+		case member.Tags[discovery.RoleTag] == RoleReplica:
+			server.Role = api.Role_REPLICA
+		case a.distributed != nil:
+			server.Role = api.Role_FOLLOWER
+			if server.RpcAddr == leader {
+				server.Role = api.Role_LEADER
+			}
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
 func (a *Agent) Shutdown() error {
 	a.shutdownLock.Lock()
 	defer a.shutdownLock.Unlock()
@@ -181,13 +428,36 @@ func (a *Agent) Shutdown() error {
 
 	shutdown := []func() error{
 		a.membership.Leave,
-		a.replicator.Close,
+		func() error {
+			if a.replicator != nil {
+				return a.replicator.Close()
+			}
+			return nil
+		},
+		func() error {
+			if a.hints != nil {
+				return a.hints.Close()
+			}
+			return nil
+		},
+		func() error {
+			if a.rebalancer != nil {
+				return a.rebalancer.Close()
+			}
+			return nil
+		},
 		func() error {
 			a.server.GracefulStop()
 			return nil
 		},
 		func() error {
-			a.kvstore.Remove(a.Config.DataDir)
+			if a.distributed != nil {
+				return a.distributed.Close()
+			}
+			return a.kvstore.Close()
+		},
+		func() error {
+			a.mux.Close()
 			return nil
 		},
 	}
@@ -11,11 +11,15 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	api "github.com/jscottransom/distributed_godis/api"
 	"github.com/jscottransom/distributed_godis/internal/agent"
 	"github.com/jscottransom/distributed_godis/internal/config"
+	"github.com/jscottransom/distributed_godis/internal/kvstore"
+	"github.com/jscottransom/distributed_godis/internal/loadbalance"
 )
 
 func TestAgent(t *testing.T) {
@@ -65,6 +69,8 @@ func TestAgent(t *testing.T) {
 				RPCPort: rpcPort,
 				DataDir: dataDir,
 				StoreName: storeName,
+				SyncMode: kvstore.SyncAlways,
+				Bootstrap: true,
 				ACLModelFile: config.ACLModelFile,
 				ACLPolicyFile: config.ACLPolicyFile,
 				ServerTLSConfig: serverTLSConfig,
@@ -93,6 +99,14 @@ func TestAgent(t *testing.T) {
 				)
 			require.NoError(t, err)
 			t.Log(setResponse2)
+
+			_, err = leaderClient.DeleteKey(
+				context.Background(),
+				&api.DeleteRequest{
+					Key: "strange",
+				},
+				)
+			require.NoError(t, err)
 			getResponse, err := leaderClient.GetKey(
 							context.Background(),
 							&api.GetRequest{
@@ -121,6 +135,7 @@ func TestAgent(t *testing.T) {
 				RPCPort: rpcPort,
 				DataDir: dataDir,
 				StoreName: storeName,
+				SyncMode: kvstore.SyncInterval,
 				ACLModelFile: config.ACLModelFile,
 				ACLPolicyFile: config.ACLPolicyFile,
 				ServerTLSConfig: serverTLSConfig,
@@ -153,6 +168,69 @@ func TestAgent(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, getResponseFollower.Value, []byte("world"))
 
+	// Writes on a follower are forwarded to the leader, and replicated
+	// back out to every node
+	_, err = followerClient.SetKey(
+		context.Background(),
+		&api.SetRequest{
+			Key: "follower",
+			Value: []byte("write"),
+		},
+	)
+	require.NoError(t, err)
+	time.Sleep(time.Second)
+	for _, agent := range agents {
+		getResponse, err := client(t, agent, peerTLSConfig).GetKey(
+			context.Background(),
+			&api.GetRequest{
+				Key: "follower",
+			},
+		)
+		require.NoError(t, err)
+		require.Equal(t, []byte("write"), getResponse.Value)
+	}
+
+	// The delete on the leader is carried to the followers,
+	// and is not undone by replicating back from them
+	for _, agent := range agents {
+		agentClient := client(t, agent, peerTLSConfig)
+		_, err = agentClient.GetKey(
+			context.Background(),
+			&api.GetRequest{
+				Key: "strange",
+			},
+		)
+		require.Equal(t, codes.NotFound, status.Code(err))
+
+		listResponse, err := agentClient.ListKeys(context.Background(), &api.ListRequest{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"strange"}, listResponse.Deleted)
+	}
+
+	// Every node lists the cluster, with the leader told apart
+	serversResponse, err := followerClient.GetServers(context.Background(), &api.GetServersRequest{})
+	require.NoError(t, err)
+	roles := make(map[string]api.Role)
+	for _, server := range serversResponse.Servers {
+		roles[server.Id] = server.Role
+	}
+	require.Equal(t, map[string]api.Role{"0": api.Role_LEADER, "1": api.Role_FOLLOWER, "2": api.Role_FOLLOWER}, roles)
+
+	// Clients that dial the cluster through the resolver find every node,
+	// and their writes reach the leader
+	rpcAddr, err := agents[1].Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(fmt.Sprintf("%s:///%s", loadbalance.Name, rpcAddr),
+		grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)))
+	require.NoError(t, err)
+	defer conn.Close()
+	clusterClient := api.NewGodisServiceClient(conn)
+	_, err = clusterClient.SetKey(context.Background(), &api.SetRequest{Key: "balanced", Value: []byte("write")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		getResponse, err := clusterClient.GetKey(context.Background(), &api.GetRequest{Key: "balanced"})
+		return err == nil && string(getResponse.Value) == "write"
+	}, 3*time.Second, 100*time.Millisecond)
 }
 
 
@@ -173,4 +251,368 @@ func client(
 	require.NoError(t, err)
 	client := api.NewGodisServiceClient(conn)
 	return client
-}
\ No newline at end of file
+}
+func TestAgentAsync(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	var agents []*agent.Agent
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		dataDir, err := os.MkdirTemp("", "agent-async-test")
+		require.NoError(t, err)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
+		}
+		agent, err := agent.New(agent.Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			DataDir:         dataDir,
+			StoreName:       "KV_store",
+			Replication:     agent.ReplicationAsync,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+		})
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	time.Sleep(3 * time.Second)
+
+	// A write on each node reaches every other node
+	for i, agent := range agents {
+		_, err := client(t, agent, peerTLSConfig).SetKey(
+			context.Background(),
+			&api.SetRequest{
+				Key:   fmt.Sprintf("key%d", i),
+				Value: []byte(fmt.Sprintf("value%d", i)),
+			},
+		)
+		require.NoError(t, err)
+	}
+	time.Sleep(3 * time.Second)
+
+	// Each node applied every write exactly once, rather than again as it
+	// echoed back through the other peers
+	for _, agent := range agents {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		stream, err := client(t, agent, peerTLSConfig).ConsumeLog(ctx, &api.ConsumeRequest{})
+		require.NoError(t, err)
+		origins := make(map[string]string)
+		for {
+			record, err := stream.Recv()
+			if err != nil {
+				break
+			}
+			require.NotContains(t, origins, record.Key)
+			origins[record.Key] = record.Origin
+		}
+		cancel()
+		require.Equal(t, map[string]string{"key0": "0", "key1": "1", "key2": "2"}, origins)
+	}
+
+	// A record the replication streams skip, as though they missed it, is
+	// still pulled in by anti-entropy. Claiming to have started out on the
+	// first node, it is taken for an echo there.
+	_, err = client(t, agents[1], peerTLSConfig).SetKey(
+		context.Background(),
+		&api.SetRequest{
+			Key:       "drift",
+			Value:     []byte("value"),
+			Origin:    "0",
+			OriginSeq: 100,
+		},
+	)
+	require.NoError(t, err)
+	time.Sleep(time.Second)
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	_, err = leaderClient.GetKey(context.Background(), &api.GetRequest{Key: "drift"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	repair, err := leaderClient.AntiEntropy(context.Background(), &api.AntiEntropyRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), repair.Repaired)
+	getResponse, err := leaderClient.GetKey(context.Background(), &api.GetRequest{Key: "drift"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), getResponse.Value)
+
+	// Nothing is left to repair
+	repair, err = leaderClient.AntiEntropy(context.Background(), &api.AntiEntropyRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), repair.Repaired)
+
+	// A node joining later starts from a snapshot of a peer's store, and
+	// carries on replicating from there. As a read-only replica, it takes
+	// no writes from clients.
+	ports := dynaport.Get(2)
+	dataDir, err := os.MkdirTemp("", "agent-async-test")
+	require.NoError(t, err)
+	joined, err := agent.New(agent.Config{
+		NodeName:        "3",
+		Role:            agent.RoleReplica,
+		StartJoinAddrs:  []string{agents[0].Config.BindAddr},
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:         ports[1],
+		DataDir:         dataDir,
+		StoreName:       "KV_store",
+		Replication:     agent.ReplicationAsync,
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+	})
+	require.NoError(t, err)
+	agents = append(agents, joined)
+	time.Sleep(3 * time.Second)
+	_, err = leaderClient.SetKey(context.Background(), &api.SetRequest{Key: "after", Value: []byte("value")})
+	require.NoError(t, err)
+	time.Sleep(time.Second)
+	joinedClient := client(t, joined, peerTLSConfig)
+
+	// The peer the snapshot came from may not have had the drifted record
+	// repaired yet, which anti-entropy pulls in just the same
+	_, err = joinedClient.AntiEntropy(context.Background(), &api.AntiEntropyRequest{})
+	require.NoError(t, err)
+	for _, key := range []string{"key0", "key1", "key2", "drift", "after"} {
+		getResponse, err := joinedClient.GetKey(context.Background(), &api.GetRequest{Key: key})
+		require.NoError(t, err, key)
+		require.NotEmpty(t, getResponse.Value)
+	}
+	_, err = joinedClient.SetKey(context.Background(), &api.SetRequest{Key: "replica", Value: []byte("value")})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	servers, err := leaderClient.GetServers(context.Background(), &api.GetServersRequest{})
+	require.NoError(t, err)
+	roles := make(map[string]api.Role)
+	for _, server := range servers.Servers {
+		roles[server.Id] = server.Role
+	}
+	require.Equal(t, map[string]api.Role{"0": api.Role_PEER, "1": api.Role_PEER, "2": api.Role_PEER, "3": api.Role_REPLICA}, roles)
+
+	// The replica reports tailing every peer, and having caught up with them
+	replication, err := joinedClient.ReplicationStatus(context.Background(), &api.ReplicationStatusRequest{})
+	require.NoError(t, err)
+	require.Len(t, replication.Peers, 3)
+	for i, peer := range replication.Peers {
+		require.Equal(t, fmt.Sprintf("%d", i), peer.Name)
+		require.Equal(t, api.ReplicationState_STREAMING, peer.State)
+		require.Equal(t, uint64(0), peer.Lag)
+	}
+}
+
+func TestAgentPartitioned(t *testing.T) {
+	serverTLSConfig, peerTLSConfig := partitionedTLSConfigs(t)
+
+	var agents []*agent.Agent
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		agents = append(agents, partitionedAgent(t, agents, 2, agent.RolePrimary, serverTLSConfig, peerTLSConfig))
+	}
+	replica := partitionedAgent(t, agents, 2, agent.RoleReplica, serverTLSConfig, peerTLSConfig)
+	defer func() {
+		require.NoError(t, replica.Shutdown())
+		require.NoError(t, os.RemoveAll(replica.Config.DataDir))
+	}()
+	time.Sleep(3 * time.Second)
+
+	// Writes made on one node are forwarded to the owners of their keys
+	keys := 20
+	setKeys(t, agents[0], keys, peerTLSConfig)
+	time.Sleep(3 * time.Second)
+
+	// Each key is stored on exactly two nodes, and read from any of them.
+	// The replica owns none of them, but holds a copy of every one.
+	requirePlaced(t, agents, keys, 2, peerTLSConfig)
+	require.Eventually(t, func() bool {
+		listResponse, err := client(t, replica, peerTLSConfig).ListKeys(
+			context.Background(),
+			&api.ListRequest{},
+		)
+		return err == nil && len(listResponse.Key) == keys
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// A write at ALL is on both owners by the time it returns, rather than
+	// waiting on replication
+	_, err := client(t, agents[0], peerTLSConfig).SetKey(
+		context.Background(),
+		&api.SetRequest{Key: "all", Value: []byte("value"), Consistency: api.Consistency_ALL},
+	)
+	require.NoError(t, err)
+	var held int
+	for _, agent := range agents {
+		listResponse, err := client(t, agent, peerTLSConfig).ListKeys(
+			context.Background(),
+			&api.ListRequest{},
+		)
+		require.NoError(t, err)
+		for _, key := range listResponse.Key {
+			if key == "all" {
+				held++
+			}
+		}
+	}
+	require.Equal(t, 2, held)
+	getResponse, err := client(t, agents[1], peerTLSConfig).GetKey(
+		context.Background(),
+		&api.GetRequest{Key: "all", Consistency: api.Consistency_QUORUM},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), getResponse.Value)
+}
+
+func TestAgentRebalance(t *testing.T) {
+	serverTLSConfig, peerTLSConfig := partitionedTLSConfigs(t)
+
+	var agents []*agent.Agent
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	// A lone node holds every key
+	agents = append(agents, partitionedAgent(t, agents, 1, agent.RolePrimary, serverTLSConfig, peerTLSConfig))
+	keys := 20
+	setKeys(t, agents[0], keys, peerTLSConfig)
+
+	// As nodes join, the keys they own are handed off to them, and dropped
+	// from the first node
+	for i := 1; i < 3; i++ {
+		agents = append(agents, partitionedAgent(t, agents, 1, agent.RolePrimary, serverTLSConfig, peerTLSConfig))
+	}
+	time.Sleep(5 * time.Second)
+	requirePlaced(t, agents, keys, 1, peerTLSConfig)
+}
+
+func partitionedTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	return serverTLSConfig, peerTLSConfig
+}
+
+// Start an agent storing each key on replicationFactor nodes, in the given
+// role, joining the cluster of the agents already started. Nodes are named
+// after the test, so gossip from the nodes of earlier tests shutting down is
+// not taken as news of them.
+func partitionedAgent(
+	t *testing.T,
+	agents []*agent.Agent,
+	replicationFactor int,
+	role string,
+	serverTLSConfig, peerTLSConfig *tls.Config,
+) *agent.Agent {
+	ports := dynaport.Get(2)
+	dataDir, err := os.MkdirTemp("", "agent-partitioned-test")
+	require.NoError(t, err)
+
+	var startJoinAddrs []string
+	if len(agents) != 0 {
+		startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
+	}
+	a, err := agent.New(agent.Config{
+		NodeName:          fmt.Sprintf("%s-%d", t.Name(), len(agents)),
+		StartJoinAddrs:    startJoinAddrs,
+		BindAddr:          fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCPort:           ports[1],
+		DataDir:           dataDir,
+		StoreName:         "KV_store",
+		Replication:       agent.ReplicationAsync,
+		ReplicationFactor: replicationFactor,
+		Role:              role,
+		ACLModelFile:      config.ACLModelFile,
+		ACLPolicyFile:     config.ACLPolicyFile,
+		ServerTLSConfig:   serverTLSConfig,
+		PeerTLSConfig:     peerTLSConfig,
+	})
+	require.NoError(t, err)
+	return a
+}
+
+func setKeys(t *testing.T, agent *agent.Agent, keys int, tlsConfig *tls.Config) {
+	for i := 0; i < keys; i++ {
+		_, err := client(t, agent, tlsConfig).SetKey(
+			context.Background(),
+			&api.SetRequest{
+				Key:   fmt.Sprintf("key%d", i),
+				Value: []byte(fmt.Sprintf("value%d", i)),
+			},
+		)
+		require.NoError(t, err)
+	}
+}
+
+// Check each key is stored on exactly replicationFactor nodes, and read from
+// any of them
+func requirePlaced(t *testing.T, agents []*agent.Agent, keys, replicationFactor int, tlsConfig *tls.Config) {
+	held := make(map[string]int)
+	for _, agent := range agents {
+		listResponse, err := client(t, agent, tlsConfig).ListKeys(
+			context.Background(),
+			&api.ListRequest{},
+		)
+		require.NoError(t, err)
+		require.Less(t, len(listResponse.Key), keys)
+		for _, key := range listResponse.Key {
+			held[key]++
+		}
+
+		for i := 0; i < keys; i++ {
+			getResponse, err := client(t, agent, tlsConfig).GetKey(
+				context.Background(),
+				&api.GetRequest{Key: fmt.Sprintf("key%d", i)},
+			)
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("value%d", i)), getResponse.Value)
+		}
+	}
+	require.Len(t, held, keys)
+	for key, n := range held {
+		require.Equal(t, replicationFactor, n, key)
+	}
+}
@@ -1,6 +1,7 @@
 package discovery
 
 import (
+	"errors"
 	"github.com/hashicorp/serf/serf"
 	"go.uber.org/zap"
 	"net"
@@ -26,6 +27,29 @@ type Handler interface {
 	Leave(name string) error
 }
 
+// FailHandler is a Handler told apart when a member fails, rather than
+// leaving of its own accord, and may come back. Handlers without it have
+// failed members leave.
+type FailHandler interface {
+	Handler
+	Fail(name string) error
+}
+
+// ReplicaHandler is a Handler told apart when a member joining is a
+// read-only replica, which takes no writes of its own. Handlers without it
+// have replicas join like any other member.
+type ReplicaHandler interface {
+	Handler
+	JoinReplica(name, addr string) error
+}
+
+const (
+	// Tag naming the role a member plays in the cluster
+	RoleTag = "role"
+	// Role of a member that receives replication, but takes no writes
+	RoleReplica = "replica"
+)
+
 func New(handler Handler, config Config) (*Membership, error) {
 	c := &Membership{
 		Config:  config,
@@ -88,7 +112,7 @@ func (m *Membership) eventHandler() {
 			}
 
 		// If a member leaves, or there is an issue joining
-		case serf.EventMemberLeave, serf.EventMemberFailed:
+		case serf.EventMemberLeave:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
 					return
@@ -96,12 +120,25 @@ func (m *Membership) eventHandler() {
 				m.handleLeave(member)
 			}
 
+		// If a member stops responding
+		case serf.EventMemberFailed:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleFail(member)
+			}
+
 		}
 	}
 }
 
 func (m *Membership) handleJoin(member serf.Member) {
-	if err := m.handler.Join(
+	join := m.handler.Join
+	if member.Tags[RoleTag] == RoleReplica {
+		join = func(name, addr string) error { return joinReplica(m.handler, name, addr) }
+	}
+	if err := join(
 		member.Name,
 		member.Tags["rpc_addr"],
 	); err != nil {
@@ -117,6 +154,30 @@ func (m *Membership) handleLeave(member serf.Member) {
 	}
 }
 
+func (m *Membership) handleFail(member serf.Member) {
+	if err := fail(m.handler, member.Name); err != nil {
+		m.logError(err, "failed to mark failed", member)
+	}
+}
+
+// Tell the handler the member failed, or that it left if it cannot tell the
+// two apart
+func fail(handler Handler, name string) error {
+	if h, ok := handler.(FailHandler); ok {
+		return h.Fail(name)
+	}
+	return handler.Leave(name)
+}
+
+// Tell the handler a replica joined, or that a member joined if it cannot
+// tell the two apart
+func joinReplica(handler Handler, name, addr string) error {
+	if h, ok := handler.(ReplicaHandler); ok {
+		return h.JoinReplica(name, addr)
+	}
+	return handler.Join(name, addr)
+}
+
 func (m *Membership) isLocal(member serf.Member) bool {
 	return m.serf.LocalMember().Name == member.Name
 }
@@ -137,3 +198,38 @@ func (m *Membership) logError(err error, msg string, member serf.Member) {
 		zap.String("rpc_addr", member.Tags["rpc_addr"]),
 	)
 }
+
+// Handlers passes membership changes on to each of several handlers in turn
+type Handlers []Handler
+
+func (hs Handlers) Join(name, addr string) error {
+	var errs []error
+	for _, h := range hs {
+		errs = append(errs, h.Join(name, addr))
+	}
+	return errors.Join(errs...)
+}
+
+func (hs Handlers) Leave(name string) error {
+	var errs []error
+	for _, h := range hs {
+		errs = append(errs, h.Leave(name))
+	}
+	return errors.Join(errs...)
+}
+
+func (hs Handlers) Fail(name string) error {
+	var errs []error
+	for _, h := range hs {
+		errs = append(errs, fail(h, name))
+	}
+	return errors.Join(errs...)
+}
+
+func (hs Handlers) JoinReplica(name, addr string) error {
+	var errs []error
+	for _, h := range hs {
+		errs = append(errs, joinReplica(h, name, addr))
+	}
+	return errors.Join(errs...)
+}
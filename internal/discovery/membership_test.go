@@ -82,3 +82,47 @@ func (h *handler) Leave(id string) error {
 	}
 	return nil
 }
+
+func TestHandlersFail(t *testing.T) {
+	plain := &handler{leaves: make(chan string, 1)}
+	failing := &failHandler{handler: handler{leaves: make(chan string, 1)}}
+	require.NoError(t, Handlers{failing, plain}.Fail("1"))
+
+	// Handlers that tell failures apart hear of them, and the rest see the
+	// member leave
+	require.Equal(t, []string{"1"}, failing.failed)
+	require.Empty(t, failing.leaves)
+	require.Equal(t, "1", <-plain.leaves)
+}
+
+type failHandler struct {
+	handler
+	failed []string
+}
+
+func (h *failHandler) Fail(id string) error {
+	h.failed = append(h.failed, id)
+	return nil
+}
+
+func TestHandlersJoinReplica(t *testing.T) {
+	plain := &handler{joins: make(chan map[string]string, 1)}
+	replicas := &replicaHandler{handler: handler{joins: make(chan map[string]string, 1)}}
+	require.NoError(t, Handlers{replicas, plain}.JoinReplica("1", "addr"))
+
+	// Handlers that tell replicas apart hear of them, and the rest see a
+	// member join
+	require.Equal(t, []string{"1"}, replicas.replicas)
+	require.Empty(t, replicas.joins)
+	require.Equal(t, map[string]string{"id": "1", "addr": "addr"}, <-plain.joins)
+}
+
+type replicaHandler struct {
+	handler
+	replicas []string
+}
+
+func (h *replicaHandler) JoinReplica(id, addr string) error {
+	h.replicas = append(h.replicas, id)
+	return nil
+}
@@ -0,0 +1,207 @@
+package keymap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// A hint file sits beside a closed segment and holds just enough to index it
+// without reading any values:
+//
+//	magic | version | segment | segment size | count | entries... | crc32
+//
+// where each entry is
+//
+//	flags | key length | segment | offset | size | timestamp | expire at | sequence | digest |
+//	origin length | key | origin
+//
+// A checkpoint of the whole keymap is laid out the same way, with its own
+// magic, and the segment and offset the part of the log it covers ends at in
+// place of the segment and its size. A hint file leaves the segment at zero.
+const (
+	hintMagic       uint16 = 0x6768 // "gh"
+	checkpointMagic uint16 = 0x6763 // "gc"
+	hintVersion     uint8  = 6
+
+	hintHeaderWidth = 2 + 1 + 4 + 8 + 4
+	hintEntryWidth  = 1 + 4 + 4 + 8 + 8 + 8 + 8 + 8 + 8 + 2
+	hintCRCWidth    = 4
+)
+
+// Hint flags
+const (
+	hintTombstone uint8 = 1 << iota
+	hintEvicted
+)
+
+var (
+	enc = binary.BigEndian
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrInvalidHint is returned when a hint file is truncated or corrupt
+	ErrInvalidHint = errors.New("invalid hint file")
+)
+
+// Hint points a key at its record in a segment
+type Hint struct {
+	Key       string
+	Tombstone bool
+	// The version of the key was dropped from the store, rather than
+	// written, so the key is no longer there. Only the journal holds these.
+	Evicted bool
+	KeyInfo
+}
+
+// Encode a hint as a single entry
+func encodeHint(hint Hint) []byte {
+	entry := make([]byte, hintEntryWidth+len(hint.Key)+len(hint.Origin))
+	if hint.Tombstone {
+		entry[0] |= hintTombstone
+	}
+	if hint.Evicted {
+		entry[0] |= hintEvicted
+	}
+	enc.PutUint32(entry[1:], uint32(len(hint.Key)))
+	enc.PutUint32(entry[5:], hint.Segment)
+	enc.PutUint64(entry[9:], hint.Offset)
+	enc.PutUint64(entry[17:], hint.Size)
+	enc.PutUint64(entry[25:], uint64(hint.Timestamp))
+	enc.PutUint64(entry[33:], uint64(hint.ExpireAt))
+	enc.PutUint64(entry[41:], hint.Seq)
+	enc.PutUint64(entry[49:], hint.Digest)
+	enc.PutUint16(entry[57:], uint16(len(hint.Origin)))
+	copy(entry[hintEntryWidth:], hint.Key)
+	copy(entry[hintEntryWidth+len(hint.Key):], hint.Origin)
+	return entry
+}
+
+// Decode the entry at the start of b, returning it with its encoded length
+func decodeHint(b []byte) (Hint, int, error) {
+	if len(b) < hintEntryWidth {
+		return Hint{}, 0, ErrInvalidHint
+	}
+	keyEnd := hintEntryWidth + int(enc.Uint32(b[1:]))
+	n := keyEnd + int(enc.Uint16(b[57:]))
+	if len(b) < n {
+		return Hint{}, 0, ErrInvalidHint
+	}
+	return Hint{Key: string(b[hintEntryWidth:keyEnd]),
+		Tombstone: b[0]&hintTombstone != 0,
+		Evicted:   b[0]&hintEvicted != 0,
+		KeyInfo: KeyInfo{Size: enc.Uint64(b[17:]),
+			Segment:   enc.Uint32(b[5:]),
+			Offset:    enc.Uint64(b[9:]),
+			Timestamp: int64(enc.Uint64(b[25:])),
+			ExpireAt:  int64(enc.Uint64(b[33:])),
+			Seq:       enc.Uint64(b[41:]),
+			Digest:    enc.Uint64(b[49:]),
+			Origin:    string(b[keyEnd:n])}}, n, nil
+}
+
+// Position is a point in the store's log, between two records
+type Position struct {
+	Segment uint32
+	Offset  uint64
+}
+
+// WriteHint writes the hints for a segment of the given size to path, and
+// syncs it to disk
+func WriteHint(path string, segmentSize uint64, hints []Hint) error {
+	return writeHints(path, hintMagic, Position{Offset: segmentSize}, hints)
+}
+
+// ReadHint reads the hints from path, along with the size of the segment
+// they were written for
+func ReadHint(path string) (uint64, []Hint, error) {
+	end, hints, err := readHints(path, hintMagic)
+	return end.Offset, hints, err
+}
+
+// WriteCheckpoint writes a checkpoint of the whole keymap to path, covering
+// the log up to end, and syncs it to disk
+func WriteCheckpoint(path string, end Position, hints []Hint) error {
+	return writeHints(path, checkpointMagic, end, hints)
+}
+
+// ReadCheckpoint reads a checkpoint of the whole keymap from path, along with
+// where the part of the log it covers ends
+func ReadCheckpoint(path string) (Position, []Hint, error) {
+	return readHints(path, checkpointMagic)
+}
+
+func writeHints(path string, magic uint16, end Position, hints []Hint) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating hint file: %w", err)
+	}
+	defer file.Close()
+
+	crc := crc32.New(crcTable)
+	buf := bufio.NewWriter(file)
+	w := func(b []byte) {
+		buf.Write(b)
+		crc.Write(b)
+	}
+
+	header := make([]byte, hintHeaderWidth)
+	enc.PutUint16(header[0:], magic)
+	header[2] = hintVersion
+	enc.PutUint32(header[3:], end.Segment)
+	enc.PutUint64(header[7:], end.Offset)
+	enc.PutUint32(header[15:], uint32(len(hints)))
+	w(header)
+
+	for _, hint := range hints {
+		w(encodeHint(hint))
+	}
+
+	trailer := make([]byte, hintCRCWidth)
+	enc.PutUint32(trailer, crc.Sum32())
+	if _, err := buf.Write(trailer); err != nil {
+		return fmt.Errorf("error writing hint file: %w", err)
+	}
+	if err := buf.Flush(); err != nil {
+		return fmt.Errorf("error writing hint file: %w", err)
+	}
+	return file.Sync()
+}
+
+func readHints(path string, magic uint16) (Position, []Hint, error) {
+	var end Position
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return end, nil, err
+	}
+	if len(b) < hintHeaderWidth+hintCRCWidth {
+		return end, nil, ErrInvalidHint
+	}
+	body := b[:len(b)-hintCRCWidth]
+	if crc32.Checksum(body, crcTable) != enc.Uint32(b[len(body):]) {
+		return end, nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidHint)
+	}
+	if enc.Uint16(body[0:]) != magic || body[2] != hintVersion {
+		return end, nil, fmt.Errorf("%w: unknown format", ErrInvalidHint)
+	}
+	end = Position{Segment: enc.Uint32(body[3:]), Offset: enc.Uint64(body[7:])}
+	count := enc.Uint32(body[15:])
+
+	hints := make([]Hint, 0, count)
+	pos := hintHeaderWidth
+	for i := uint32(0); i < count; i++ {
+		hint, n, err := decodeHint(body[pos:])
+		if err != nil {
+			return end, nil, err
+		}
+		hints = append(hints, hint)
+		pos += n
+	}
+	if pos != len(body) {
+		return end, nil, ErrInvalidHint
+	}
+	return end, hints, nil
+}
@@ -0,0 +1,117 @@
+package keymap
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	journalCRCWidth = 4
+)
+
+// Journal is an append-only log of keymap updates made since the last
+// checkpoint. Each entry is a hint prefixed with its own checksum, so a torn
+// final entry can be told apart and dropped.
+type Journal struct {
+	file    *os.File
+	buf     *bufio.Writer
+	entries uint64
+}
+
+// OpenJournal opens the journal at path, creating it if needed, and returns
+// the entries already in it. A torn final entry is truncated away.
+func OpenJournal(path string) (*Journal, []Hint, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening journal: %w", err)
+	}
+	b, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error reading journal: %w", err)
+	}
+
+	var hints []Hint
+	pos := 0
+	for pos+journalCRCWidth < len(b) {
+		hint, n, err := decodeHint(b[pos+journalCRCWidth:])
+		if err != nil {
+			break
+		}
+		entry := b[pos+journalCRCWidth : pos+journalCRCWidth+n]
+		if crc32.Checksum(entry, crcTable) != enc.Uint32(b[pos:]) {
+			break
+		}
+		hints = append(hints, hint)
+		pos += journalCRCWidth + n
+	}
+	if err := file.Truncate(int64(pos)); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error truncating journal: %w", err)
+	}
+	if _, err := file.Seek(int64(pos), io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error seeking journal: %w", err)
+	}
+
+	return &Journal{file: file,
+		buf:     bufio.NewWriter(file),
+		entries: uint64(len(hints))}, hints, nil
+}
+
+// Append buffers an entry for the journal
+func (j *Journal) Append(hint Hint) error {
+	entry := encodeHint(hint)
+	crc := make([]byte, journalCRCWidth)
+	enc.PutUint32(crc, crc32.Checksum(entry, crcTable))
+	if _, err := j.buf.Write(crc); err != nil {
+		return err
+	}
+	if _, err := j.buf.Write(entry); err != nil {
+		return err
+	}
+	j.entries++
+	return nil
+}
+
+// Entries returns the number of entries in the journal
+func (j *Journal) Entries() uint64 {
+	return j.entries
+}
+
+// Flush writes the buffered entries to the journal file
+func (j *Journal) Flush() error {
+	return j.buf.Flush()
+}
+
+// Sync flushes the buffered entries and syncs the journal to disk
+func (j *Journal) Sync() error {
+	if err := j.buf.Flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Reset empties the journal, once its entries are covered by a checkpoint
+func (j *Journal) Reset() error {
+	j.buf.Reset(j.file)
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	j.entries = 0
+	return nil
+}
+
+// Close flushes and closes the journal
+func (j *Journal) Close() error {
+	if err := j.Sync(); err != nil {
+		return err
+	}
+	return j.file.Close()
+}
@@ -1,11 +1,7 @@
 package keymap
 
 import (
-	"encoding/gob"
-	"fmt"
-	"os"
-
-	// "path/filepath"
+	"sort"
 	"sync"
 )
 
@@ -14,8 +10,29 @@ const (
 )
 
 type KeyInfo struct {
-	Size   uint64
-	Offset uint64
+	Size      uint64
+	Segment   uint32
+	Offset    uint64
+	Timestamp int64
+	ExpireAt  int64 // Unix nanoseconds, or 0 if the key never expires
+	Seq       uint64 // Sequence number of the record in the store's log
+	Origin    string // Node the record was first written on
+	Digest    uint64 // Hash of the version, folded into the store's Merkle tree
+}
+
+// Expired reports whether the key has expired as of now, in Unix nanoseconds
+func (k *KeyInfo) Expired(now int64) bool {
+	return k.ExpireAt != 0 && k.ExpireAt <= now
+}
+
+// Before reports whether the record is an older version of the key than o.
+// Versions are ordered by timestamp, with ties between nodes broken by origin,
+// so every node picks the same winner.
+func (k *KeyInfo) Before(o *KeyInfo) bool {
+	if k.Timestamp != o.Timestamp {
+		return k.Timestamp < o.Timestamp
+	}
+	return k.Origin < o.Origin
 }
 
 // Simple abstraction to manage key lookups
@@ -23,80 +40,53 @@ type KeyInfo struct {
 type KeyMap map[string]*KeyInfo
 
 type SafeMap struct {
-	File  		*os.File
 	FileLock  sync.RWMutex
 	Map   	  KeyMap
+	// Deleted keys, pointing at their tombstone records
+	Tombstones KeyMap
 }
 
 
-// Instantiate a New SafeMap based on the directory of the KV Store
-func NewMap(dir string) (*SafeMap, error) {
-	// Create new if it doesn't exist
-	mapString := dir + "/" + "keymap"
-	mapFile, err := os.Create(mapString)
-	if err != nil {
-		fmt.Errorf("error opening file for writing Keymap: %w", err)
-		return nil, err
-	}
-
+// Instantiate a New SafeMap. The map is rebuilt from the store's segments
+// and their hint files, rather than saved on its own.
+func NewMap() *SafeMap {
 	mapobj := make(KeyMap, 0)
 
 	return &SafeMap{
-		File: mapFile,
 		FileLock: sync.RWMutex{},
 		Map: mapobj,
-	}, nil
-
-
-} 
-
-// The following methods
-// As the KeyMap is Updated, the map will be saved to a file
-func (k *SafeMap) SaveMap() error {
-
-	defer k.File.Close()
-	// Instantiate a new Gob Encoder
-	enc := gob.NewEncoder(k.File)
-	err := enc.Encode(k.Map)
-	if err != nil {
-		return fmt.Errorf("error saving KeyMap: %w", err)
+		Tombstones: make(KeyMap),
 	}
-
-	return nil
-
 }
 
-func (k *SafeMap) LoadMap() error {
-
-	defer k.File.Close()
-
-	// Instantiate a new Gob Encoder
-	enc := gob.NewDecoder(k.File)
-	if err := enc.Decode(&k.Map); err != nil {
-		return fmt.Errorf("error loading KeyMap: %w", err)
+// Hints returns a hint for every key in the map, live or deleted, to
+// checkpoint the whole map. The caller must hold FileLock.
+func (k *SafeMap) Hints() []Hint {
+	hints := make([]Hint, 0, len(k.Map)+len(k.Tombstones))
+	for key, keyinfo := range k.Map {
+		hints = append(hints, Hint{Key: key, KeyInfo: *keyinfo})
 	}
-
-	return nil
-
+	for key, keyinfo := range k.Tombstones {
+		hints = append(hints, Hint{Key: key, Tombstone: true, KeyInfo: *keyinfo})
+	}
+	return hints
 }
 
-func (k *SafeMap) SaveMap2(dir string, uid uint64) error {
-
-	// Create new if it doesn't exist
-	mapfile, err := os.Create("/Users/jscoran/godis/godis_keymap2")
-	if err != nil {
-		return fmt.Errorf("error creating file for writing to keymap: %w", err)
+// SegmentHints returns the hints for the keys whose records are in the
+// segment, in the order the records were written. The caller must hold
+// FileLock.
+func (k *SafeMap) SegmentHints(segment uint32) []Hint {
+	var hints []Hint
+	for key, keyinfo := range k.Map {
+		if keyinfo.Segment == segment {
+			hints = append(hints, Hint{Key: key, KeyInfo: *keyinfo})
+		}
 	}
-
-	defer mapfile.Close()
-
-	// Instantiate a new Gob Encoder
-	enc := gob.NewEncoder(mapfile)
-	err = enc.Encode(k.Map)
-	if err != nil {
-		return fmt.Errorf("error saving KeyMap: %w", err)
+	for key, keyinfo := range k.Tombstones {
+		if keyinfo.Segment == segment {
+			hints = append(hints, Hint{Key: key, Tombstone: true, KeyInfo: *keyinfo})
+		}
 	}
-
-	return nil
-
+	sort.Slice(hints, func(i, j int) bool { return hints[i].Offset < hints[j].Offset })
+	return hints
 }
@@ -0,0 +1,118 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	api "github.com/jscottransom/distributed_godis/api"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// Periodically run anti-entropy with every peer, catching whatever the
+// replication streams missed while they were down
+func (r *Replicator) antiEntropyLoop() {
+	ticker := time.NewTicker(r.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+			if _, err := r.AntiEntropy(context.Background()); err != nil {
+				r.logger.Error("failed to run anti-entropy", zap.Error(err))
+			}
+		}
+	}
+}
+
+// AntiEntropy compares the local Merkle tree with every peer's, and pulls the
+// keys in the ranges where they differ. Each side pulls what it is missing, so
+// a round on every node brings them all in line. It returns the number of
+// records applied.
+func (r *Replicator) AntiEntropy(ctx context.Context) (uint64, error) {
+	r.mu.Lock()
+	r.init()
+	peers := make(map[string]string, len(r.peers))
+	for name, addr := range r.peers {
+		peers[name] = addr
+	}
+	r.mu.Unlock()
+
+	var repaired uint64
+	var errs []error
+	for name, addr := range peers {
+		n, err := r.repair(ctx, name, addr)
+		repaired += n
+		if err != nil {
+			r.logError(err, "failed to repair from peer", addr)
+			errs = append(errs, err)
+		}
+	}
+	return repaired, errors.Join(errs...)
+}
+
+// Pull the keys that differ from a single peer
+func (r *Replicator) repair(ctx context.Context, name, addr string) (uint64, error) {
+	cc, err := grpc.NewClient(addr, r.DialOptions...)
+	if err != nil {
+		return 0, err
+	}
+	defer cc.Close()
+	client := api.NewGodisServiceClient(cc)
+
+	// Only the keys both nodes hold are compared: those the peer owns, that
+	// this node owns too unless it keeps every key
+	owners := []string{name}
+	if r.Owns != nil {
+		owners = append(owners, r.NodeID)
+	}
+	local, err := r.LocalServer.GetMerkleTree(ctx, &api.MerkleTreeRequest{Owners: owners})
+	if err != nil {
+		return 0, err
+	}
+	remote, err := client.GetMerkleTree(ctx, &api.MerkleTreeRequest{Owners: owners})
+	if err != nil {
+		return 0, err
+	}
+	buckets := MerkleTree(local.Nodes).Diff(remote.Nodes)
+	if len(buckets) == 0 {
+		return 0, nil
+	}
+
+	stream, err := client.ConsumeRange(ctx, &api.RangeRequest{Buckets: buckets, Owners: owners})
+	if err != nil {
+		return 0, err
+	}
+	var repaired uint64
+	for {
+		record, err := stream.Recv()
+		if err == io.EOF {
+			return repaired, nil
+		}
+		if err != nil {
+			return repaired, err
+		}
+		// The rings of the two nodes can disagree while members come and go
+		if !r.owns(record.Key) {
+			continue
+		}
+
+		// Versions are compared by the local store, so nothing older than
+		// what is here is applied
+		origin := record.Origin
+		if origin == "" {
+			origin = name
+		}
+		applied, err := r.write(ctx, record, origin, record.OriginSeq)
+		if err != nil {
+			return repaired, err
+		}
+		if applied {
+			repaired++
+		}
+	}
+}
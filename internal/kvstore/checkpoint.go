@@ -0,0 +1,103 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+
+	kmap "github.com/jscottransom/distributed_godis/internal/keymap"
+)
+
+// Load the keymap from the last checkpoint and replay the journal over it.
+// Evictions in the journal drop the keys again.
+// It returns whether a checkpoint was loaded, along with where the part of
+// the log the checkpoint and journal cover ends; records after it are not yet
+// indexed.
+// A journal without a checkpoint to go with it is discarded, as is a
+// checkpoint that points outside the segments on disk.
+// The caller must hold Keymap.FileLock.
+func (s *KVstore) loadCheckpoint() (bool, kmap.Position, error) {
+	journal, journaled, err := kmap.OpenJournal(s.dir + "/" + s.name + journalSuffix)
+	if err != nil {
+		return false, kmap.Position{}, err
+	}
+	s.journal = journal
+
+	pos, hints, err := kmap.ReadCheckpoint(s.dir + "/" + s.name + checkpointSuffix)
+	if err != nil {
+		return false, pos, s.journal.Reset()
+	}
+	if seg, ok := s.segments[pos.Segment]; !ok || pos.Offset > seg.size {
+		return false, pos, s.journal.Reset()
+	}
+	hints = append(hints, journaled...)
+	for _, hint := range hints {
+		seg, ok := s.segments[hint.Segment]
+		if !ok || hint.Offset+hint.Size > seg.size {
+			return false, pos, s.journal.Reset()
+		}
+	}
+
+	for _, hint := range hints {
+		keyinfo := hint.KeyInfo
+		if hint.Evicted {
+			s.evict(hint.Key, &keyinfo)
+			continue
+		}
+		s.index(hint.Key, &keyinfo, hint.Tombstone)
+		if keyinfo.Timestamp > s.lastTimestamp {
+			s.lastTimestamp = keyinfo.Timestamp
+		}
+		if keyinfo.Seq > s.lastSeq {
+			s.lastSeq = keyinfo.Seq
+		}
+	}
+
+	// The journal covers the records it has entries for, which may run past
+	// the checkpoint
+	for _, hint := range journaled {
+		end := kmap.Position{Segment: hint.Segment, Offset: hint.Offset + hint.Size}
+		if end.Segment > pos.Segment || end.Segment == pos.Segment && end.Offset > pos.Offset {
+			pos = end
+		}
+	}
+	return true, pos, nil
+}
+
+// Write a checkpoint of the whole keymap, and empty the journal it replaces.
+// The records the keymap points at are flushed first, so the checkpoint never
+// points past the end of a segment on disk.
+// The caller must hold s.mu and Keymap.FileLock.
+func (s *KVstore) checkpoint() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	path := s.dir + "/" + s.name + checkpointSuffix
+	end := kmap.Position{Segment: s.active.id, Offset: s.active.size}
+	if err := kmap.WriteCheckpoint(path+tmpSuffix, end, s.Keymap.Hints()); err != nil {
+		os.Remove(path + tmpSuffix)
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+	if err := os.Rename(path+tmpSuffix, path); err != nil {
+		return fmt.Errorf("error swapping in checkpoint: %w", err)
+	}
+	return s.journal.Reset()
+}
+
+// Whether the journal has grown long enough to fold into a checkpoint.
+// The caller must hold Keymap.FileLock.
+func (s *KVstore) checkpointDue() bool {
+	entries := s.journal.Entries()
+	keys := uint64(len(s.Keymap.Map) + len(s.Keymap.Tombstones))
+	return entries >= s.Config.Checkpoint.Entries && entries >= keys
+}
+
+// Drop the checkpoint and journal, for when the segments they point into
+// are about to be rewritten. The caller must hold s.mu.
+func (s *KVstore) dropCheckpoint() error {
+	err := os.Remove(s.dir + "/" + s.name + checkpointSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.journal.Reset()
+}
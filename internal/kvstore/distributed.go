@@ -1,17 +1,607 @@
 package kvstore
 
-// import (
-// 	"bytes"
-// 	"crypto/tls"
-// 	"fmt"
-// 	"io"
-// 	"net"
-// 	"os"
-// 	"path/filepath"
-// 	"time"
-// 	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
-// 	"google.golang.org/protobuf/proto"
-// 	"github.com/hashicorp/raft"
-
-// 	api "github.com/jscottransom/distributed_godis/api"
-// )
\ No newline at end of file
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/jscottransom/distributed_godis/api"
+)
+
+// DistributedKVstore replicates a KVstore with raft. Writes go through the
+// raft log and are applied to the local store on every server once they are
+// committed, so a write acknowledged by the leader is seen by all later
+// writes on any server. Reads are served by the local store. Expired keys are
+// swept by the leader through the raft log too, rather than by each local
+// store on its own.
+type DistributedKVstore struct {
+	*KVstore
+	config    DistributedConfig
+	raft      *raft.Raft
+	boltStore *raftboltdb.BoltStore
+}
+
+type DistributedConfig struct {
+	Store Config
+	Raft  struct {
+		raft.Config
+		StreamLayer *StreamLayer
+		// Start a new cluster with this server as its only member
+		Bootstrap bool
+	}
+}
+
+func NewDistributedKVstore(dataDir, name string, config DistributedConfig) (*DistributedKVstore, error) {
+	storeConfig := config.Store
+	storeConfig.Expire.Interval = -1
+	store, err := NewKVstore(dataDir, name, storeConfig)
+	if err != nil {
+		return nil, err
+	}
+	d := &DistributedKVstore{KVstore: store,
+		config: config}
+	if err := d.setupRaft(dataDir); err != nil {
+		if d.boltStore != nil {
+			d.boltStore.Close()
+		}
+		store.Close()
+		return nil, err
+	}
+
+	interval := config.Store.Expire.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	if interval > 0 {
+		go d.expireLoop(interval)
+	}
+	return d, nil
+}
+
+func (d *DistributedKVstore) setupRaft(dataDir string) error {
+	raftDir := filepath.Join(dataDir, "raft")
+	if err := os.MkdirAll(raftDir, 0755); err != nil {
+		return fmt.Errorf("error creating raft directory: %w", err)
+	}
+
+	// The raft log and its stable state share a bolt database
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(raftDir, "raft.db"))
+	if err != nil {
+		return fmt.Errorf("error opening raft log: %w", err)
+	}
+	d.boltStore = boltStore
+	logStore, err := raft.NewLogCache(512, boltStore)
+	if err != nil {
+		return err
+	}
+
+	snapshotStore, err := raft.NewFileSnapshotStore(raftDir, 1, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("error opening raft snapshots: %w", err)
+	}
+
+	transport := raft.NewNetworkTransport(
+		d.config.Raft.StreamLayer,
+		5,
+		10*time.Second,
+		os.Stderr,
+	)
+
+	config := raft.DefaultConfig()
+	config.LocalID = d.config.Raft.LocalID
+	if d.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = d.config.Raft.HeartbeatTimeout
+	}
+	if d.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = d.config.Raft.ElectionTimeout
+	}
+	if d.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = d.config.Raft.LeaderLeaseTimeout
+	}
+	if d.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = d.config.Raft.CommitTimeout
+	}
+	if d.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = d.config.Raft.SnapshotThreshold
+	}
+
+	d.raft, err = raft.NewRaft(config, &fsm{store: d.KVstore}, logStore, boltStore, snapshotStore, transport)
+	if err != nil {
+		return fmt.Errorf("error starting raft: %w", err)
+	}
+
+	hasState, err := raft.HasExistingState(logStore, boltStore, snapshotStore)
+	if err != nil {
+		return err
+	}
+	if d.config.Raft.Bootstrap && !hasState {
+		config := raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}
+		err = d.raft.BootstrapCluster(config).Error()
+	}
+	return err
+}
+
+// Set the record through the raft log
+func (d *DistributedKVstore) Set(record Record) error {
+	_, err := d.apply(SetRequestType, &api.SetRequest{Key: record.Key,
+		Value:     record.Value,
+		ExpireAt:  UnixMilli(record.ExpireAt),
+		Origin:    record.Origin,
+		OriginSeq: record.OriginSeq,
+		Timestamp: record.Timestamp,
+		Context:   record.Clock.Context(),
+		Siblings:  APISiblings(record.Siblings)})
+	return err
+}
+
+// Delete the key through the raft log
+func (d *DistributedKVstore) Delete(key string) error {
+	return d.DeleteRecord(Record{Key: key})
+}
+
+// DeleteRecord deletes the record's key through the raft log
+func (d *DistributedKVstore) DeleteRecord(record Record) error {
+	_, err := d.apply(DeleteRequestType, &api.DeleteRequest{Key: record.Key,
+		Origin:    record.Origin,
+		OriginSeq: record.OriginSeq,
+		Timestamp: record.Timestamp,
+		Context:   record.Clock.Context()})
+	return err
+}
+
+// Expire the key through the raft log
+func (d *DistributedKVstore) Expire(key string, at time.Time) error {
+	_, err := d.apply(ExpireRequestType, &api.ExpireRequest{Key: key,
+		ExpireAt: UnixMilli(at)})
+	return err
+}
+
+// Persist the key through the raft log
+func (d *DistributedKVstore) Persist(key string) error {
+	return d.Expire(key, time.Time{})
+}
+
+// Periodically sweep the keys that have expired, while this server leads
+func (d *DistributedKVstore) expireLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+			if !d.IsLeader() {
+				continue
+			}
+			if _, err := d.SweepExpired(); err != nil {
+				zap.L().Named("kvstore").Error("failed to sweep expired keys", zap.Error(err))
+			}
+		}
+	}
+}
+
+// SweepExpired sweeps the keys that have expired through the raft log, each
+// server writing its tombstone as the sweep is applied. Only the leader can
+// sweep.
+func (d *DistributedKVstore) SweepExpired() (int, error) {
+	swept := 0
+	for key, at := range d.expired() {
+		res, err := d.apply(SweepRequestType, &api.ExpireRequest{Key: key,
+			ExpireAt: time.Unix(0, at).UnixMilli()})
+		if err != nil {
+			return swept, err
+		}
+		if res.(bool) {
+			swept++
+		}
+	}
+	return swept, nil
+}
+
+// Append the request to the raft log, stamped with this server's ID and the
+// time, and wait for it to be applied to the local store
+func (d *DistributedKVstore) apply(reqType RequestType, req proto.Message) (interface{}, error) {
+	d.mu.Lock()
+	at := stamp{origin: d.KVstore.Config.NodeID, timestamp: d.nextTimestamp()}
+	d.mu.Unlock()
+	entry, err := encodeEntry(reqType, at, req)
+	if err != nil {
+		return nil, err
+	}
+
+	future := d.raft.Apply(entry, 10*time.Second)
+	if future.Error() != nil {
+		return nil, future.Error()
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// IsLeader reports whether this server is the leader, and takes writes
+func (d *DistributedKVstore) IsLeader() bool {
+	return d.raft.State() == raft.Leader
+}
+
+// Leader returns the address of the current leader, or "" if there is none
+func (d *DistributedKVstore) Leader() string {
+	addr, _ := d.raft.LeaderWithID()
+	return string(addr)
+}
+
+// Join adds the server to the cluster. It is called on every server as
+// members join, and only does anything on the leader.
+func (d *DistributedKVstore) Join(id, addr string) error {
+	return d.join(id, addr, d.raft.AddVoter)
+}
+
+// JoinReplica adds a read-only replica to the cluster. It takes the raft log
+// as a nonvoter, so it never counts towards a quorum or stands for leader.
+func (d *DistributedKVstore) JoinReplica(id, addr string) error {
+	return d.join(id, addr, d.raft.AddNonvoter)
+}
+
+func (d *DistributedKVstore) join(id, addr string, add func(raft.ServerID, raft.ServerAddress, uint64, time.Duration) raft.IndexFuture) error {
+	if !d.IsLeader() {
+		return nil
+	}
+	configFuture := d.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				// Already a member
+				return nil
+			}
+			// Replace the stale entry for the server
+			if err := d.raft.RemoveServer(serverID, 0, 0).Error(); err != nil {
+				return err
+			}
+		}
+	}
+	return add(serverID, serverAddr, 0, 0).Error()
+}
+
+// Leave removes the server from the cluster. Like Join, it only does
+// anything on the leader.
+func (d *DistributedKVstore) Leave(id string) error {
+	if !d.IsLeader() {
+		return nil
+	}
+	return d.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// WaitForLeader blocks until the cluster has elected a leader, or the
+// timeout passes
+func (d *DistributedKVstore) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for leader")
+		case <-ticker.C:
+			if d.Leader() != "" {
+				return nil
+			}
+		}
+	}
+}
+
+// Close shuts down raft, then the local store
+func (d *DistributedKVstore) Close() error {
+	if err := d.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := d.boltStore.Close(); err != nil {
+		return err
+	}
+	return d.KVstore.Close()
+}
+
+// RequestType prefixes each entry in the raft log, saying which request
+// follows it. Every entry is laid out as
+//
+//	request type | timestamp | origin length | origin | request
+//
+// where the timestamp and origin are those the leader stamped the write with.
+// Applying an entry goes by them rather than the server's own clock and ID,
+// so every server ends up with the same records.
+type RequestType uint8
+
+const entryHeaderWidth = 1 + 8 + 2
+
+const (
+	SetRequestType RequestType = iota
+	DeleteRequestType
+	ExpireRequestType
+	SweepRequestType
+)
+
+func encodeEntry(reqType RequestType, at stamp, req proto.Message) ([]byte, error) {
+	if len(at.origin) > math.MaxUint16 {
+		return nil, fmt.Errorf("error encoding raft entry: origin is %d bytes long", len(at.origin))
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	entry := make([]byte, entryHeaderWidth+len(at.origin)+len(b))
+	entry[0] = byte(reqType)
+	enc.PutUint64(entry[1:], uint64(at.timestamp))
+	enc.PutUint16(entry[9:], uint16(len(at.origin)))
+	copy(entry[entryHeaderWidth+copy(entry[entryHeaderWidth:], at.origin):], b)
+	return entry, nil
+}
+
+// The finite state machine raft applies committed entries to
+type fsm struct {
+	store *KVstore
+}
+
+var _ raft.FSM = (*fsm)(nil)
+
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	if len(buf) < entryHeaderWidth || len(buf) < entryHeaderWidth+int(enc.Uint16(buf[9:])) {
+		return fmt.Errorf("raft entry %d is truncated", record.Index)
+	}
+	reqType := RequestType(buf[0])
+	originEnd := entryHeaderWidth + int(enc.Uint16(buf[9:]))
+	// The index of the entry stands in for the sequence number on the origin
+	at := &stamp{origin: string(buf[entryHeaderWidth:originEnd]),
+		originSeq: record.Index,
+		timestamp: int64(enc.Uint64(buf[1:]))}
+	data := buf[originEnd:]
+	switch reqType {
+	case SetRequestType:
+		var req api.SetRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		clock, err := ParseVectorClock(req.Context)
+		if err != nil {
+			return err
+		}
+		siblings, err := ParseSiblings(req.Siblings)
+		if err != nil {
+			return err
+		}
+		return f.store.set(Record{Key: req.Key,
+			Value:     req.Value,
+			ExpireAt:  FromUnixMilli(req.ExpireAt),
+			Origin:    req.Origin,
+			OriginSeq: req.OriginSeq,
+			Timestamp: req.Timestamp,
+			Clock:     clock,
+			Siblings:  siblings}, at)
+	case DeleteRequestType:
+		var req api.DeleteRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		clock, err := ParseVectorClock(req.Context)
+		if err != nil {
+			return err
+		}
+		return f.store.deleteRecord(Record{Key: req.Key,
+			Origin:    req.Origin,
+			OriginSeq: req.OriginSeq,
+			Timestamp: req.Timestamp,
+			Clock:     clock}, at)
+	case ExpireRequestType:
+		var req api.ExpireRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		return f.store.expire(req.Key, FromUnixMilli(req.ExpireAt), at)
+	case SweepRequestType:
+		var req api.ExpireRequest
+		if err := proto.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		swept, err := f.store.sweep(req.Key, expireAt(FromUnixMilli(req.ExpireAt)), at)
+		if err != nil {
+			return err
+		}
+		return swept
+	}
+	return fmt.Errorf("unknown raft request type %d", reqType)
+}
+
+// Snapshots are taken while writes carry on, so a snapshot may hold records
+// newer than the raft index it is taken at. Replaying the log after it on
+// restore sets and deletes the same keys again in order, so the store still
+// ends up where the log says it should be.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &snapshot{store: f.store,
+		keys:       f.store.Keys(),
+		tombstones: f.store.Tombstones()}, nil
+}
+
+// Restore replaces the contents of the store with the snapshot
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+
+	restored := make(map[string]struct{})
+	br := bufio.NewReader(r)
+	for {
+		// Raft hands over its own snapshot without saying how long it is
+		record, h, err := decodeRecord(br, math.MaxUint64)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error restoring snapshot: %w", err)
+		}
+		restored[record.Key] = struct{}{}
+		if err := f.store.restore(record, h.flags&flagTombstone); err != nil {
+			return err
+		}
+	}
+
+	// Drop whatever the snapshot does not know about
+	for _, key := range f.store.Keys() {
+		if _, ok := restored[key]; ok {
+			continue
+		}
+		if err := f.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a record from a raft snapshot as it is, keeping the timestamp and
+// origin it was written with, along with its clock and siblings
+func (s *KVstore) restore(record Record, flags uint8) error {
+	s.mu.Lock()
+	at := &stamp{origin: record.Origin, originSeq: record.OriginSeq, timestamp: record.Timestamp}
+	record.Timestamp = 0
+	err := s.append(record, flags, at)
+	seq := s.written
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.commit(seq)
+}
+
+// A snapshot is the live records of the store followed by its tombstones, in
+// the same format as the segments
+type snapshot struct {
+	store      *KVstore
+	keys       []string
+	tombstones []string
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+// Each record keeps the timestamp, origin and sequence number it was written
+// with, so the store it is restored into orders versions of its key as this
+// one does.
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	err := func() error {
+		for _, key := range append(s.keys, s.tombstones...) {
+			record, err := s.store.readFlushed(func() (LogRecord, error) { return s.store.readVersion(key) })
+			if errors.Is(err, ErrKeyNotFound) {
+				// Evicted since the snapshot was taken
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			var flags uint8
+			if record.Deleted {
+				flags = flagTombstone
+			}
+			data, err := encodeRecord(record.Record, flags, record.Timestamp, record.Offset)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}()
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
+
+// RaftRPC is the first byte of every raft connection, telling it apart from
+// the gRPC connections sharing the port
+const RaftRPC = 1
+
+// StreamLayer carries raft traffic over connections multiplexed with the
+// gRPC server on the RPC port
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+}
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
+	return &StreamLayer{ln: ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig}
+}
+
+func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+	// Identify the connection as raft to the listener on the other side
+	if _, err = conn.Write([]byte{byte(RaftRPC)}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		conn = tls.Client(conn, s.peerTLSConfig)
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1)
+	if _, err = conn.Read(b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+		conn.Close()
+		return nil, fmt.Errorf("not a raft rpc")
+	}
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
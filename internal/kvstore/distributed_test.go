@@ -0,0 +1,249 @@
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/jscottransom/distributed_godis/api"
+)
+
+func TestDistributedKVstore(t *testing.T) {
+	var stores []*DistributedKVstore
+	nodeCount := 3
+	ports := dynaport.Get(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-store-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+
+		config := DistributedConfig{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+		config.Store.Expire.Interval = 50 * time.Millisecond
+
+		s, err := NewDistributedKVstore(dataDir, STORE_TEMPLATE, config)
+		require.NoError(t, err)
+		defer s.Close()
+
+		if i != 0 {
+			require.NoError(t, stores[0].Join(fmt.Sprintf("%d", i), ln.Addr().String()))
+		} else {
+			require.NoError(t, s.WaitForLeader(3*time.Second))
+		}
+		stores = append(stores, s)
+	}
+
+	// Writes on the leader reach every server
+	records := []Record{
+		{Key: "hello", Value: []byte("world")},
+		{Key: "strange", Value: []byte("fruit")},
+		{Key: "session", Value: []byte("token"), ExpireAt: time.Now().Add(time.Hour)},
+	}
+	for _, record := range records {
+		require.NoError(t, stores[0].Set(record))
+	}
+	require.NoError(t, stores[0].Delete("strange"))
+	require.Eventually(t, func() bool {
+		for _, s := range stores {
+			value, err := s.Get("hello")
+			if err != nil || !bytes.Equal([]byte("world"), value) {
+				return false
+			}
+			if _, err := s.TTL("session"); err != nil {
+				return false
+			}
+			if _, err := s.Get("strange"); err != ErrKeyNotFound {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// Every server applies a write with the timestamp and origin the leader
+	// stamped it with
+	want, err := stores[0].GetVersion("hello")
+	require.NoError(t, err)
+	for _, s := range stores[1:] {
+		got, err := s.GetVersion("hello")
+		require.NoError(t, err)
+		require.Equal(t, want.Timestamp, got.Timestamp)
+		require.Equal(t, want.Origin, got.Origin)
+		require.Equal(t, want.OriginSeq, got.OriginSeq)
+	}
+
+	// Followers do not take writes themselves
+	require.True(t, stores[0].IsLeader())
+	require.False(t, stores[1].IsLeader())
+	require.Equal(t, stores[0].config.Raft.StreamLayer.Addr().String(), stores[1].Leader())
+	require.ErrorIs(t, stores[1].Set(Record{Key: "follower", Value: []byte("write")}), raft.ErrNotLeader)
+
+	// Expired keys are swept by the leader through the raft log, and deleted
+	// on every server
+	require.NoError(t, stores[0].Set(Record{Key: "brief", Value: []byte("token"), ExpireAt: time.Now().Add(100 * time.Millisecond)}))
+	require.Eventually(t, func() bool {
+		for _, s := range stores {
+			if !contains(s.Tombstones(), "brief") {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// A server that has left stops receiving writes
+	require.NoError(t, stores[0].Leave("1"))
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, stores[0].Set(Record{Key: "third", Value: []byte("record")}))
+	require.Eventually(t, func() bool {
+		_, err := stores[2].Get("third")
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	_, err = stores[1].Get("third")
+	require.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestFSMSiblings(t *testing.T) {
+	store, err := NewKVstore(t.TempDir(), STORE_TEMPLATE, Config{NodeID: "c", Siblings: true})
+	require.NoError(t, err)
+	defer store.Close()
+
+	// A write replicated with its siblings keeps every one of them
+	req := &api.SetRequest{Key: "key",
+		Value:     []byte("a"),
+		Origin:    "a",
+		OriginSeq: 1,
+		Timestamp: 1,
+		Context:   VectorClock{"a": 1, "b": 1}.Bytes(),
+		Siblings: []*api.Sibling{
+			{Value: []byte("a"), Clock: VectorClock{"a": 1}.Bytes()},
+			{Value: []byte("b"), Clock: VectorClock{"b": 1}.Bytes()},
+		}}
+	res := (&fsm{store: store}).Apply(&raft.Log{Data: entry(t, SetRequestType, stamp{origin: "c", timestamp: 2}, req)})
+	require.Nil(t, res)
+
+	record, err := store.GetRecord("key")
+	require.NoError(t, err)
+	require.Len(t, record.Siblings, 2)
+	require.Equal(t, []byte("b"), record.Siblings[1].Value)
+}
+
+func TestFSMDeterministic(t *testing.T) {
+	var stores []*KVstore
+	for _, node := range []string{"a", "b"} {
+		store, err := NewKVstore(t.TempDir(), STORE_TEMPLATE, Config{NodeID: node, Siblings: true})
+		require.NoError(t, err)
+		defer store.Close()
+		stores = append(stores, store)
+	}
+
+	// The same entries, applied on servers with their own IDs and clocks,
+	// leave the same records behind. The expiry is applied as of the time the
+	// leader stamped it with, after the key had expired, however late it
+	// reaches each server.
+	expired := time.Now().Add(-time.Hour)
+	entries := [][]byte{
+		entry(t, SetRequestType, stamp{origin: "leader", timestamp: 1}, &api.SetRequest{Key: "key", Value: []byte("value")}),
+		entry(t, SetRequestType, stamp{origin: "leader", timestamp: 2}, &api.SetRequest{Key: "brief", Value: []byte("value"), ExpireAt: expired.UnixMilli()}),
+		entry(t, ExpireRequestType, stamp{origin: "leader", timestamp: expired.UnixNano() + 1}, &api.ExpireRequest{Key: "brief"}),
+		entry(t, DeleteRequestType, stamp{origin: "leader", timestamp: 4}, &api.DeleteRequest{Key: "gone"}),
+		entry(t, SweepRequestType, stamp{origin: "leader", timestamp: 5}, &api.ExpireRequest{Key: "brief", ExpireAt: expired.UnixMilli()}),
+	}
+	for _, store := range stores {
+		for i, data := range entries {
+			res := (&fsm{store: store}).Apply(&raft.Log{Index: uint64(i + 1), Data: data})
+			if i == 2 {
+				require.ErrorIs(t, res.(error), ErrKeyNotFound)
+			}
+		}
+	}
+	for _, key := range []string{"key", "brief", "gone"} {
+		want, err := stores[0].GetVersion(key)
+		require.NoError(t, err)
+		require.Equal(t, "leader", want.Origin)
+		got, err := stores[1].GetVersion(key)
+		require.NoError(t, err)
+		require.Equal(t, want, got, key)
+	}
+	version, err := stores[0].GetVersion("key")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version.Timestamp)
+	require.Equal(t, uint64(1), version.OriginSeq)
+	require.Equal(t, VectorClock{"leader": 1}, version.Clock)
+	require.Equal(t, []string{"brief", "gone"}, stores[1].Tombstones())
+}
+
+func entry(t *testing.T, reqType RequestType, at stamp, req proto.Message) []byte {
+	data, err := encodeEntry(reqType, at, req)
+	require.NoError(t, err)
+	return data
+}
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	// Restoring replaces whatever the target held before
+	target, err := NewKVstore(t.TempDir(), STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	defer target.Close()
+	require.NoError(t, target.Set(Record{Key: "stale", Value: []byte("key")}))
+	require.NoError(t, target.Set(Record{Key: "strange", Value: []byte("fruit")}))
+
+	source, err := NewKVstore(t.TempDir(), STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	defer source.Close()
+	require.NoError(t, source.Set(Record{Key: "hello", Value: []byte("world")}))
+	require.NoError(t, source.Set(Record{Key: "session", Value: []byte("token"), ExpireAt: time.Now().Add(time.Hour)}))
+	require.NoError(t, source.Delete("strange"))
+
+	snap, err := (&fsm{store: source}).Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	require.NoError(t, (&fsm{store: target}).Restore(io.NopCloser(&sink.Buffer)))
+	require.Equal(t, []string{"hello", "session"}, target.Keys())
+
+	// Records keep the version they were written with
+	for _, key := range []string{"hello", "strange"} {
+		want, err := source.GetVersion(key)
+		require.NoError(t, err)
+		got, err := target.GetVersion(key)
+		require.NoError(t, err)
+		require.Equal(t, want.Timestamp, got.Timestamp)
+		require.Equal(t, want.Origin, got.Origin)
+	}
+	require.Equal(t, []string{"stale", "strange"}, target.Tombstones())
+	value, err := target.Get("hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), value)
+	ttl, err := target.TTL("session")
+	require.NoError(t, err)
+	require.True(t, ttl > 0)
+}
+
+type snapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *snapshotSink) ID() string    { return "test" }
+func (s *snapshotSink) Cancel() error { return nil }
+func (s *snapshotSink) Close() error  { return nil }
@@ -0,0 +1,158 @@
+package kvstore
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// NoExpiry is the TTL of a key that never expires
+const NoExpiry time.Duration = -1
+
+// Periodically sweep the keys that have expired
+func (s *KVstore) expireLoop() {
+	ticker := time.NewTicker(s.Config.Expire.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			if _, err := s.SweepExpired(); err != nil {
+				zap.L().Named("kvstore").Error("failed to sweep expired keys", zap.Error(err))
+			}
+		}
+	}
+}
+
+// SweepExpired writes tombstones for the keys that have expired, so they are
+// deleted for good and their space can be merged away. Expired keys are
+// already hidden from reads, so the sweep only has to happen eventually.
+// It returns the number of keys swept.
+func (s *KVstore) SweepExpired() (int, error) {
+	swept := 0
+	for key, at := range s.expired() {
+		ok, err := s.sweep(key, at, nil)
+		if ok {
+			swept++
+		}
+		if err != nil {
+			return swept, err
+		}
+	}
+	return swept, nil
+}
+
+// The keys that have expired as of now, along with when they did
+func (s *KVstore) expired() map[string]int64 {
+	now := time.Now().UnixNano()
+	s.Keymap.FileLock.RLock()
+	defer s.Keymap.FileLock.RUnlock()
+	expired := make(map[string]int64)
+	for key, keyinfo := range s.Keymap.Map {
+		if keyinfo.Expired(now) {
+			expired[key] = keyinfo.ExpireAt
+		}
+	}
+	return expired
+}
+
+// Write a tombstone for the key if it still expires at the given time, in
+// Unix nanoseconds, rather than having been set again since. Going by the
+// expiry rather than the clock lets every node decide the same way. It
+// returns whether the key was swept.
+func (s *KVstore) sweep(key string, at int64, by *stamp) (bool, error) {
+	s.mu.Lock()
+	s.Keymap.FileLock.RLock()
+	keyinfo, ok := s.Keymap.Map[key]
+	ok = ok && at != 0 && keyinfo.ExpireAt == at
+	s.Keymap.FileLock.RUnlock()
+	var err error
+	if ok {
+		// Stamped at the moment the key expired rather than now, so the
+		// tombstone wins over the version that expired but never over a
+		// write made since, here or on another node
+		tombstone := Record{Key: key, Timestamp: max(keyinfo.ExpireAt, keyinfo.Timestamp+1)}
+		if s.Config.Siblings {
+			// Keep the key's clock, so later writes carry on counting
+			// from it
+			if err = s.flush(); err == nil {
+				tombstone.Clock, _, err = s.versions(key)
+			}
+		}
+		if err == nil {
+			err = s.append(tombstone, flagTombstone, by)
+		}
+	}
+	seq := s.written
+	s.mu.Unlock()
+	if err != nil {
+		return ok, err
+	}
+	return ok, s.commit(seq)
+}
+
+// Expire sets the time at which the key expires, with the zero time meaning
+// never
+func (s *KVstore) Expire(key string, at time.Time) error {
+	return s.expire(key, at, nil)
+}
+
+// Set the key's expiry as a new write. When the write carries a stamp, its
+// timestamp rather than the clock decides whether the key has already expired
+func (s *KVstore) expire(key string, at time.Time, by *stamp) error {
+	now := time.Now().UnixNano()
+	if by != nil {
+		now = by.timestamp
+	}
+	s.mu.Lock()
+	if err := s.flush(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	logged, err := s.readVersion(key)
+	if err == nil && (logged.Deleted || expireAt(logged.ExpireAt) != 0 && expireAt(logged.ExpireAt) <= now) {
+		err = ErrKeyNotFound
+	}
+	if err == nil {
+		record := logged.Record
+		// The new expiry is a write of its own on this node
+		record.ExpireAt = at
+		record.Origin, record.OriginSeq, record.Timestamp = "", 0, 0
+		if s.Config.Siblings {
+			node := s.writer(by)
+			record.Clock = record.Clock.Merge(VectorClock{node: record.Clock[node] + 1})
+		}
+		err = s.append(record, 0, by)
+	}
+	seq := s.written
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.commit(seq)
+}
+
+// Persist removes the expiry from the key
+func (s *KVstore) Persist(key string) error {
+	return s.Expire(key, time.Time{})
+}
+
+// TTL returns how long the key has left before it expires, or NoExpiry if
+// it never does
+func (s *KVstore) TTL(key string) (time.Duration, error) {
+	s.Keymap.FileLock.RLock()
+	defer s.Keymap.FileLock.RUnlock()
+
+	now := time.Now().UnixNano()
+	keyinfo, ok := s.Keymap.Map[key]
+	if !ok || keyinfo.Expired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if keyinfo.ExpireAt == 0 {
+		return NoExpiry, nil
+	}
+	return time.Duration(keyinfo.ExpireAt - now), nil
+}
@@ -0,0 +1,569 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/jscottransom/distributed_godis/api"
+	"github.com/jscottransom/distributed_godis/internal/ring"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// HintedHandoff keeps the writes meant for owners of a key that have failed,
+// and hands them off once the owners join again. The writes for each failed
+// node are queued in a file of their own, so they survive a restart, each as
+// the time it was queued followed by the record laid out the same way as in
+// the store. Hints queued longer than Window ago are dropped, leaving
+// anti-entropy to repair a node that was down that long.
+type HintedHandoff struct {
+	Dir         string
+	Ring        *ring.Ring
+	DialOptions []grpc.DialOption
+	// How long to keep the writes for a node that stays down
+	Window time.Duration
+	// How hints are made durable, one of SyncAlways, SyncInterval or
+	// SyncNone as for the store. Empty syncs every hint as it is queued.
+	SyncMode string
+	// How often to fsync in SyncInterval mode
+	SyncInterval time.Duration
+	logger       *zap.Logger
+	mu           sync.Mutex
+	queues       map[string]*hintQueue
+	closed       bool
+	close        chan struct{}
+}
+
+// The writes queued for a single node
+type hintQueue struct {
+	mu     sync.Mutex
+	name   string
+	path   string
+	file   *os.File
+	depth  int64
+	oldest int64 // When the oldest hint was queued, in Unix nanoseconds
+	seq    uint64
+	dirty  bool // Hints have been written since the file was last synced
+	closed bool
+}
+
+// A write queued for a node, along with when it was queued
+type queuedHint struct {
+	LogRecord
+	queued int64 // Unix nanoseconds
+}
+
+const (
+	hintQueueSuffix = ".hints"
+	queuedWidth     = 8
+	// How often to drop the hints that are past the window
+	hintPruneInterval = time.Minute
+)
+
+var (
+	hintTarget, _ = tag.NewKey("target")
+
+	// HintsQueued is the number of writes queued for a node that is down
+	HintsQueued = stats.Int64("godis/hints_queued", "Writes queued for replicas that are down", stats.UnitDimensionless)
+	// HintViews report the hints queued for each node
+	HintViews = []*view.View{{
+		Name:        "godis/hints_queued",
+		Description: "Writes queued for replicas that are down, by replica",
+		Measure:     HintsQueued,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{hintTarget},
+	}}
+)
+
+func (h *HintedHandoff) init() error {
+	if h.logger == nil {
+		h.logger = zap.L().Named("hints")
+	}
+	if h.close == nil {
+		h.close = make(chan struct{})
+		go h.pruneLoop()
+		if h.SyncMode == SyncInterval && h.SyncInterval > 0 {
+			go h.syncLoop()
+		}
+	}
+	if h.queues != nil {
+		return nil
+	}
+
+	// Pick up the queues left from before a restart
+	h.queues = make(map[string]*hintQueue)
+	if err := os.MkdirAll(h.Dir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(h.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		escaped, ok := strings.CutSuffix(entry.Name(), hintQueueSuffix)
+		if !ok {
+			continue
+		}
+		name, err := url.PathUnescape(escaped)
+		if err != nil {
+			continue
+		}
+		q := &hintQueue{name: name, path: filepath.Join(h.Dir, entry.Name())}
+		if err := q.open(); err != nil {
+			return fmt.Errorf("error loading hints for %s: %w", name, err)
+		}
+		h.queues[name] = q
+		q.mu.Lock()
+		q.report()
+		q.mu.Unlock()
+	}
+	return nil
+}
+
+// Hint queues the record for each owner of its key that is down. The queues
+// are written to without holding up hints for other nodes.
+func (h *HintedHandoff) Hint(record LogRecord) error {
+	down := h.Ring.DownOwners(record.Key)
+	if len(down) == 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	if err := h.init(); err != nil {
+		h.mu.Unlock()
+		return err
+	}
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	queues := make([]*hintQueue, 0, len(down))
+	for _, name := range down {
+		q, ok := h.queues[name]
+		if !ok {
+			q = &hintQueue{name: name, path: filepath.Join(h.Dir, url.PathEscape(name)+hintQueueSuffix)}
+			if err := q.open(); err != nil {
+				h.mu.Unlock()
+				return err
+			}
+			h.queues[name] = q
+		}
+		queues = append(queues, q)
+	}
+	h.mu.Unlock()
+
+	queued := time.Now().UnixNano()
+	durable := h.SyncMode == "" || h.SyncMode == SyncAlways
+	for _, q := range queues {
+		if err := q.append(queuedHint{LogRecord: record, queued: queued}, durable); err != nil {
+			return fmt.Errorf("error queueing hint for %s: %w", q.name, err)
+		}
+	}
+	return nil
+}
+
+// Join hands off the writes queued for the node, now that it is back
+func (h *HintedHandoff) Join(name, addr string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.init(); err != nil {
+		return err
+	}
+	q, ok := h.queues[name]
+	if !ok || h.closed {
+		return nil
+	}
+
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-h.close:
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+
+		cc, err := grpc.NewClient(addr, h.DialOptions...)
+		if err != nil {
+			h.logger.Error("failed to dial", zap.String("name", name), zap.Error(err))
+			return
+		}
+		defer cc.Close()
+		n, err := h.replay(ctx, name, q, api.NewGodisServiceClient(cc))
+		if err != nil {
+			h.logger.Error("failed to hand off hints", zap.String("name", name), zap.Error(err))
+		}
+		h.logger.Info("handed off hints", zap.String("name", name), zap.Int("hints", n))
+	}()
+	return nil
+}
+
+// Leave drops the writes queued for the node, which has left for good
+func (h *HintedHandoff) Leave(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.init(); err != nil {
+		return err
+	}
+	q, ok := h.queues[name]
+	if !ok {
+		return nil
+	}
+	delete(h.queues, name)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.depth = 0
+	q.closed = true
+	q.report()
+	if err := q.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(q.path)
+}
+
+// Fail does nothing: writes are only queued for the node once the ring
+// passes it over
+func (h *HintedHandoff) Fail(name string) error {
+	return nil
+}
+
+// Send the queued writes to the node, oldest first, leaving those it did not
+// take queued for next time. It returns the number handed off.
+func (h *HintedHandoff) replay(ctx context.Context, name string, q *hintQueue, client api.GodisServiceClient) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.report()
+	if q.closed {
+		return 0, nil
+	}
+
+	hints, err := q.hints()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-h.Window).UnixNano()
+	var sent int
+	for i, hint := range hints {
+		if h.Window > 0 && hint.queued < cutoff {
+			continue
+		}
+		if _, err := writeRecord(ctx, client, APIRecord(hint.LogRecord), hint.Origin, hint.OriginSeq); err != nil {
+			return sent, errors.Join(err, q.keep(hints[i:]))
+		}
+		sent++
+	}
+	return sent, q.keep(nil)
+}
+
+// Periodically drop the hints that are past the window
+func (h *HintedHandoff) pruneLoop() {
+	ticker := time.NewTicker(hintPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.close:
+			return
+		case <-ticker.C:
+			if err := h.Prune(); err != nil {
+				h.logger.Error("failed to prune hints", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Prune drops the hints queued longer ago than the window
+func (h *HintedHandoff) Prune() error {
+	if h.Window <= 0 {
+		return nil
+	}
+	h.mu.Lock()
+	queues := make(map[string]*hintQueue, len(h.queues))
+	for name, q := range h.queues {
+		queues[name] = q
+	}
+	h.mu.Unlock()
+
+	cutoff := time.Now().Add(-h.Window).UnixNano()
+	var errs []error
+	for _, q := range queues {
+		errs = append(errs, q.prune(cutoff))
+	}
+	return errors.Join(errs...)
+}
+
+// Periodically sync the queues written to since they were last synced
+func (h *HintedHandoff) syncLoop() {
+	ticker := time.NewTicker(h.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.close:
+			return
+		case <-ticker.C:
+			h.mu.Lock()
+			queues := make([]*hintQueue, 0, len(h.queues))
+			for _, q := range h.queues {
+				queues = append(queues, q)
+			}
+			h.mu.Unlock()
+			for _, q := range queues {
+				if err := q.sync(); err != nil {
+					h.logger.Error("failed to sync hints", zap.String("name", q.name), zap.Error(err))
+				}
+			}
+		}
+	}
+}
+
+// Depth returns the number of writes queued for the node
+func (h *HintedHandoff) Depth(name string) int64 {
+	h.mu.Lock()
+	if err := h.init(); err != nil {
+		h.mu.Unlock()
+		return 0
+	}
+	q, ok := h.queues[name]
+	h.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth
+}
+
+func (h *HintedHandoff) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	if h.close != nil {
+		close(h.close)
+	}
+	var errs []error
+	for _, q := range h.queues {
+		q.mu.Lock()
+		if q.file != nil && !q.closed {
+			if q.dirty {
+				errs = append(errs, q.file.Sync())
+			}
+			errs = append(errs, q.file.Close())
+		}
+		q.closed = true
+		q.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Open the queue's file for appending, counting the hints already in it. A
+// torn hint at the end, from a crash part way through appending it, is
+// truncated away.
+func (q *hintQueue) open() error {
+	file, err := os.OpenFile(q.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	q.file = file
+	q.depth, q.oldest = 0, 0
+	q.dirty = false
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(file, 0, info.Size()))
+	var size uint64
+	for {
+		hint, n, err := readQueuedHint(r, uint64(info.Size())-size)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return file.Truncate(int64(size))
+		}
+		size += n
+		q.count(hint)
+		q.seq = hint.Offset
+	}
+}
+
+func (q *hintQueue) count(hint queuedHint) {
+	q.depth++
+	if q.oldest == 0 || hint.queued < q.oldest {
+		q.oldest = hint.queued
+	}
+}
+
+// Encode the hint as it is laid out in the queue, at the given position
+func encodeQueuedHint(hint queuedHint, seq uint64) ([]byte, error) {
+	var flags uint8
+	if hint.Deleted {
+		flags = flagTombstone
+	}
+	record, err := encodeRecord(hint.Record, flags, hint.Timestamp, seq)
+	if err != nil {
+		return nil, err
+	}
+	return append(enc.AppendUint64(nil, uint64(hint.queued)), record...), nil
+}
+
+// Read the next hint from r, which holds at most limit more bytes, returning
+// it along with its size in the queue
+func readQueuedHint(r io.Reader, limit uint64) (queuedHint, uint64, error) {
+	b := make([]byte, queuedWidth)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return queuedHint{}, 0, err
+	}
+	if limit < queuedWidth {
+		return queuedHint{}, 0, io.ErrUnexpectedEOF
+	}
+	record, h, err := decodeRecord(r, limit-queuedWidth)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return queuedHint{}, 0, err
+	}
+	return queuedHint{LogRecord: LogRecord{Record: record,
+		Offset:  h.seq,
+		Deleted: h.flags&flagTombstone != 0},
+		queued: int64(enc.Uint64(b))}, queuedWidth + h.size(), nil
+}
+
+// Append the hint to the queue, syncing it to disk if asked to. A queue
+// closed since it was picked drops the hint.
+func (q *hintQueue) append(hint queuedHint, sync bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+
+	b, err := encodeQueuedHint(hint, q.seq+1)
+	if err != nil {
+		return err
+	}
+	if _, err := q.file.Write(b); err != nil {
+		return err
+	}
+	q.seq++
+	if sync {
+		if err := q.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		q.dirty = true
+	}
+	q.count(hint)
+	q.report()
+	return nil
+}
+
+// Sync the hints written since the file was last synced
+func (q *hintQueue) sync() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || !q.dirty {
+		return nil
+	}
+	if err := q.file.Sync(); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+// Read back every hint in the queue.
+// The caller must hold q.mu.
+func (q *hintQueue) hints() ([]queuedHint, error) {
+	info, err := q.file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error reading hints: %w", err)
+	}
+	r := bufio.NewReader(io.NewSectionReader(q.file, 0, info.Size()))
+	var hints []queuedHint
+	var size uint64
+	for {
+		hint, n, err := readQueuedHint(r, uint64(info.Size())-size)
+		if err == io.EOF {
+			return hints, nil
+		}
+		if err != nil {
+			return hints, fmt.Errorf("error reading hints: %w", err)
+		}
+		size += n
+		hints = append(hints, hint)
+	}
+}
+
+// Drop the hints queued before cutoff
+func (q *hintQueue) prune(cutoff int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.report()
+	if q.closed || q.depth == 0 || q.oldest >= cutoff {
+		return nil
+	}
+	hints, err := q.hints()
+	if err != nil {
+		return err
+	}
+	kept := hints[:0]
+	for _, hint := range hints {
+		if hint.queued >= cutoff {
+			kept = append(kept, hint)
+		}
+	}
+	return q.keep(kept)
+}
+
+// Rewrite the queue with just the given hints, in a single rename.
+// The caller must hold q.mu.
+func (q *hintQueue) keep(hints []queuedHint) error {
+	var b []byte
+	for i, hint := range hints {
+		encoded, err := encodeQueuedHint(hint, uint64(i+1))
+		if err != nil {
+			return err
+		}
+		b = append(b, encoded...)
+	}
+	if err := q.file.Close(); err != nil {
+		return err
+	}
+	if err := writeFile(q.path, b); err != nil {
+		return err
+	}
+	q.seq = uint64(len(hints))
+	return q.open()
+}
+
+// Record the depth of the queue in the metrics.
+// The caller must hold q.mu.
+func (q *hintQueue) report() {
+	ctx, err := tag.New(context.Background(), tag.Upsert(hintTarget, q.name))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, HintsQueued.M(q.depth))
+}
@@ -0,0 +1,85 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jscottransom/distributed_godis/internal/ring"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHintedHandoff(t *testing.T) {
+	r := ring.New(ring.Config{NodeName: "a", RPCAddr: "a:1"})
+	r.Join("b", "b:1")
+	r.Join("c", "c:1")
+	dir := t.TempDir()
+	h := &HintedHandoff{Dir: dir, Ring: r, Window: 200 * time.Millisecond}
+	defer h.Close()
+
+	// Nothing is queued while every owner is up
+	now := time.Now().UnixNano()
+	require.NoError(t, h.Hint(LogRecord{Record: Record{Key: "up", Value: []byte("a"), Origin: "a", OriginSeq: 1, Timestamp: now}}))
+	require.Equal(t, int64(0), h.Depth("b"))
+
+	// Writes are queued for the owner that has failed
+	r.Fail("b")
+	records := []LogRecord{
+		{Record: Record{Key: "stale", Value: []byte("a"), Origin: "a", OriginSeq: 2, Timestamp: now}},
+		{Record: Record{Key: "first", Value: []byte("b"), Origin: "a", OriginSeq: 3, Timestamp: now + 1}},
+		{Record: Record{Key: "first", Origin: "a", OriginSeq: 4, Timestamp: now + 2}, Deleted: true},
+		{Record: Record{Key: "second", Value: []byte("c"), Origin: "c", OriginSeq: 7, Timestamp: now - 2*int64(time.Hour)}},
+	}
+	require.NoError(t, h.Hint(records[0]))
+	time.Sleep(300 * time.Millisecond)
+	for _, record := range records[1:] {
+		require.NoError(t, h.Hint(record))
+	}
+	require.Equal(t, int64(4), h.Depth("b"))
+	require.Equal(t, int64(0), h.Depth("c"))
+
+	// Hints queued longer ago than the window are dropped, going by when
+	// they were queued rather than written
+	require.NoError(t, h.Prune())
+	require.Equal(t, int64(3), h.Depth("b"))
+
+	// The queue survives a restart
+	require.NoError(t, h.Close())
+	h = &HintedHandoff{Dir: dir, Ring: r, Window: time.Hour}
+	defer h.Close()
+	require.Equal(t, int64(3), h.Depth("b"))
+
+	// Once the node is back its writes are handed off in order, keeping
+	// their origins
+	local := &localServer{}
+	h.mu.Lock()
+	q := h.queues["b"]
+	h.mu.Unlock()
+	n, err := h.replay(context.Background(), "b", q, local)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, []string{"set first a/3", "delete first a/4", "set second c/7"}, local.applied)
+	require.Equal(t, int64(0), h.Depth("b"))
+
+	// A node that leaves for good takes its queue with it
+	require.NoError(t, h.Hint(records[1]))
+	require.Equal(t, int64(1), h.Depth("b"))
+	require.NoError(t, h.Leave("b"))
+	require.Equal(t, int64(0), h.Depth("b"))
+	require.NoFileExists(t, q.path)
+
+	// Outside SyncAlways hints are synced in the background, rather than
+	// each as it is queued
+	h = &HintedHandoff{Dir: t.TempDir(), Ring: r, SyncMode: SyncInterval, SyncInterval: 10 * time.Millisecond}
+	defer h.Close()
+	require.NoError(t, h.Hint(records[1]))
+	require.Equal(t, int64(1), h.Depth("b"))
+	h.mu.Lock()
+	q = h.queues["b"]
+	h.mu.Unlock()
+	require.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return !q.dirty
+	}, time.Second, 10*time.Millisecond)
+}
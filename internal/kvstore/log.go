@@ -0,0 +1,143 @@
+package kvstore
+
+import (
+	"sort"
+)
+
+// LogRecord is a record read back from the store's log, along with its
+// offset in it
+type LogRecord struct {
+	Record
+	Offset  uint64
+	Deleted bool
+}
+
+// LogReader reads the records in the store in the order they were written,
+// starting from an offset. The offset of a record is its sequence number.
+// Records that have been overwritten and merged away are skipped, so a
+// reader that falls behind still sees the latest record for every key.
+// Records written before sequence numbers were added all have offset 0.
+type LogReader struct {
+	s    *KVstore
+	next uint64 // Offset of the next record to return
+
+	// Where to carry on reading from, which holds until the next merge
+	located bool
+	merges  uint64
+	segment uint32
+	pos     uint64
+}
+
+// NewLogReader returns a reader for the log from the given offset on
+func (s *KVstore) NewLogReader(from uint64) *LogReader {
+	return &LogReader{s: s, next: from}
+}
+
+// Offset returns the offset the reader carries on from
+func (r *LogReader) Offset() uint64 {
+	return r.next
+}
+
+// LastOffset returns the offset of the newest record in the log, or 0 if it
+// is empty
+func (s *KVstore) LastOffset() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastSeq
+}
+
+// Appended returns a channel that is closed once another record is appended
+// to the store
+func (s *KVstore) Appended() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.appended
+}
+
+// Read returns up to max of the next records in the log, or none if the
+// reader has caught up with the store
+func (r *LogReader) Read(max int) ([]LogRecord, error) {
+	s := r.s
+
+	// Everything appended so far can be read from the segment files
+	s.mu.Lock()
+	err := s.flush()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	s.segMu.RLock()
+	defer s.segMu.RUnlock()
+
+	ids := make([]uint32, 0, len(s.segments))
+	for id := range s.segments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if merges := s.merges.Load(); !r.located || merges != r.merges {
+		if err := r.locate(ids); err != nil {
+			return nil, err
+		}
+		r.merges = merges
+		r.located = true
+	}
+
+	var records []LogRecord
+	for len(records) < max {
+		seg, ok := s.segments[r.segment]
+		if !ok {
+			break
+		}
+		if r.pos >= seg.flushed.Load() {
+			// Only the last segment is still being appended to
+			i := sort.Search(len(ids), func(i int) bool { return ids[i] > r.segment })
+			if i == len(ids) {
+				break
+			}
+			r.segment = ids[i]
+			r.pos = 0
+			continue
+		}
+
+		record, h, err := readRecord(seg.file, r.pos, seg.flushed.Load())
+		if err != nil {
+			return records, err
+		}
+		r.pos += h.size()
+		if h.seq < r.next {
+			continue
+		}
+		records = append(records, LogRecord{Record: record,
+			Offset:  h.seq,
+			Deleted: h.flags&flagTombstone != 0})
+		if h.seq > 0 {
+			r.next = h.seq + 1
+		}
+	}
+	return records, nil
+}
+
+// Find the segment holding the next offset, skipping the segments that only
+// hold records before it. The caller must hold s.segMu.
+func (r *LogReader) locate(ids []uint32) error {
+	r.segment, r.pos = ids[0], 0
+	for i := 1; i < len(ids); i++ {
+		seg := r.s.segments[ids[i]]
+		if seg.flushed.Load() == 0 {
+			break
+		}
+		_, h, err := readRecord(seg.file, 0, seg.flushed.Load())
+		if err != nil {
+			return err
+		}
+		if h.seq >= r.next {
+			break
+		}
+		r.segment = ids[i]
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package kvstore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	kmap "github.com/jscottransom/distributed_godis/internal/keymap"
+	"go.uber.org/zap"
+)
+
+const (
+	mergeSuffix = ".merge"
+)
+
+// Periodically check whether enough of the store is dead to be worth merging
+func (s *KVstore) mergeLoop() {
+	ticker := time.NewTicker(s.Config.Merge.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			if _, err := s.MaybeMerge(); err != nil {
+				zap.L().Named("kvstore").Error("failed to merge store", zap.Error(err))
+			}
+		}
+	}
+}
+
+// DeadBytes returns the number of bytes taken up by overwritten or deleted
+// records, along with the total size of the store
+func (s *KVstore) DeadBytes() (dead, total uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seg := range s.segments {
+		dead += seg.dead
+		total += seg.size
+	}
+	return dead, total
+}
+
+// MaybeMerge merges the store if the configured thresholds are met, and
+// returns the number of bytes reclaimed
+func (s *KVstore) MaybeMerge() (uint64, error) {
+	dead, total := s.DeadBytes()
+	if dead < s.Config.Merge.MinDeadBytes ||
+		float64(dead) < s.Config.Merge.DeadRatio*float64(total) {
+		return 0, nil
+	}
+	return s.Merge()
+}
+
+// Merge rewrites the live records and tombstones of the closed segments into
+// new segments and swaps them in, reclaiming the space held by overwritten and
+// deleted records, and tombstones older than Config.Tombstone.TTL. The active
+// segment is closed first, so the whole store is merged. The records are
+// copied without holding up writes, which are only held back at the end,
+// while the keymap is pointed at the copies and the segments are swapped. It
+// returns the number of bytes reclaimed.
+func (s *KVstore) Merge() (uint64, error) {
+	s.mergeMu.Lock()
+	defer s.mergeMu.Unlock()
+
+	// Closed segments are never written to again, so they are copied
+	// without holding up writes, taking only segMu around each read to keep
+	// their files from being closed under it
+	s.mu.Lock()
+	if s.active.size > 0 {
+		if err := s.roll(); err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+	}
+	var ids []uint32
+	var before uint64
+	sealed := make(map[uint32]*segment)
+	for id, seg := range s.segments {
+		if id != s.active.id {
+			ids = append(ids, id)
+			before += seg.size
+			sealed[id] = seg
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// Keep the records in the order they were written
+	var hints []kmap.Hint
+	s.Keymap.FileLock.RLock()
+	for _, id := range ids {
+		hints = append(hints, s.Keymap.SegmentHints(id)...)
+	}
+	s.Keymap.FileLock.RUnlock()
+	s.mu.Unlock()
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// The merged segments reuse the lowest of the merged ids, as they never
+	// need more segments than they replace
+	var outputs []*os.File
+	var outputHints, sources [][]kmap.Hint
+	var sizes []uint64
+	var buf *bufio.Writer
+	defer func() {
+		for i, output := range outputs {
+			output.Close()
+			os.Remove(output.Name())
+			os.Remove(hintPath(s.dir, s.name, ids[i]) + mergeSuffix)
+		}
+	}()
+	next := func() error {
+		if buf != nil {
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+		}
+		output, err := os.Create(segmentPath(s.dir, s.name, ids[len(outputs)]) + mergeSuffix)
+		if err != nil {
+			return fmt.Errorf("error creating file for merging store: %w", err)
+		}
+		outputs = append(outputs, output)
+		outputHints = append(outputHints, nil)
+		sources = append(sources, nil)
+		sizes = append(sizes, 0)
+		buf = bufio.NewWriter(output)
+		return nil
+	}
+	if err := next(); err != nil {
+		return 0, err
+	}
+
+	// Copy each record over as is, after checking it is intact. Every older
+	// version of a key is in the segments being merged, so a tombstone past
+	// its TTL can go without the key coming back.
+	var horizon int64
+	if s.Config.Tombstone.TTL > 0 {
+		horizon = time.Now().Add(-s.Config.Tombstone.TTL).UnixNano()
+	}
+	var collected []kmap.Hint
+	for _, hint := range hints {
+		if hint.Tombstone && hint.Timestamp < horizon {
+			collected = append(collected, hint)
+			continue
+		}
+		cur := len(outputs) - 1
+		if sizes[cur] > 0 && sizes[cur]+hint.Size > s.Config.Segment.MaxBytes && len(outputs) < len(ids) {
+			if err := next(); err != nil {
+				return 0, err
+			}
+			cur++
+		}
+
+		data, err := s.readSealed(sealed[hint.Segment], hint)
+		if err != nil {
+			return 0, fmt.Errorf("error merging store: %w", err)
+		}
+		if _, err := buf.Write(data); err != nil {
+			return 0, fmt.Errorf("error merging store: %w", err)
+		}
+		sources[cur] = append(sources[cur], hint)
+		hint.Segment = ids[cur]
+		hint.Offset = sizes[cur]
+		outputHints[cur] = append(outputHints[cur], hint)
+		sizes[cur] += hint.Size
+	}
+	if err := buf.Flush(); err != nil {
+		return 0, err
+	}
+	for _, output := range outputs {
+		if err := output.Sync(); err != nil {
+			return 0, err
+		}
+		if err := output.Close(); err != nil {
+			return 0, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Keymap.FileLock.Lock()
+	defer s.Keymap.FileLock.Unlock()
+
+	// Keys written, deleted or evicted while the records were copied no
+	// longer point at the records, and their copies are left dead
+	live := make([]uint64, len(outputs))
+	for i := range outputHints {
+		kept := outputHints[i][:0]
+		for j, hint := range outputHints[i] {
+			keyinfo, ok := s.Keymap.Map[hint.Key]
+			if hint.Tombstone {
+				keyinfo, ok = s.Keymap.Tombstones[hint.Key]
+			}
+			source := sources[i][j]
+			if ok && keyinfo.Segment == source.Segment && keyinfo.Offset == source.Offset {
+				kept = append(kept, hint)
+				live[i] += hint.Size
+			}
+		}
+		outputHints[i] = kept
+		if err := kmap.WriteHint(hintPath(s.dir, s.name, ids[i])+mergeSuffix, sizes[i], kept); err != nil {
+			return 0, err
+		}
+	}
+
+	// Swap the merged segments in for the closed ones. A crash part way
+	// through leaves older copies of records behind, which recovery skips
+	// as it keeps the newest record for each key, though a key whose
+	// tombstone was collected may come back from them. The old checkpoint and
+	// hints go first, so they are never read against segments they were not
+	// written for.
+	if err := s.dropCheckpoint(); err != nil {
+		return 0, fmt.Errorf("error dropping checkpoint: %w", err)
+	}
+	for _, id := range ids {
+		if err := os.Remove(hintPath(s.dir, s.name, id)); err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("error removing hint file: %w", err)
+		}
+	}
+	for i, output := range outputs {
+		if err := os.Rename(output.Name(), segmentPath(s.dir, s.name, ids[i])); err != nil {
+			return 0, fmt.Errorf("error swapping in merged segment: %w", err)
+		}
+		if err := os.Rename(hintPath(s.dir, s.name, ids[i])+mergeSuffix, hintPath(s.dir, s.name, ids[i])); err != nil {
+			return 0, fmt.Errorf("error swapping in merged hint file: %w", err)
+		}
+	}
+	outputs = nil
+	s.segMu.Lock()
+	defer s.segMu.Unlock()
+	s.merges.Add(1)
+	for _, id := range ids {
+		s.segments[id].file.Close()
+		delete(s.segments, id)
+	}
+	for _, id := range ids[len(sizes):] {
+		if err := os.Remove(segmentPath(s.dir, s.name, id)); err != nil {
+			return 0, fmt.Errorf("error removing merged segment: %w", err)
+		}
+	}
+	var after uint64
+	for i, id := range ids[:len(sizes)] {
+		seg, err := openSegment(s.dir, s.name, id, false)
+		if err != nil {
+			return 0, err
+		}
+		seg.dead = seg.size - live[i]
+		s.segments[id] = seg
+		after += seg.size
+	}
+
+	// Drop the keys of the tombstones collected, unless they were written
+	// since
+	for _, hint := range collected {
+		keyinfo, ok := s.Keymap.Tombstones[hint.Key]
+		if ok && keyinfo.Segment == hint.Segment && keyinfo.Offset == hint.Offset {
+			delete(s.Keymap.Tombstones, hint.Key)
+			s.leaves[Bucket(hint.Key)] ^= keyinfo.Digest
+		}
+	}
+
+	// Point the keymap at the merged records
+	for _, outputHint := range outputHints {
+		for _, hint := range outputHint {
+			keyinfo := s.Keymap.Map[hint.Key]
+			if hint.Tombstone {
+				keyinfo = s.Keymap.Tombstones[hint.Key]
+			}
+			*keyinfo = hint.KeyInfo
+		}
+	}
+
+	return before - after, s.checkpoint()
+}
+
+// Read a record from a closed segment as it is, after checking it is intact,
+// as long as the segment is still the store's and open
+func (s *KVstore) readSealed(seg *segment, hint kmap.Hint) ([]byte, error) {
+	s.segMu.RLock()
+	defer s.segMu.RUnlock()
+	select {
+	case <-s.closed:
+		return nil, fmt.Errorf("store closed while reading segment %d", seg.id)
+	default:
+	}
+	if s.segments[seg.id] != seg {
+		return nil, fmt.Errorf("segment %d replaced while reading it", seg.id)
+	}
+
+	if _, _, err := readRecord(seg.file, hint.Offset, seg.size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, hint.Size)
+	if _, err := seg.file.ReadAt(data, int64(hint.Offset)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
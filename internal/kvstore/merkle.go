@@ -0,0 +1,203 @@
+package kvstore
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+
+	kmap "github.com/jscottransom/distributed_godis/internal/keymap"
+)
+
+// Replicas compare what they hold through a Merkle tree, without sending the
+// keys themselves. Every key hashes into one of merkleLeaves ranges of the
+// hash space, each leaf hashes the versions of the keys in its range, and
+// each node above hashes its two children. Replicas with the same root hold
+// the same versions; otherwise only the ranges under the nodes that differ
+// have to be exchanged.
+const (
+	merkleDepth  = 8
+	merkleLeaves = 1 << merkleDepth
+)
+
+// MerkleTree holds the node hashes breadth first from the root, so the
+// children of node i are 2i+1 and 2i+2, and the leaves come last
+type MerkleTree []uint64
+
+// Bucket returns the range of the hash space the key falls in, which is its
+// leaf in the Merkle tree
+func Bucket(key string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return uint32(h.Sum64() >> (64 - merkleDepth))
+}
+
+// Diff returns the ranges where the trees differ, walking down from the root
+// only where the hashes do not match. Trees of the wrong shape differ in
+// every range.
+func (t MerkleTree) Diff(o MerkleTree) []uint32 {
+	var buckets []uint32
+	if len(t) != 2*merkleLeaves-1 || len(o) != len(t) {
+		for bucket := uint32(0); bucket < merkleLeaves; bucket++ {
+			buckets = append(buckets, bucket)
+		}
+		return buckets
+	}
+
+	pending := []int{0}
+	for len(pending) > 0 {
+		i := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if t[i] == o[i] {
+			continue
+		}
+		if i >= merkleLeaves-1 {
+			buckets = append(buckets, uint32(i-(merkleLeaves-1)))
+			continue
+		}
+		pending = append(pending, 2*i+1, 2*i+2)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	return buckets
+}
+
+// MerkleTree builds the tree over the version of every key in the store that
+// keep picks out, or every key if it is nil, deleted and expired keys
+// included. The leaves over every key are kept up to date as the keymap
+// changes, so only a tree over some of the keys has to walk them, and then
+// only the versions held in the keymap.
+func (s *KVstore) MerkleTree(keep func(key string) bool) (MerkleTree, error) {
+	tree := make(MerkleTree, 2*merkleLeaves-1)
+	leaves := tree[merkleLeaves-1:]
+
+	s.Keymap.FileLock.RLock()
+	if keep == nil {
+		copy(leaves, s.leaves[:])
+	} else {
+		for _, keymap := range []kmap.KeyMap{s.Keymap.Map, s.Keymap.Tombstones} {
+			for key, keyinfo := range keymap {
+				if keep(key) {
+					leaves[Bucket(key)] ^= keyinfo.Digest
+				}
+			}
+		}
+	}
+	s.Keymap.FileLock.RUnlock()
+
+	for i := merkleLeaves - 2; i >= 0; i-- {
+		h := fnv.New64a()
+		h.Write(enc.AppendUint64(enc.AppendUint64(nil, tree[2*i+1]), tree[2*i+2]))
+		tree[i] = h.Sum64()
+	}
+	return tree, nil
+}
+
+// Hash a version of the key for its leaf in the Merkle tree, where keys are
+// folded in any order. A version is told apart by its timestamp and origin,
+// or by its vector clock if the store keeps siblings, as merged records are
+// stamped afresh on every node.
+func (s *KVstore) digest(key string, tombstone bool, timestamp int64, origin string, clock VectorClock) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	if tombstone {
+		h.Write([]byte{flagTombstone})
+	} else {
+		h.Write([]byte{0})
+	}
+	if s.Config.Siblings {
+		h.Write(clock.Bytes())
+	} else {
+		h.Write(enc.AppendUint64(nil, uint64(timestamp)))
+		h.Write([]byte(origin))
+	}
+	return h.Sum64()
+}
+
+// RangeRecords returns the latest record for every key in the given ranges
+// of the hash space that keep picks out, or every key if it is nil,
+// tombstones included, for a replica to compare against its own
+func (s *KVstore) RangeRecords(buckets []uint32, keep func(key string) bool) ([]LogRecord, error) {
+	var records []LogRecord
+	err := s.scanBuckets(buckets, keep, func(record LogRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Scan calls fn with the latest record for every key, tombstones included,
+// a range of the hash space at a time. The keys are taken up front and their
+// records read one at a time, like Get, so writes carry on meanwhile; a key
+// written since may be seen at its newer version, and one evicted since is
+// passed over.
+func (s *KVstore) Scan(fn func(record LogRecord) error) error {
+	buckets := make([]uint32, merkleLeaves)
+	for bucket := range buckets {
+		buckets[bucket] = uint32(bucket)
+	}
+	return s.scanBuckets(buckets, nil, fn)
+}
+
+// Scan the keys in the given ranges that keep picks out, or every one if it
+// is nil, in the order the ranges are given. The keys are sorted into their
+// ranges in one pass over the keymap.
+func (s *KVstore) scanBuckets(buckets []uint32, keep func(key string) bool, fn func(record LogRecord) error) error {
+	var wanted [merkleLeaves]bool
+	for _, bucket := range buckets {
+		if bucket < merkleLeaves {
+			wanted[bucket] = true
+		}
+	}
+
+	var keys [merkleLeaves][]string
+	s.Keymap.FileLock.RLock()
+	for _, keymap := range []kmap.KeyMap{s.Keymap.Map, s.Keymap.Tombstones} {
+		for key := range keymap {
+			bucket := Bucket(key)
+			if wanted[bucket] && (keep == nil || keep(key)) {
+				keys[bucket] = append(keys[bucket], key)
+			}
+		}
+	}
+	s.Keymap.FileLock.RUnlock()
+
+	for _, bucket := range buckets {
+		if bucket >= merkleLeaves {
+			continue
+		}
+		for _, key := range keys[bucket] {
+			record, err := s.readFlushed(func() (LogRecord, error) { return s.readVersion(key) })
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		// A range asked for twice is only scanned once
+		keys[bucket] = nil
+	}
+	return nil
+}
+
+// Read the latest record for the key, whether it is live or not
+func (s *KVstore) readVersion(key string) (LogRecord, error) {
+	s.Keymap.FileLock.RLock()
+	defer s.Keymap.FileLock.RUnlock()
+	s.segMu.RLock()
+	defer s.segMu.RUnlock()
+
+	keyInfo, ok := s.Keymap.Map[key]
+	if !ok {
+		keyInfo, ok = s.Keymap.Tombstones[key]
+	}
+	if !ok {
+		return LogRecord{}, ErrKeyNotFound
+	}
+	return s.readAt(key, keyInfo)
+}
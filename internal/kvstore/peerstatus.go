@@ -0,0 +1,189 @@
+package kvstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/jscottransom/distributed_godis/api"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"google.golang.org/protobuf/proto"
+)
+
+// PeerStatus is how far the local node has replicated the log of a peer
+type PeerStatus struct {
+	Name  string
+	Addr  string
+	State api.ReplicationState
+	// Offset of the last record taken from the peer's log
+	Applied uint64
+	// Offset of the newest record in the peer's log, as last heard from it
+	PeerOffset uint64
+	// Records and bytes taken from the peer since it joined
+	Records uint64
+	Bytes   uint64
+	// The last failure replicating the peer, and when it happened
+	LastError   error
+	LastErrorAt time.Time
+}
+
+// Lag returns the number of records in the peer's log not yet taken
+func (s PeerStatus) Lag() uint64 {
+	if s.PeerOffset <= s.Applied {
+		return 0
+	}
+	return s.PeerOffset - s.Applied
+}
+
+var (
+	replicationPeer, _ = tag.NewKey("peer")
+
+	// ReplicationLag is the number of records in a peer's log not yet taken
+	ReplicationLag = stats.Int64("godis/replication_lag", "Records in a peer's log not yet replicated", stats.UnitDimensionless)
+	// ReplicationRecords is the number of records taken from a peer
+	ReplicationRecords = stats.Int64("godis/replication_records", "Records replicated from a peer", stats.UnitDimensionless)
+	// ReplicationBytes is the number of bytes taken from a peer, snapshots
+	// included
+	ReplicationBytes = stats.Int64("godis/replication_bytes", "Bytes replicated from a peer", stats.UnitBytes)
+	// ReplicationErrors is the number of times replicating a peer has failed
+	ReplicationErrors = stats.Int64("godis/replication_errors", "Failures replicating from a peer", stats.UnitDimensionless)
+	// ReplicationStreaming is 1 while a peer's log is being tailed, and 0
+	// otherwise
+	ReplicationStreaming = stats.Int64("godis/replication_streaming", "Whether a peer's log is being tailed", stats.UnitDimensionless)
+
+	// ReplicationViews report replication from each peer
+	ReplicationViews = []*view.View{{
+		Name:        "godis/replication_lag",
+		Description: "Records in a peer's log not yet replicated, by peer",
+		Measure:     ReplicationLag,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{replicationPeer},
+	}, {
+		Name:        "godis/replication_records",
+		Description: "Records replicated, by peer",
+		Measure:     ReplicationRecords,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{replicationPeer},
+	}, {
+		Name:        "godis/replication_bytes",
+		Description: "Bytes replicated, by peer",
+		Measure:     ReplicationBytes,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{replicationPeer},
+	}, {
+		Name:        "godis/replication_errors",
+		Description: "Failures replicating, by peer",
+		Measure:     ReplicationErrors,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{replicationPeer},
+	}, {
+		Name:        "godis/replication_streaming",
+		Description: "Whether each peer's log is being tailed",
+		Measure:     ReplicationStreaming,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{replicationPeer},
+	}}
+)
+
+// The status of replication from a peer, kept up to date as it goes
+type peerStatus struct {
+	mu sync.Mutex
+	PeerStatus
+	ctx context.Context // Tagged with the peer, for the metrics
+}
+
+func newPeerStatus(name, addr string) *peerStatus {
+	ctx, err := tag.New(context.Background(), tag.Upsert(replicationPeer, name))
+	if err != nil {
+		ctx = context.Background()
+	}
+	return &peerStatus{PeerStatus: PeerStatus{Name: name, Addr: addr}, ctx: ctx}
+}
+
+// Carry on from the cursor saved for the peer
+func (p *peerStatus) resume(cursor uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cursor > 0 {
+		p.Applied = cursor - 1
+	}
+}
+
+func (p *peerStatus) setState(state api.ReplicationState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.State = state
+	var streaming int64
+	if state == api.ReplicationState_STREAMING {
+		streaming = 1
+	}
+	stats.Record(p.ctx, ReplicationStreaming.M(streaming))
+}
+
+func (p *peerStatus) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.LastError = err
+	p.LastErrorAt = time.Now()
+	stats.Record(p.ctx, ReplicationErrors.M(1))
+}
+
+// Count a record taken from the peer's log
+func (p *peerStatus) took(record *api.LogRecord) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	size := proto.Size(record)
+	p.Records++
+	p.Bytes += uint64(size)
+	if record.Offset > 0 {
+		p.Applied = record.Offset
+	}
+	p.PeerOffset = max(p.PeerOffset, record.LastOffset, record.Offset)
+	stats.Record(p.ctx,
+		ReplicationRecords.M(1),
+		ReplicationBytes.M(int64(size)),
+		ReplicationLag.M(int64(p.Lag())))
+}
+
+// Count a piece of a snapshot taken from the peer
+func (p *peerStatus) loaded(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Bytes += uint64(n)
+	stats.Record(p.ctx, ReplicationBytes.M(int64(n)))
+}
+
+// Note the store was loaded from a snapshot of the peer's log up to seq
+func (p *peerStatus) bootstrapped(seq uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Applied = seq
+	p.PeerOffset = max(p.PeerOffset, seq)
+	stats.Record(p.ctx, ReplicationLag.M(int64(p.Lag())))
+}
+
+// Clear the metrics for a peer that has left
+func (p *peerStatus) clear() {
+	stats.Record(p.ctx, ReplicationLag.M(0), ReplicationStreaming.M(0))
+}
+
+func (p *peerStatus) status() PeerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.PeerStatus
+}
+
+// ReplicationStatus returns how far each peer has been replicated, by name
+func (r *Replicator) ReplicationStatus() []PeerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]PeerStatus, 0, len(r.status))
+	for _, p := range r.status {
+		statuses = append(statuses, p.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
@@ -0,0 +1,342 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/jscottransom/distributed_godis/api"
+	"github.com/jscottransom/distributed_godis/internal/ring"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// Rebalancer moves keys between nodes as members join and leave, and the ring
+// gives their ranges of the keyspace to other nodes. After every change it
+// walks the keys stored here and hands each one off to the nodes that have
+// come to own it. Keys this node no longer owns are dropped once every owner
+// has taken them.
+type Rebalancer struct {
+	Store       *KVstore
+	Ring        *ring.Ring
+	DialOptions []grpc.DialOption
+	// Most bytes a second to hand off, across every node. Zero leaves it
+	// unthrottled.
+	BytesPerSecond int64
+	logger         *zap.Logger
+	mu             sync.Mutex
+	// The ring the keys here were last balanced for, or nil if they have
+	// not been yet, when they are all taken to be here alone
+	placed  *ring.Ring
+	conns   map[string]*grpc.ClientConn
+	pending chan struct{}
+	closed  bool
+	close   chan struct{}
+
+	progressMu sync.Mutex
+	progress   RebalanceProgress
+}
+
+// RebalanceProgress tells how far the running rebalance has got, or how the
+// last one went
+type RebalanceProgress struct {
+	Running bool
+	// Keys to look at, and how many of them have been
+	Keys    uint64
+	Scanned uint64
+	// Records taken by their new owners, and their size
+	HandedOff uint64
+	Bytes     uint64
+	// Keys dropped here once handed off
+	Evicted uint64
+	// Records an owner could not be reached for, which are left to the next
+	// rebalance
+	Failed uint64
+}
+
+const (
+	// Membership changes this close together are balanced in one go
+	rebalanceDelay = 500 * time.Millisecond
+	// Wait before trying a rebalance that could not finish again
+	rebalanceRetry = 5 * time.Second
+	// Log progress this often while a rebalance runs
+	rebalanceReport = 5 * time.Second
+)
+
+func (b *Rebalancer) init() {
+	if b.logger == nil {
+		b.logger = zap.L().Named("rebalancer")
+	}
+	if b.conns == nil {
+		b.conns = make(map[string]*grpc.ClientConn)
+	}
+	if b.close == nil {
+		b.close = make(chan struct{})
+		b.pending = make(chan struct{}, 1)
+		go b.rebalanceLoop()
+	}
+}
+
+// Join schedules a rebalance, as the joining member takes over ranges of the
+// keyspace. It is called after the ring has the member.
+func (b *Rebalancer) Join(name, addr string) error {
+	b.schedule()
+	return nil
+}
+
+// Leave schedules a rebalance, as the ranges of the member that left go to
+// other nodes
+func (b *Rebalancer) Leave(name string) error {
+	b.schedule()
+	return nil
+}
+
+// Fail leaves the keys where they are, as a failed member may well come
+// back. Its writes go to the next nodes round meanwhile, and are held for it
+// by hinted handoff. Its keys only move once it leaves for good.
+func (b *Rebalancer) Fail(name string) error {
+	return nil
+}
+
+func (b *Rebalancer) schedule() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+	if b.closed {
+		return
+	}
+	select {
+	case b.pending <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Rebalancer) rebalanceLoop() {
+	for {
+		select {
+		case <-b.close:
+			return
+		case <-b.pending:
+		}
+
+		select {
+		case <-b.close:
+			return
+		case <-time.After(rebalanceDelay):
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-b.close:
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+		err := b.Rebalance(ctx)
+		cancel()
+		if err == nil || b.isClosed() {
+			continue
+		}
+		b.logger.Error("failed to rebalance", zap.Error(err))
+
+		select {
+		case <-b.close:
+			return
+		case <-time.After(rebalanceRetry):
+			b.schedule()
+		}
+	}
+}
+
+func (b *Rebalancer) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// Rebalance hands off the keys stored here to the nodes that have come to own
+// them since the last rebalance, and drops those this node no longer owns.
+// Every owner of a key being dropped is sent it, so nothing is dropped until
+// all of them hold it, and keys with an owner that is down are kept until it
+// is back. If an owner cannot be reached, the keys it is missing are left for
+// the next rebalance. The store is walked a range of the hash space at a
+// time, while writes carry on.
+func (b *Rebalancer) Rebalance(ctx context.Context) error {
+	b.mu.Lock()
+	b.init()
+	placed := b.placed
+	b.mu.Unlock()
+	current := b.Ring.Snapshot()
+	local := current.Config.NodeName
+
+	b.updateProgress(func(p *RebalanceProgress) {
+		*p = RebalanceProgress{Running: true, Keys: uint64(b.Store.KeyCount())}
+	})
+	defer b.updateProgress(func(p *RebalanceProgress) { p.Running = false })
+
+	start := time.Now()
+	reported := start
+	var sent uint64
+	var errs []error
+	rebalance := func(record LogRecord) error {
+		previous := []string{local}
+		if placed != nil {
+			previous = placed.Owners(record.Key)
+		}
+		owners := current.Owners(record.Key)
+		owned := contains(owners, local)
+
+		handedOff := len(current.DownOwners(record.Key)) == 0
+		for _, owner := range owners {
+			if owner == local || (owned && contains(previous, owner)) {
+				continue
+			}
+			n, err := b.handOff(ctx, current, owner, record)
+			if err != nil {
+				handedOff = false
+				errs = append(errs, fmt.Errorf("error handing off key %s to %s: %w", record.Key, owner, err))
+				b.updateProgress(func(p *RebalanceProgress) { p.Failed++ })
+				continue
+			}
+			sent += n
+			b.updateProgress(func(p *RebalanceProgress) {
+				p.HandedOff++
+				p.Bytes += n
+			})
+			if err := b.throttle(ctx, start, sent); err != nil {
+				return err
+			}
+		}
+		if !owned && handedOff {
+			evicted, err := b.Store.Evict(record.Key, record.Timestamp, record.Origin)
+			if err != nil {
+				return fmt.Errorf("error evicting key %s: %w", record.Key, err)
+			}
+			if evicted {
+				b.updateProgress(func(p *RebalanceProgress) { p.Evicted++ })
+			}
+		}
+		b.updateProgress(func(p *RebalanceProgress) { p.Scanned++ })
+
+		if time.Since(reported) > rebalanceReport {
+			b.report("rebalancing")
+			reported = time.Now()
+		}
+		return nil
+	}
+	if err := b.Store.Scan(rebalance); err != nil {
+		return fmt.Errorf("error rebalancing keys: %w", err)
+	}
+	b.report("rebalanced")
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	b.mu.Lock()
+	b.placed = current
+	b.mu.Unlock()
+	return nil
+}
+
+// Send a record to its new owner, returning its size. An owner that already
+// holds a newer version has taken it just the same.
+func (b *Rebalancer) handOff(ctx context.Context, current *ring.Ring, owner string, record LogRecord) (uint64, error) {
+	addr, ok := current.Addr(owner)
+	if !ok {
+		return 0, fmt.Errorf("no address for %s", owner)
+	}
+	client, err := b.client(addr)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := writeRecord(ctx, client, APIRecord(record), record.Origin, record.OriginSeq); err != nil {
+		return 0, err
+	}
+	return uint64(len(record.Key) + len(record.Value)), nil
+}
+
+func (b *Rebalancer) client(addr string) (api.GodisServiceClient, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn, ok := b.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = grpc.NewClient(addr, b.DialOptions...); err != nil {
+			return nil, err
+		}
+		b.conns[addr] = conn
+	}
+	return api.NewGodisServiceClient(conn), nil
+}
+
+// Hold off until the bytes sent since start are within the bandwidth limit
+func (b *Rebalancer) throttle(ctx context.Context, start time.Time, sent uint64) error {
+	if b.BytesPerSecond <= 0 {
+		return nil
+	}
+	due := start.Add(time.Duration(float64(sent) / float64(b.BytesPerSecond) * float64(time.Second)))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// Progress returns how far the running rebalance has got, or how the last
+// one went
+func (b *Rebalancer) Progress() RebalanceProgress {
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	return b.progress
+}
+
+func (b *Rebalancer) updateProgress(fn func(p *RebalanceProgress)) {
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	fn(&b.progress)
+}
+
+func (b *Rebalancer) report(msg string) {
+	p := b.Progress()
+	b.logger.Info(
+		msg,
+		zap.Uint64("keys", p.Keys),
+		zap.Uint64("scanned", p.Scanned),
+		zap.Uint64("handed_off", p.HandedOff),
+		zap.Uint64("bytes", p.Bytes),
+		zap.Uint64("evicted", p.Evicted),
+		zap.Uint64("failed", p.Failed),
+	)
+}
+
+func (b *Rebalancer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.init()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.close)
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
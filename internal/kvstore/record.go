@@ -0,0 +1,283 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// Every record on disk is prefixed with a fixed size header:
+//
+//	crc32 | magic | version | flags | timestamp | key length | value length | expire at | sequence |
+//	origin length | origin sequence | clock length
+//
+// followed by the key, the value, the ID of the node the record was first
+// written on and then its vector clock, if it has one. The checksum covers
+// everything after itself, so a reader can walk and verify the file without
+// the keymap.
+// Version 1 records have no expire at field, and never expire. Versions 1
+// and 2 have no sequence number, and are read as sequence 0. Versions before
+// 4 have no origin, and before 5 no vector clock.
+const (
+	recordMagic   uint16 = 0x6764 // "gd"
+	recordVersion uint8  = 5
+
+	crcWidth       = 4
+	magicWidth     = 2
+	versionWidth   = 1
+	flagsWidth     = 1
+	timestampWidth = 8
+	keyLenWidth    = 4
+	valueLenWidth  = 4
+	expireAtWidth  = 8
+	seqWidth       = 8
+	originLenWidth = 2
+	originSeqWidth = 8
+	clockLenWidth  = 2
+
+	crcPos       = 0
+	magicPos     = crcPos + crcWidth
+	versionPos   = magicPos + magicWidth
+	flagsPos     = versionPos + versionWidth
+	timestampPos = flagsPos + flagsWidth
+	keyLenPos    = timestampPos + timestampWidth
+	valueLenPos  = keyLenPos + keyLenWidth
+	expireAtPos  = valueLenPos + valueLenWidth
+	seqPos       = expireAtPos + expireAtWidth
+	originLenPos = seqPos + seqWidth
+	originSeqPos = originLenPos + originLenWidth
+	clockLenPos  = originSeqPos + originSeqWidth
+	headerWidth  = clockLenPos + clockLenWidth
+
+	headerV1Width = expireAtPos
+	headerV2Width = seqPos
+	headerV3Width = originLenPos
+	headerV4Width = clockLenPos
+)
+
+// Record flags
+const (
+	// The record marks its key as deleted, and carries no value
+	flagTombstone uint8 = 1 << iota
+	// The value holds several versions of the key, written concurrently
+	flagSiblings
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrCorruptRecord is returned when a record fails its integrity checks
+	ErrCorruptRecord = errors.New("corrupt record")
+	// ErrRecordTooLarge is returned for a record with a part longer than its
+	// header can give the length of
+	ErrRecordTooLarge = errors.New("record too large")
+)
+
+type header struct {
+	crc       uint32
+	magic     uint16
+	version   uint8
+	flags     uint8
+	timestamp int64
+	keyLen    uint32
+	valueLen  uint32
+	expireAt  int64  // Unix nanoseconds, or 0 if the record never expires
+	seq       uint64 // Position of the record in the order it was written
+	originLen uint16
+	originSeq uint64 // Sequence number of the record on its origin
+	clockLen  uint16
+}
+
+// Size of the header on disk
+func (h header) width() uint64 {
+	switch h.version {
+	case 1:
+		return headerV1Width
+	case 2:
+		return headerV2Width
+	case 3:
+		return headerV3Width
+	case 4:
+		return headerV4Width
+	}
+	return headerWidth
+}
+
+// Total size of the record on disk, header included
+func (h header) size() uint64 {
+	return h.width() + uint64(h.keyLen) + uint64(h.valueLen) + uint64(h.originLen) + uint64(h.clockLen)
+}
+
+// Encode the record with its header, ready to be appended to the store
+func encodeRecord(record Record, flags uint8, timestamp int64, seq uint64) ([]byte, error) {
+	value := record.Value
+	if record.Siblings != nil {
+		flags |= flagSiblings
+		value = encodeSiblings(record.Siblings)
+	}
+	var clock []byte
+	if record.Clock != nil {
+		clock = record.Clock.Bytes()
+	}
+	switch {
+	case uint64(len(record.Key)) > math.MaxUint32:
+		return nil, fmt.Errorf("%w: key is %d bytes long", ErrRecordTooLarge, len(record.Key))
+	case uint64(len(value)) > math.MaxUint32:
+		return nil, fmt.Errorf("%w: value is %d bytes long", ErrRecordTooLarge, len(value))
+	case len(record.Origin) > math.MaxUint16:
+		return nil, fmt.Errorf("%w: origin is %d bytes long", ErrRecordTooLarge, len(record.Origin))
+	case len(clock) > math.MaxUint16:
+		return nil, fmt.Errorf("%w: clock is %d bytes long", ErrRecordTooLarge, len(clock))
+	}
+
+	b := make([]byte, headerWidth+len(record.Key)+len(value)+len(record.Origin)+len(clock))
+	enc.PutUint16(b[magicPos:], recordMagic)
+	b[versionPos] = recordVersion
+	b[flagsPos] = flags
+	enc.PutUint64(b[timestampPos:], uint64(timestamp))
+	enc.PutUint32(b[keyLenPos:], uint32(len(record.Key)))
+	enc.PutUint32(b[valueLenPos:], uint32(len(value)))
+	enc.PutUint64(b[expireAtPos:], uint64(expireAt(record.ExpireAt)))
+	enc.PutUint64(b[seqPos:], seq)
+	enc.PutUint16(b[originLenPos:], uint16(len(record.Origin)))
+	enc.PutUint64(b[originSeqPos:], record.OriginSeq)
+	enc.PutUint16(b[clockLenPos:], uint16(len(clock)))
+	pos := headerWidth
+	pos += copy(b[pos:], record.Key)
+	pos += copy(b[pos:], value)
+	pos += copy(b[pos:], record.Origin)
+	copy(b[pos:], clock)
+	enc.PutUint32(b[crcPos:], crc32.Checksum(b[magicPos:], crcTable))
+	return b, nil
+}
+
+// Decode and sanity check a record header. b must hold at least the version 1
+// header, and the rest of the header if the version has more.
+func decodeHeader(b []byte) (header, error) {
+	h := header{
+		crc:       enc.Uint32(b[crcPos:]),
+		magic:     enc.Uint16(b[magicPos:]),
+		version:   b[versionPos],
+		flags:     b[flagsPos],
+		timestamp: int64(enc.Uint64(b[timestampPos:])),
+		keyLen:    enc.Uint32(b[keyLenPos:]),
+		valueLen:  enc.Uint32(b[valueLenPos:]),
+	}
+	if h.magic != recordMagic {
+		return h, fmt.Errorf("%w: bad magic %#x", ErrCorruptRecord, h.magic)
+	}
+	if h.version < 1 || h.version > recordVersion {
+		return h, fmt.Errorf("%w: unknown version %d", ErrCorruptRecord, h.version)
+	}
+	if h.version >= 2 && len(b) >= headerV2Width {
+		h.expireAt = int64(enc.Uint64(b[expireAtPos:]))
+	}
+	if h.version >= 3 && len(b) >= headerV3Width {
+		h.seq = enc.Uint64(b[seqPos:])
+	}
+	if h.version >= 4 && len(b) >= headerWidth {
+		h.originLen = enc.Uint16(b[originLenPos:])
+		h.originSeq = enc.Uint64(b[originSeqPos:])
+	}
+	if h.version >= 5 && len(b) >= headerWidth {
+		h.clockLen = enc.Uint16(b[clockLenPos:])
+	}
+	return h, nil
+}
+
+// Read and verify the record starting at offset, in a segment of the given
+// size
+func readRecord(r io.ReaderAt, offset, size uint64) (Record, header, error) {
+	if offset > size {
+		return Record{}, header{}, io.EOF
+	}
+	record, h, err := decodeRecord(io.NewSectionReader(r, int64(offset), int64(size-offset)), size-offset)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if errors.Is(err, ErrCorruptRecord) {
+		err = fmt.Errorf("%w at offset %d", err, offset)
+	}
+	return record, h, err
+}
+
+// Read and verify the next record from r, which holds at most limit more
+// bytes. It returns io.EOF if r is empty, and io.ErrUnexpectedEOF if it ends
+// part way through a record. The lengths in the header are not yet covered
+// by the checksum, so a record they say runs past the limit is taken to be
+// corrupt before anything is allocated for it.
+func decodeRecord(r io.Reader, limit uint64) (Record, header, error) {
+	b := make([]byte, headerV1Width)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return Record{}, header{}, err
+	}
+	h, err := decodeHeader(b)
+	if err != nil {
+		return Record{}, h, err
+	}
+
+	// The rest of the header, which depends on the version, says how long
+	// the rest of the record is
+	b = append(b, make([]byte, h.width()-headerV1Width)...)
+	if _, err := io.ReadFull(r, b[headerV1Width:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, h, err
+	}
+	if h, err = decodeHeader(b); err != nil {
+		return Record{}, h, err
+	}
+	if h.size() > limit {
+		return Record{}, h, fmt.Errorf("%w: length runs past the end", ErrCorruptRecord)
+	}
+
+	b = append(b, make([]byte, h.size()-h.width())...)
+	if _, err := io.ReadFull(r, b[h.width():]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, h, err
+	}
+	if crc32.Checksum(b[magicPos:], crcTable) != h.crc {
+		return Record{}, h, fmt.Errorf("%w: checksum mismatch", ErrCorruptRecord)
+	}
+
+	keyEnd := h.width() + uint64(h.keyLen)
+	valueEnd := keyEnd + uint64(h.valueLen)
+	originEnd := valueEnd + uint64(h.originLen)
+	record := Record{Key: string(b[h.width():keyEnd]),
+		Value:     b[keyEnd:valueEnd],
+		Origin:    string(b[valueEnd:originEnd]),
+		OriginSeq: h.originSeq,
+		Timestamp: h.timestamp}
+	if h.expireAt != 0 {
+		record.ExpireAt = time.Unix(0, h.expireAt)
+	}
+	if h.clockLen > 0 {
+		if record.Clock, err = ParseVectorClock(b[originEnd:]); err != nil {
+			return Record{}, h, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+		}
+	}
+	if h.flags&flagSiblings != 0 {
+		if record.Siblings, err = decodeSiblings(record.Value); err != nil {
+			return Record{}, h, err
+		}
+		record.Value = nil
+		if len(record.Siblings) > 0 {
+			record.Value = record.Siblings[0].Value
+		}
+	}
+	return record, h, nil
+}
+
+// Unix nanoseconds for a record expiry, with the zero time meaning never
+func expireAt(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -2,22 +2,54 @@ package kvstore
 
 import (
 	"context"
-	// "fmt"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
-	"io"
+	"time"
+
 	api "github.com/jscottransom/distributed_godis/api"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Replicator struct {
 	DialOptions []grpc.DialOption
 	LocalServer api.GodisServiceClient
-	logger      *zap.Logger
-	mu          sync.Mutex
-	servers     map[string]chan struct{}
-	closed      bool
-	close       chan struct{}
+	// ID of the local node. Records that started out here are not applied
+	// again when they come back through a peer.
+	NodeID string
+	// How often to compare Merkle trees with every peer, pulling whatever
+	// the replication streams missed. Zero leaves it to AntiEntropy calls.
+	AntiEntropyInterval time.Duration
+	// Where to keep how far each peer's log has been replicated, so it can
+	// carry on from there after a restart
+	CursorDir string
+	// Whether a key is stored on the local node, when the keyspace is
+	// partitioned. Records for keys stored elsewhere are not applied. Nil
+	// means every key is stored here.
+	Owns func(key string) bool
+	// The local store. While it is still empty, it is loaded from a snapshot
+	// of the first peer to join rather than by replaying the peer's log, and
+	// the other peers are replicated once it has been. Nil always replays.
+	Store   *KVstore
+	logger  *zap.Logger
+	mu      sync.Mutex
+	servers map[string]chan struct{}
+	peers   map[string]string // Address of each peer, by name
+	status  map[string]*peerStatus
+	closed  bool
+	close   chan struct{}
+	// Name of the peer the store is bootstrapped from, and closed once it
+	// has been, or has failed to be
+	bootstrapPeer string
+	bootstrapped  chan struct{}
+	bootstrapOnce sync.Once
+	// Where to carry on replicating the other peers from, as of the snapshot
+	seeded map[string]uint64
 }
 
 func (r *Replicator) init() {
@@ -27,8 +59,20 @@ func (r *Replicator) init() {
 	if r.servers == nil {
 		r.servers = make(map[string]chan struct{})
 	}
+	if r.peers == nil {
+		r.peers = make(map[string]string)
+	}
+	if r.status == nil {
+		r.status = make(map[string]*peerStatus)
+	}
+	if r.bootstrapped == nil {
+		r.bootstrapped = make(chan struct{})
+	}
 	if r.close == nil {
 		r.close = make(chan struct{})
+		if r.AntiEntropyInterval > 0 {
+			go r.antiEntropyLoop()
+		}
 	}
 }
 
@@ -40,86 +84,311 @@ func (r *Replicator) logError(err error, msg, addr string) {
 	)
 }
 
-func (r *Replicator) replicate(addr string, leave chan struct{}) {
-	
-	sugarlog := r.sugarLogger()
+// Tail the peer's log and apply its records locally, carrying on from the
+// cursor saved for the peer. A lost connection is retried until the peer
+// leaves or the replicator is closed.
+func (r *Replicator) replicate(peer *peerStatus, leave chan struct{}) {
+	name, addr := peer.Name, peer.Addr
+	// However replication of the peer ends, the others are not held up
+	defer r.finishBootstrap(name)
+
 	cc, err := grpc.NewClient(addr, r.DialOptions...)
-	sugarlog.Infof("Client Connection target is %s", addr)
-	
 	if err != nil {
+		peer.fail(err)
 		r.logError(err, "failed to dial", addr)
 		return
 	}
 	defer cc.Close()
 
-	ctx := context.Background()
 	client := api.NewGodisServiceClient(cc)
 
-	
-	logger := r.sugarLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.close:
+		case <-leave:
+		}
+		cancel()
+	}()
+
+	cursor, err := r.loadCursor(name)
+	if err != nil {
+		peer.fail(err)
+		r.logError(err, "failed to load cursor", addr)
+		return
+	}
+	peer.resume(cursor)
+	if cursor, err = r.bootstrap(ctx, client, peer, cursor); err != nil {
+		peer.fail(err)
+		r.logError(err, "failed to bootstrap from snapshot", addr)
+	}
 
-	// Client gets a list of all the keys from the client,
-	// and then sets the value based on get requests for those keys
-	apiKeyList, err := client.ListKeys(ctx, &api.ListRequest{})
-	
+	for {
+		cursor, err = r.consume(ctx, client, peer, cursor)
+		if err := r.saveCursor(name, cursor); err != nil {
+			r.logError(err, "failed to save cursor", addr)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		peer.setState(api.ReplicationState_RETRYING)
+		peer.fail(err)
+		r.logError(err, "failed to consume log", addr)
 
-	var keyList []string
-	for _, k := range apiKeyList.Key {
-		keyList = append(keyList, k)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
 	}
+}
 
-	multiRequest := api.MultiGetRequest{Keys: keyList}
-	stream, err := client.GetStream(ctx, &multiRequest)
+// Load the empty local store from a snapshot of the peer, if it is the first
+// to join, returning the cursor to carry on replicating the peer from. The
+// other peers wait for it, so none of their records are written to the store
+// before the snapshot replaces it, and then carry on from where the peer had
+// got to with them, as their records before that are in the snapshot. If the
+// snapshot cannot be loaded, every peer's log is replayed as usual.
+func (r *Replicator) bootstrap(ctx context.Context, client api.GodisServiceClient, peer *peerStatus, cursor uint64) (uint64, error) {
+	if r.Store == nil {
+		return cursor, nil
+	}
+	name := peer.Name
+	r.mu.Lock()
+	first := r.bootstrapPeer == name
+	bootstrapped := r.bootstrapped
+	r.mu.Unlock()
+	if !first {
+		select {
+		case <-bootstrapped:
+		case <-ctx.Done():
+			return cursor, nil
+		}
+		r.mu.Lock()
+		seeded, ok := r.seeded[name]
+		r.mu.Unlock()
+		if !ok || seeded <= cursor {
+			return cursor, nil
+		}
+		peer.bootstrapped(seeded - 1)
+		return seeded, nil
+	}
+	defer r.finishBootstrap(name)
+	if cursor != 0 || !r.Store.empty() {
+		return cursor, nil
+	}
 
+	peer.setState(api.ReplicationState_BOOTSTRAPPING)
+	stream, err := client.StreamSnapshot(ctx, &api.SnapshotRequest{})
 	if err != nil {
-		r.logError(err, "failed to Get", addr)
-		return
+		return cursor, err
+	}
+	var seq uint64
+	var cursors map[string]uint64
+	err = r.Store.LoadSnapshot(func() (string, []byte, error) {
+		chunk, err := stream.Recv()
+		if err != nil {
+			return "", nil, err
+		}
+		seq, cursors = chunk.Seq, chunk.Cursors
+		peer.loaded(len(chunk.Data))
+		return chunk.File, chunk.Data, nil
+	})
+	if errors.Is(err, ErrStoreNotEmpty) {
+		return cursor, nil
 	}
+	if err != nil {
+		return cursor, err
+	}
+	if seq == 0 {
+		return cursor, nil
+	}
+	r.logger.Info("bootstrapped from snapshot", zap.String("name", name), zap.Uint64("seq", seq))
+	peer.bootstrapped(seq)
+	if err := r.seed(name, cursors); err != nil {
+		return seq + 1, err
+	}
+	return seq + 1, r.saveCursor(name, seq+1)
+}
 
-	valueList := make(chan *api.GetResponse)
+// Save the cursors the snapshot came with for the other peers, for them to
+// carry on from once the bootstrap is finished, or when they join later
+func (r *Replicator) seed(source string, cursors map[string]uint64) error {
+	seeded := make(map[string]uint64, len(cursors))
+	for name, cursor := range cursors {
+		if name == r.NodeID || name == source {
+			continue
+		}
+		if err := r.saveCursor(name, cursor); err != nil {
+			return err
+		}
+		seeded[name] = cursor
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seeded = seeded
+	return nil
+}
 
-	go func() {
-		for {
-			recv, err := stream.Recv()
-			
-			if err == io.EOF {
-				break
-			}
+// Let the other peers be replicated, once the store has been bootstrapped
+// from the peer or has failed to be
+func (r *Replicator) finishBootstrap(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name == r.bootstrapPeer {
+		r.bootstrapOnce.Do(func() { close(r.bootstrapped) })
+	}
+}
 
-			if err != nil {
-				logger.Info(err)
-				r.logError(err, "Failed to Receive", addr)
-				return
-			}
+// Apply the peer's records from the cursor on, until the stream breaks. It
+// returns the cursor to carry on from.
+func (r *Replicator) consume(ctx context.Context, client api.GodisServiceClient, peer *peerStatus, cursor uint64) (uint64, error) {
+	name := peer.Name
+	stream, err := client.ConsumeLog(ctx, &api.ConsumeRequest{FromOffset: cursor})
+	if err != nil {
+		return cursor, err
+	}
+	peer.setState(api.ReplicationState_STREAMING)
 
-			response := &api.GetResponse{
-				Key:   recv.Key,
-				Value: recv.Value,
-			}
-			valueList <- response
+	saved := time.Now()
+	for {
+		record, err := stream.Recv()
+		if err != nil {
+			return cursor, err
 		}
-	}()
 
-	for {
-		select {
-		case <-r.close:
-			return
-		case <-leave:
-			return
-		case val := <-valueList:
-
-			logger.Infof("Setting the following Key and Value: %s, %s", val.Key, val.Value)
-			_, err = r.LocalServer.SetKey(ctx, &api.SetRequest{
-				Key:   val.Key,
-				Value: val.Value,
-			})
-			if err != nil {
-				r.logError(err, "failed to Set Key", addr)
-				return
+		if err := r.apply(ctx, name, record); err != nil {
+			return cursor, err
+		}
+		if record.Offset > 0 {
+			cursor = record.Offset + 1
+		}
+		peer.took(record)
+
+		// The cursor is saved every so often rather than on every record;
+		// after a crash the records since are applied again
+		if time.Since(saved) > cursorSaveInterval {
+			if err := r.saveCursor(name, cursor); err != nil {
+				return cursor, err
 			}
+			saved = time.Now()
 		}
 	}
+}
+
+// Apply a record from the peer's log locally, unless it started out on this
+// node. Records written before origins were recorded are taken to have
+// started out on the peer. Records are compared with the version of their
+// key held locally rather than by where they came from, so one reaching this
+// node again through another peer, or out of order, loses to whatever is
+// already here if it is no newer, and is dropped.
+func (r *Replicator) apply(ctx context.Context, name string, record *api.LogRecord) error {
+	origin, originSeq := record.Origin, record.OriginSeq
+	if origin == "" {
+		origin, originSeq = name, record.Offset
+	}
+	if origin == r.NodeID || !r.owns(record.Key) {
+		return nil
+	}
+	_, err := r.write(ctx, record, origin, originSeq)
+	return err
+}
+
+func (r *Replicator) owns(key string) bool {
+	return r.Owns == nil || r.Owns(key)
+}
+
+// Write a record from a peer to the local server. It returns false if the
+// local server already held a newer version of the key, and dropped it.
+func (r *Replicator) write(ctx context.Context, record *api.LogRecord, origin string, originSeq uint64) (bool, error) {
+	return writeRecord(ctx, r.LocalServer, record, origin, originSeq)
+}
+
+// Write a record to a node, keeping its origin and version. It returns false
+// if the node already held a newer version of the key, and dropped it.
+func writeRecord(ctx context.Context, client api.GodisServiceClient, record *api.LogRecord, origin string, originSeq uint64) (bool, error) {
+	var err error
+	if record.Deleted {
+		_, err = client.DeleteKey(ctx, &api.DeleteRequest{Key: record.Key,
+			Origin:    origin,
+			OriginSeq: originSeq,
+			Timestamp: record.Timestamp,
+			Context:   record.Context})
+	} else {
+		_, err = client.SetKey(ctx, &api.SetRequest{
+			Key:       record.Key,
+			Value:     record.Value,
+			ExpireAt:  record.ExpireAt,
+			Origin:    origin,
+			OriginSeq: originSeq,
+			Timestamp: record.Timestamp,
+			Context:   record.Context,
+			Siblings:  record.Siblings,
+		})
+	}
+	if status.Code(err) == codes.Aborted {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+const cursorSaveInterval = time.Second
+
+func (r *Replicator) cursorPath(name string) string {
+	return filepath.Join(r.CursorDir, name+".cursor")
+}
+
+// Load the offset to carry on replicating the peer from
+func (r *Replicator) loadCursor(name string) (uint64, error) {
+	if r.CursorDir == "" {
+		return 0, nil
+	}
+	b, err := os.ReadFile(r.cursorPath(name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("error reading cursor for %s: bad length %d", name, len(b))
+	}
+	return enc.Uint64(b), nil
+}
+
+// Save the offset to carry on replicating the peer from
+func (r *Replicator) saveCursor(name string, cursor uint64) error {
+	if r.CursorDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(r.CursorDir, 0755); err != nil {
+		return err
+	}
+
+	b := make([]byte, 8)
+	enc.PutUint64(b, cursor)
+	return writeFile(r.cursorPath(name), b)
+}
 
+// Replace the file with b in a single rename
+func writeFile(path string, b []byte) error {
+	file, err := os.Create(path + tmpSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+tmpSuffix, path)
 }
 
 func (r *Replicator) Join(name, addr string) error {
@@ -135,13 +404,17 @@ func (r *Replicator) Join(name, addr string) error {
 		return nil
 	}
 
+	if r.Store != nil && r.bootstrapPeer == "" {
+		r.bootstrapPeer = name
+	}
 	r.servers[name] = make(chan struct{})
-	go r.replicate(addr, r.servers[name])
+	r.peers[name] = addr
+	r.status[name] = newPeerStatus(name, addr)
+	go r.replicate(r.status[name], r.servers[name])
 
 	return nil
 }
 
-
 func (r *Replicator) Leave(name string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -151,11 +424,12 @@ func (r *Replicator) Leave(name string) error {
 	}
 	close(r.servers[name])
 	delete(r.servers, name)
+	delete(r.peers, name)
+	r.status[name].clear()
+	delete(r.status, name)
 	return nil
 }
 
-
-
 func (r *Replicator) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -168,12 +442,3 @@ func (r *Replicator) Close() error {
 	close(r.close)
 	return nil
 }
-
-
-
-func (r *Replicator) sugarLogger() *zap.SugaredLogger {
-	tempLogger := zap.Must(zap.NewDevelopment())
-	sugar := tempLogger.Sugar()
-
-	return sugar
-}
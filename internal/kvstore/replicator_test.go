@@ -0,0 +1,262 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	api "github.com/jscottransom/distributed_godis/api"
+	kmap "github.com/jscottransom/distributed_godis/internal/keymap"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReplicatorCursor(t *testing.T) {
+	r := &Replicator{CursorDir: t.TempDir() + "/replication"}
+
+	// Peers start from the beginning of their log
+	cursor, err := r.loadCursor("peer")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), cursor)
+
+	require.NoError(t, r.saveCursor("peer", 42))
+	require.NoError(t, r.saveCursor("other", 7))
+
+	// A restarted replicator carries on from the saved cursors
+	r = &Replicator{CursorDir: r.CursorDir}
+	cursor, err = r.loadCursor("peer")
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), cursor)
+	cursor, err = r.loadCursor("other")
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), cursor)
+}
+
+func TestReplicatorSkipsEchoes(t *testing.T) {
+	local := &localServer{}
+	r := &Replicator{NodeID: "a", LocalServer: local, CursorDir: t.TempDir()}
+	ctx := context.Background()
+
+	records := []*api.LogRecord{
+		// Written on this node, and echoed back by the peer
+		{Offset: 1, Key: "mine", Value: []byte("a"), Origin: "a", OriginSeq: 1, Timestamp: 1},
+		// Written on the peer
+		{Offset: 2, Key: "theirs", Value: []byte("b"), Origin: "b", OriginSeq: 1, Timestamp: 2},
+		// Written on a third node
+		{Offset: 3, Key: "other", Value: []byte("c"), Origin: "c", OriginSeq: 4, Timestamp: 3},
+		{Offset: 4, Key: "other", Deleted: true, Origin: "c", OriginSeq: 5, Timestamp: 4},
+		// Written before origins were recorded
+		{Offset: 5, Key: "legacy", Value: []byte("d"), Timestamp: 5},
+	}
+	for _, record := range records {
+		require.NoError(t, r.apply(ctx, "b", record))
+	}
+	require.Equal(t, []string{"set theirs b/1", "set other c/4", "delete other c/5", "set legacy b/5"}, local.applied)
+
+	// The third node's records arriving again through another peer lose to
+	// the versions already here, as does anything older from it
+	local.applied = nil
+	require.NoError(t, r.apply(ctx, "c", records[2]))
+	require.NoError(t, r.apply(ctx, "c", records[3]))
+	require.NoError(t, r.apply(ctx, "c", &api.LogRecord{Offset: 9, Key: "other", Value: []byte("e"), Origin: "c", OriginSeq: 3, Timestamp: 2}))
+	require.NoError(t, r.apply(ctx, "c", &api.LogRecord{Offset: 10, Key: "newer", Value: []byte("f"), Origin: "c", OriginSeq: 6, Timestamp: 6}))
+	require.Equal(t, []string{"set newer c/6"}, local.applied)
+}
+
+func TestReplicatorOutOfOrder(t *testing.T) {
+	local := &localServer{}
+	r := &Replicator{NodeID: "x", LocalServer: local}
+	ctx := context.Background()
+
+	// A's later write to one key arrives through B before its earlier write
+	// to another arrives from A itself, and both are applied
+	require.NoError(t, r.apply(ctx, "b", &api.LogRecord{Offset: 40, Key: "later", Value: []byte("12"), Origin: "a", OriginSeq: 12, Timestamp: 12}))
+	require.NoError(t, r.apply(ctx, "a", &api.LogRecord{Offset: 11, Key: "earlier", Value: []byte("11"), Origin: "a", OriginSeq: 11, Timestamp: 11}))
+	require.Equal(t, []string{"set later a/12", "set earlier a/11"}, local.applied)
+
+	// Records for keys stored elsewhere are passed over without holding back
+	// the rest of the origin's records
+	r.Owns = func(key string) bool { return key != "elsewhere" }
+	local.applied = nil
+	require.NoError(t, r.apply(ctx, "a", &api.LogRecord{Offset: 14, Key: "elsewhere", Value: []byte("14"), Origin: "a", OriginSeq: 14, Timestamp: 14}))
+	require.NoError(t, r.apply(ctx, "b", &api.LogRecord{Offset: 41, Key: "here", Value: []byte("13"), Origin: "a", OriginSeq: 13, Timestamp: 13}))
+	require.Equal(t, []string{"set here a/13"}, local.applied)
+}
+
+func TestReplicatorStatus(t *testing.T) {
+	r := &Replicator{NodeID: "a", LocalServer: &localServer{}}
+	r.init()
+	peer := newPeerStatus("b", "127.0.0.1:1")
+	r.status["b"] = peer
+	peer.resume(3)
+
+	// The peer's log runs on ahead of what has been taken from it
+	client := &peerServer{records: []*api.LogRecord{
+		{Offset: 3, Key: "one", Value: []byte("1"), Origin: "b", OriginSeq: 3, LastOffset: 6},
+		{Offset: 4, Key: "two", Value: []byte("2"), Origin: "b", OriginSeq: 4, LastOffset: 6},
+	}}
+	cursor, err := r.consume(context.Background(), client, peer, 3)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, uint64(5), cursor)
+
+	statuses := r.ReplicationStatus()
+	require.Len(t, statuses, 1)
+	got := statuses[0]
+	require.Equal(t, api.ReplicationState_STREAMING, got.State)
+	require.Equal(t, uint64(4), got.Applied)
+	require.Equal(t, uint64(6), got.PeerOffset)
+	require.Equal(t, uint64(2), got.Lag())
+	require.Equal(t, uint64(2), got.Records)
+	require.Greater(t, got.Bytes, uint64(0))
+	require.NoError(t, got.LastError)
+
+	// Failures are kept until the next one
+	peer.fail(err)
+	got = r.ReplicationStatus()[0]
+	require.ErrorIs(t, got.LastError, io.ErrUnexpectedEOF)
+	require.False(t, got.LastErrorAt.IsZero())
+
+	// Peers that leave are no longer reported
+	r.servers["b"] = make(chan struct{})
+	require.NoError(t, r.Leave("b"))
+	require.Empty(t, r.ReplicationStatus())
+}
+
+func TestReplicatorBootstrap(t *testing.T) {
+	dir := t.TempDir()
+	src, err := NewKVstore(dir, "src", Config{NodeID: "a"})
+	require.NoError(t, err)
+	defer src.Close()
+	require.NoError(t, src.Set(Record{Key: "key", Value: []byte("value")}))
+	snapshot, err := src.Snapshot()
+	require.NoError(t, err)
+	defer snapshot.Close()
+
+	// The peer the snapshot comes from has replicated b up to 7, and this
+	// node up to 2
+	cursors := map[string]uint64{"b": 8, "x": 3}
+	var chunks []*api.SnapshotChunk
+	require.NoError(t, snapshot.Chunks(1024, func(name string, data []byte) error {
+		chunks = append(chunks, &api.SnapshotChunk{File: name,
+			Data:    append([]byte(nil), data...),
+			Seq:     snapshot.Seq,
+			Cursors: cursors})
+		return nil
+	}))
+
+	dst, err := NewKVstore(dir, "dst", Config{NodeID: "x"})
+	require.NoError(t, err)
+	defer dst.Close()
+	r := &Replicator{NodeID: "x", LocalServer: &localServer{}, Store: dst, CursorDir: dir + "/replication"}
+	r.init()
+	r.bootstrapPeer = "a"
+	ctx := context.Background()
+
+	a := newPeerStatus("a", "127.0.0.1:1")
+	cursor, err := r.bootstrap(ctx, &peerServer{chunks: chunks}, a, 0)
+	require.NoError(t, err)
+	require.Equal(t, snapshot.Seq+1, cursor)
+	require.Equal(t, []string{"key"}, dst.Keys())
+
+	// The other peers carry on from where the snapshot had got to with them
+	// rather than replaying their logs from the start
+	b := newPeerStatus("b", "127.0.0.1:2")
+	cursor, err = r.bootstrap(ctx, nil, b, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), cursor)
+	require.Equal(t, uint64(7), b.status().Applied)
+	cursor, err = r.loadCursor("b")
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), cursor)
+	cursor, err = r.loadCursor("x")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), cursor)
+
+	// Peers the snapshot knew nothing of start from the beginning
+	c := newPeerStatus("c", "127.0.0.1:3")
+	cursor, err = r.bootstrap(ctx, nil, c, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), cursor)
+}
+
+// A peer whose log stream sends the records, then breaks
+type peerServer struct {
+	api.GodisServiceClient
+	records []*api.LogRecord
+	chunks  []*api.SnapshotChunk
+}
+
+func (s *peerServer) StreamSnapshot(ctx context.Context, req *api.SnapshotRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[api.SnapshotChunk], error) {
+	return &snapshotStream{chunks: s.chunks}, nil
+}
+
+type snapshotStream struct {
+	grpc.ServerStreamingClient[api.SnapshotChunk]
+	chunks []*api.SnapshotChunk
+}
+
+func (s *snapshotStream) Recv() (*api.SnapshotChunk, error) {
+	if len(s.chunks) == 0 {
+		return nil, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func (s *peerServer) ConsumeLog(ctx context.Context, req *api.ConsumeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[api.LogRecord], error) {
+	return &logStream{records: s.records}, nil
+}
+
+type logStream struct {
+	grpc.ServerStreamingClient[api.LogRecord]
+	records []*api.LogRecord
+}
+
+func (s *logStream) Recv() (*api.LogRecord, error) {
+	if len(s.records) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	record := s.records[0]
+	s.records = s.records[1:]
+	return record, nil
+}
+
+// Records the writes a replicator applies. Like the store, it drops a write
+// that is no newer than the version of its key it already holds.
+type localServer struct {
+	api.GodisServiceClient
+	applied  []string
+	versions map[string]*kmap.KeyInfo
+}
+
+func (s *localServer) receive(key, origin string, timestamp int64) bool {
+	version := &kmap.KeyInfo{Timestamp: timestamp, Origin: origin}
+	if prev, ok := s.versions[key]; ok && !prev.Before(version) {
+		return false
+	}
+	if s.versions == nil {
+		s.versions = make(map[string]*kmap.KeyInfo)
+	}
+	s.versions[key] = version
+	return true
+}
+
+func (s *localServer) SetKey(ctx context.Context, req *api.SetRequest, opts ...grpc.CallOption) (*api.SetResponse, error) {
+	if !s.receive(req.Key, req.Origin, req.Timestamp) {
+		return nil, status.Error(codes.Aborted, "newer version")
+	}
+	s.applied = append(s.applied, fmt.Sprintf("set %s %s/%d", req.Key, req.Origin, req.OriginSeq))
+	return &api.SetResponse{Response: "OK"}, nil
+}
+
+func (s *localServer) DeleteKey(ctx context.Context, req *api.DeleteRequest, opts ...grpc.CallOption) (*api.DeleteResponse, error) {
+	if !s.receive(req.Key, req.Origin, req.Timestamp) {
+		return nil, status.Error(codes.Aborted, "newer version")
+	}
+	s.applied = append(s.applied, fmt.Sprintf("delete %s %s/%d", req.Key, req.Origin, req.OriginSeq))
+	return &api.DeleteResponse{Response: "OK"}, nil
+}
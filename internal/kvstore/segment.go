@@ -0,0 +1,80 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// A numbered file holding a run of records. Only the active segment is
+// appended to; once it fills up it is closed and never modified again.
+type segment struct {
+	id   uint32
+	file *os.File
+	size uint64 // Bytes of records in the segment
+	dead uint64 // Bytes of overwritten or deleted records in the segment
+	// Bytes of the segment that have reached the file, and can be read
+	// without flushing the write buffer
+	flushed atomic.Uint64
+}
+
+const (
+	hintSuffix = ".hint"
+	tmpSuffix  = ".tmp"
+
+	journalSuffix    = ".journal"
+	checkpointSuffix = ".checkpoint"
+)
+
+func segmentPath(dir, name string, id uint32) string {
+	return fmt.Sprintf("%s/%s.%06d", dir, name, id)
+}
+
+// The hint file for a closed segment sits beside it
+func hintPath(dir, name string, id uint32) string {
+	return segmentPath(dir, name, id) + hintSuffix
+}
+
+// Open the segment for appending if it is the active one, or read only
+func openSegment(dir, name string, id uint32, active bool) (*segment, error) {
+	flag := os.O_RDONLY
+	if active {
+		flag = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(segmentPath(dir, name, id), flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening segment %d: %w", id, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error getting segment stats: %w", err)
+	}
+	seg := &segment{id: id,
+		file: file,
+		size: uint64(stat.Size())}
+	seg.flushed.Store(seg.size)
+	return seg, nil
+}
+
+// List the ids of the segments in the directory, in order
+func listSegments(dir, name string) ([]uint32, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, name+".*"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, path := range paths {
+		id, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(path), name+"."), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
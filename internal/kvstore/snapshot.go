@@ -0,0 +1,287 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrStoreNotEmpty is returned when loading a snapshot into a store that
+// already holds records
+var ErrStoreNotEmpty = errors.New("store not empty")
+
+// The file a snapshot carries the keymap in, beside the segments
+const snapshotCheckpoint = "checkpoint"
+
+// Snapshot is a point-in-time copy of the store's segments, along with a
+// checkpoint of the keymap pointing into them. It holds its own handles on
+// the files, so merges and appends carry on while it is read.
+type Snapshot struct {
+	// Sequence number of the newest record in the snapshot. Replication
+	// from the store carries on after it.
+	Seq   uint64
+	files []snapshotFile
+}
+
+type snapshotFile struct {
+	name string // Segment number, or snapshotCheckpoint
+	file *os.File
+	size int64
+}
+
+// Snapshot takes a snapshot of the store. The keymap is checkpointed first,
+// so the snapshot can be loaded without walking its segments.
+func (s *KVstore) Snapshot() (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Keymap.FileLock.RLock()
+	err := s.checkpoint()
+	s.Keymap.FileLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{Seq: s.lastSeq}
+	add := func(name, path string, size int64) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		snapshot.files = append(snapshot.files, snapshotFile{name: name, file: file, size: size})
+		return nil
+	}
+
+	s.segMu.RLock()
+	ids := make([]uint32, 0, len(s.segments))
+	for id := range s.segments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		// The active segment is cut off where it stands now
+		if err = add(fmt.Sprintf("%06d", id), segmentPath(s.dir, s.name, id), int64(s.segments[id].size)); err != nil {
+			break
+		}
+	}
+	s.segMu.RUnlock()
+	if err == nil {
+		path := s.dir + "/" + s.name + checkpointSuffix
+		var stat os.FileInfo
+		if stat, err = os.Stat(path); err == nil {
+			err = add(snapshotCheckpoint, path, stat.Size())
+		}
+	}
+	if err != nil {
+		snapshot.Close()
+		return nil, fmt.Errorf("error taking snapshot: %w", err)
+	}
+	return snapshot, nil
+}
+
+// Chunks passes the files of the snapshot to fn in order, a piece of at most
+// size bytes at a time. Every file is passed at least once, even if empty.
+func (s *Snapshot) Chunks(size int, fn func(name string, data []byte) error) error {
+	b := make([]byte, size)
+	for _, f := range s.files {
+		r := io.NewSectionReader(f.file, 0, f.size)
+		for sent := false; ; sent = true {
+			n, err := io.ReadFull(r, b)
+			if err == io.EOF && sent {
+				break
+			}
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return fmt.Errorf("error reading snapshot: %w", err)
+			}
+			if err := fn(f.name, b[:n]); err != nil {
+				return err
+			}
+			if n < size {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Snapshot) Close() error {
+	var errs []error
+	for _, f := range s.files {
+		errs = append(errs, f.file.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// LoadSnapshot fills an empty store from a snapshot of another, taking the
+// pieces of its files from next until it returns io.EOF. The files are
+// written aside first, and only swapped in once the whole snapshot has
+// arrived. It returns ErrStoreNotEmpty, and leaves the store as it was, if
+// the store has taken any records.
+func (s *KVstore) LoadSnapshot(next func() (name string, data []byte, err error)) error {
+	if !s.empty() {
+		return ErrStoreNotEmpty
+	}
+
+	staging, err := os.MkdirTemp(s.dir, s.name+".snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	names, err := receiveSnapshot(staging, s.name, next)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastSeq != 0 {
+		return ErrStoreNotEmpty
+	}
+	s.Keymap.FileLock.Lock()
+	defer s.Keymap.FileLock.Unlock()
+	s.segMu.Lock()
+	defer s.segMu.Unlock()
+
+	// Put the store's own files aside and recover from the snapshot's, as if
+	// the store had been reopened on them. If that fails, the store's own
+	// files are put back and recovered from instead.
+	aside, err := os.MkdirTemp(s.dir, s.name+".aside")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(aside)
+	own := []string{s.name + journalSuffix, s.name + checkpointSuffix}
+	for id := range s.segments {
+		own = append(own, filepath.Base(segmentPath(s.dir, s.name, id)), filepath.Base(hintPath(s.dir, s.name, id)))
+	}
+	var movedAside, movedIn []string
+	lastTimestamp := s.lastTimestamp
+	load := func() error {
+		if err := s.journal.Close(); err != nil {
+			return err
+		}
+		if err := s.closeSegments(); err != nil {
+			return err
+		}
+		if movedAside, err = moveFiles(s.dir, aside, own); err != nil {
+			return err
+		}
+		if movedIn, err = moveFiles(staging, s.dir, names); err != nil {
+			return err
+		}
+		s.segments = make(map[uint32]*segment)
+		s.active = nil
+		return s.recover()
+	}
+	s.merges.Add(1)
+	if err := load(); err != nil {
+		s.closeSegments()
+		s.journal.Close()
+		for _, name := range movedIn {
+			os.Remove(filepath.Join(s.dir, name))
+		}
+		_, rerr := moveFiles(aside, s.dir, movedAside)
+		if rerr == nil {
+			s.segments = make(map[uint32]*segment)
+			s.active = nil
+			s.lastSeq, s.lastTimestamp = 0, lastTimestamp
+			rerr = s.recover()
+		}
+		return fmt.Errorf("error loading snapshot: %w", errors.Join(err, rerr))
+	}
+
+	close(s.appended)
+	s.appended = make(chan struct{})
+	return nil
+}
+
+// Whether the store has never taken a record
+func (s *KVstore) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSeq == 0
+}
+
+// Write the files of a snapshot to dir, named for a store called name. It
+// returns the names of the files written.
+func receiveSnapshot(dir, name string, next func() (string, []byte, error)) ([]string, error) {
+	var names []string
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+	for {
+		part, data, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error receiving snapshot: %w", err)
+		}
+
+		// Each file arrives whole before the next starts
+		if len(names) == 0 || names[len(names)-1] != name+"."+part {
+			if _, err := strconv.ParseUint(part, 10, 32); err != nil && part != snapshotCheckpoint {
+				return nil, fmt.Errorf("error receiving snapshot: unexpected file %q", part)
+			}
+			if file != nil {
+				if err := syncClose(file); err != nil {
+					return nil, err
+				}
+			}
+			names = append(names, name+"."+part)
+			if file, err = os.Create(filepath.Join(dir, names[len(names)-1])); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := file.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if file != nil {
+		err := syncClose(file)
+		file = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, n := range names {
+		if strings.HasSuffix(n, "."+snapshotCheckpoint) {
+			return names, nil
+		}
+	}
+	return nil, errors.New("error receiving snapshot: no checkpoint")
+}
+
+// Move the named files from one directory to another, skipping any that do
+// not exist. It returns the names of the files moved.
+func moveFiles(from, to string, names []string) ([]string, error) {
+	var moved []string
+	for _, name := range names {
+		err := os.Rename(filepath.Join(from, name), filepath.Join(to, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return moved, fmt.Errorf("error moving %s: %w", name, err)
+		}
+		moved = append(moved, name)
+	}
+	return moved, nil
+}
+
+func syncClose(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -2,34 +2,156 @@ package kvstore
 
 import (
 	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
-	// "path/filepath"
 	"sync"
+	"sync/atomic"
 	kmap "github.com/jscottransom/distributed_godis/internal/keymap"
+	"go.uber.org/zap"
 )
 
 const (
 	STORE_TEMPLATE = "godis_kv"
 )
 
+var (
+	enc = binary.BigEndian
+
+	// ErrKeyNotFound is returned when a key is not in the store, or has been deleted
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrStaleRecord is returned when a replicated write is older than the
+	// version of the key already in the store
+	ErrStaleRecord = errors.New("stale record")
+)
+
 // Record is a struct representing a key value pairing
 // Key must be a string and value must be a slice of bytes
 type Record struct {
 	Key   string
 	Value []byte
+	// The key is hidden and later deleted once this passes; the zero time
+	// means it never expires
+	ExpireAt time.Time
+	// The node the record was first written on, and its sequence number
+	// there. Records written locally are stamped with the store's node ID.
+	Origin    string
+	OriginSeq uint64
+	// Hybrid logical clock reading the record was written at. It is left zero
+	// on a new write for the store to stamp, and carried over when the write
+	// is replicated, so every node orders versions of a key the same way.
+	Timestamp int64
+	// Vector clock of the key when the store keeps siblings. Read back, it
+	// is the causal context to write the key with; a write replaces the
+	// versions its context has seen.
+	Clock VectorClock
+	// Every version of the key when concurrent writes have left more than
+	// one, with Value holding the first. Nil unless the store keeps siblings.
+	Siblings []Sibling
+}
+
+type Config struct {
+	// ID of the node the store runs on, recorded as the origin of local writes
+	NodeID string
+	// Keep concurrent writes to a key side by side as siblings, versioned by
+	// vector clocks, rather than letting the last write win
+	Siblings bool
+	Segment struct {
+		// Roll over to a new segment once the active one reaches this size
+		MaxBytes uint64
+	}
+	Merge struct {
+		// Merge once this fraction of the store is overwritten or deleted data
+		DeadRatio float64
+		// and at least this many bytes would be reclaimed
+		MinDeadBytes uint64
+		// How often to check the thresholds in the background
+		Interval time.Duration
+	}
+	Checkpoint struct {
+		// Checkpoint the keymap once the journal holds this many entries,
+		// and at least as many as the keymap has keys, so the cost of
+		// writing the whole keymap out is spread across the writes since
+		Entries uint64
+	}
+	Tombstone struct {
+		// Drop tombstones older than this as the store is merged, by when
+		// every replica can be counted on to have seen them. Zero keeps
+		// them for good.
+		TTL time.Duration
+	}
+	Expire struct {
+		// How often to sweep expired keys, writing tombstones for them. A
+		// negative interval leaves sweeping to the caller.
+		Interval time.Duration
+	}
+	Sync struct {
+		// One of SyncAlways, SyncInterval or SyncNone
+		Mode string
+		// How often to fsync in SyncInterval mode
+		Interval time.Duration
+	}
 }
 
 type KVstore struct {
-	file                   *os.File // File to work with
+	Config
+	dir, name              string
+	segments               map[uint32]*segment
+	active                 *segment // Segment to append to
 	Keymap		    	   *kmap.SafeMap
-	mu                     sync.Mutex
-	baseoffset, nextoffset uint64 // Represents the last offset in the file
+	leaves                 [merkleLeaves]uint64 // Merkle tree leaves over the keymap, guarded by Keymap.FileLock
+	mu                     sync.Mutex // Serializes writes
+	segMu                  sync.RWMutex // Guards the segments map and closing their files
 	buf                    *bufio.Writer
+	journal                *kmap.Journal // Keymap updates since the last checkpoint
+	lastTimestamp          int64 // Timestamp of the newest record in the store
+	lastSeq                uint64 // Sequence number of the newest record in the store
+	merges                 atomic.Uint64 // Number of merges, which move records around
+	mergeMu                sync.Mutex // Held for the whole of a merge, so only one runs at a time
+	appended               chan struct{} // Closed and replaced on every append
+	closed                 chan struct{}
+	syncMu                 sync.Mutex // Held by the writer syncing on behalf of a group
+	written                uint64 // Sequence number of the last write, guarded by mu
+	synced                 atomic.Uint64 // Sequence number of the last durable write
+	syncs                  atomic.Uint64 // Number of fsyncs issued for commits
 }
 
-func NewKVstore(dir string, name string) (*KVstore, error) {
+func NewKVstore(dir string, name string, c Config) (*KVstore, error) {
+	if c.Segment.MaxBytes == 0 {
+		c.Segment.MaxBytes = 64 * 1024 * 1024
+	}
+	if c.Merge.DeadRatio == 0 {
+		c.Merge.DeadRatio = 0.5
+	}
+	if c.Merge.MinDeadBytes == 0 {
+		c.Merge.MinDeadBytes = 1024 * 1024
+	}
+	if c.Merge.Interval == 0 {
+		c.Merge.Interval = time.Minute
+	}
+	if c.Checkpoint.Entries == 0 {
+		c.Checkpoint.Entries = 10000
+	}
+	switch c.Sync.Mode {
+	case "":
+		c.Sync.Mode = SyncAlways
+	case SyncAlways, SyncInterval, SyncNone:
+	default:
+		return nil, fmt.Errorf("error creating store: unknown sync mode %q", c.Sync.Mode)
+	}
+	if c.Expire.Interval == 0 {
+		c.Expire.Interval = time.Second
+	}
+	if c.Sync.Interval == 0 {
+		c.Sync.Interval = 100 * time.Millisecond
+	}
 
 	// Create new if it doesn't exist
 	// err := os.MkdirAll(dir, os.ModePerm)
@@ -37,109 +159,740 @@ func NewKVstore(dir string, name string) (*KVstore, error) {
 	// 	return nil, fmt.Errorf("error creating directories %w", err)
 	// }
 
-	fileString := dir + "/" + name
-	storefile, err := os.Create(fileString)
+	kmapObj := kmap.NewMap()
+
+	s := &KVstore{Config: c,
+		dir:        dir,
+		name:       name,
+		segments:   make(map[uint32]*segment),
+		Keymap: 	kmapObj,
+		mu:         sync.Mutex{},
+		closed:     make(chan struct{}),
+		appended:   make(chan struct{})}
+
+	// Open the existing segments, so a restarted node comes back with its data
+	if err := s.recover(); err != nil {
+		s.closeSegments()
+		if s.journal != nil {
+			s.journal.Close()
+		}
+		return nil, err
+	}
+
+	go s.mergeLoop()
+	if c.Expire.Interval > 0 {
+		go s.expireLoop()
+	}
+	if c.Sync.Mode == SyncInterval {
+		go s.syncLoop()
+	}
+
+	return s, nil
+}
+
+// Open the segments in order to rebuild the keymap. The keymap is loaded
+// from the last checkpoint and the journal of updates since, and only the
+// records written after the last journal entry are walked. Without a usable
+// checkpoint, closed segments are indexed from their hint files where
+// possible, and otherwise walked like the active segment. A torn final record
+// in the active segment, left behind by a crash, is truncated away, while a
+// corrupt record anywhere else is reported rather than silently dropping
+// everything after it.
+// Once the store is in use, the caller must hold Keymap.FileLock and segMu.
+func (s *KVstore) recover() error {
+
+	// Leftovers from a merge or hint file write that did not finish
+	for _, suffix := range []string{mergeSuffix, tmpSuffix} {
+		leftovers, err := filepath.Glob(filepath.Join(s.dir, s.name+".*"+suffix))
+		if err != nil {
+			return err
+		}
+		for _, leftover := range leftovers {
+			os.Remove(leftover)
+		}
+	}
+
+	ids, err := listSegments(s.dir, s.name)
 	if err != nil {
-		return nil, fmt.Errorf("error opening file for writing to store: %w", err)
+		return fmt.Errorf("error listing segments: %w", err)
+	}
+
+	// A store written before segments existed becomes the first segment
+	if len(ids) == 0 {
+		legacy := s.dir + "/" + s.name
+		if _, err := os.Stat(legacy); err == nil {
+			if err := os.Rename(legacy, segmentPath(s.dir, s.name, 0)); err != nil {
+				return err
+			}
+		}
+		ids = []uint32{0}
+	}
+
+	for i, id := range ids {
+		active := i == len(ids)-1
+		seg, err := openSegment(s.dir, s.name, id, active)
+		if err != nil {
+			return err
+		}
+		s.segments[id] = seg
+		if active {
+			s.active = seg
+			s.buf = bufio.NewWriter(seg.file)
+		}
 	}
 
+	s.Keymap.Map = make(kmap.KeyMap)
+	s.Keymap.Tombstones = make(kmap.KeyMap)
+	s.leaves = [merkleLeaves]uint64{}
 
-	stat, err := os.Stat(storefile.Name())
+	covered, pos, err := s.loadCheckpoint()
 	if err != nil {
-		return nil, fmt.Errorf("error getting file stats: %w", err)
+		return err
 	}
 
-	// Get the current offset of the file by getting the size
-	offset := uint64(stat.Size())
+	var scanned []*segment
+	for _, id := range ids {
+		seg := s.segments[id]
+		active := seg == s.active
+		var from uint64
+		switch {
+		case covered && id < pos.Segment:
+			continue
+		case covered && id == pos.Segment:
+			from = pos.Offset
+		case !active && s.loadHint(seg):
+			continue
+		case !active:
+			scanned = append(scanned, seg)
+		}
+		if err := s.scanSegment(seg, active, from); err != nil {
+			return err
+		}
+	}
+	s.recountDead()
 
-	kmapObj, err := kmap.NewMap(dir)
+	// Closed segments without a hint get one for next time
+	for _, seg := range scanned {
+		s.writeHint(seg)
+	}
 
-	return &KVstore{file: storefile,
-		Keymap: 	kmapObj,
-		baseoffset: offset,
-		nextoffset: offset,
-		mu:         sync.Mutex{},
-		buf:        bufio.NewWriter(storefile)}, nil
+	// Start the journal afresh from a checkpoint of what was recovered
+	return s.checkpoint()
+}
+
+// Index a closed segment from its hint file. It returns false if the hint is
+// missing or was not written for this segment, and the segment must be
+// walked instead. The caller must hold Keymap.FileLock.
+func (s *KVstore) loadHint(seg *segment) bool {
+	size, hints, err := kmap.ReadHint(hintPath(s.dir, s.name, seg.id))
+	if err != nil || size != seg.size {
+		return false
+	}
+	for _, hint := range hints {
+		keyinfo := hint.KeyInfo
+		s.index(hint.Key, &keyinfo, hint.Tombstone)
+		if keyinfo.Timestamp > s.lastTimestamp {
+			s.lastTimestamp = keyinfo.Timestamp
+		}
+		if keyinfo.Seq > s.lastSeq {
+			s.lastSeq = keyinfo.Seq
+		}
+	}
+	return true
+}
+
+// Write the hint file for a closed segment. Failing to write one only costs
+// walking the segment on the next start, so it is logged rather than
+// returned. The caller must hold Keymap.FileLock.
+func (s *KVstore) writeHint(seg *segment) {
+	path := hintPath(s.dir, s.name, seg.id)
+	err := kmap.WriteHint(path+tmpSuffix, seg.size, s.Keymap.SegmentHints(seg.id))
+	if err == nil {
+		err = os.Rename(path+tmpSuffix, path)
+	}
+	if err != nil {
+		os.Remove(path + tmpSuffix)
+		zap.L().Named("kvstore").Error("failed to write hint file", zap.Uint32("segment", seg.id), zap.Error(err))
+	}
+}
+
+// Work out the dead bytes in each segment from what the keymap points at.
+// The caller must hold Keymap.FileLock.
+func (s *KVstore) recountDead() {
+	live := make(map[uint32]uint64)
+	for _, keymap := range []kmap.KeyMap{s.Keymap.Map, s.Keymap.Tombstones} {
+		for _, keyinfo := range keymap {
+			live[keyinfo.Segment] += keyinfo.Size
+		}
+	}
+	for id, seg := range s.segments {
+		seg.dead = seg.size - live[id]
+	}
+}
+
+// Index every record in the segment from the given offset on.
+// The caller must hold Keymap.FileLock.
+func (s *KVstore) scanSegment(seg *segment, active bool, offset uint64) error {
+	for offset < seg.size {
+		record, h, err := readRecord(seg.file, offset, seg.size)
+		if err == io.EOF && active {
+			break
+		}
+		if err != nil {
+			if active && errors.Is(err, ErrCorruptRecord) && offset+h.size() >= seg.size {
+				break
+			}
+			return fmt.Errorf("error recovering segment %d: %w", seg.id, err)
+		}
+
+		tombstone := h.flags&flagTombstone != 0
+		s.index(record.Key, &kmap.KeyInfo{Size: h.size(),
+			Segment:   seg.id,
+			Offset:    offset,
+			Timestamp: h.timestamp,
+			ExpireAt:  h.expireAt,
+			Seq:       h.seq,
+			Origin:    record.Origin,
+			Digest:    s.digest(record.Key, tombstone, h.timestamp, record.Origin, record.Clock)}, tombstone)
+		if h.timestamp > s.lastTimestamp {
+			s.lastTimestamp = h.timestamp
+		}
+		if h.seq > s.lastSeq {
+			s.lastSeq = h.seq
+		}
+		offset += h.size()
+	}
+
+	if offset < seg.size {
+		if err := seg.file.Truncate(int64(offset)); err != nil {
+			return fmt.Errorf("error truncating torn record at offset %d: %w", offset, err)
+		}
+		seg.size = offset
+		seg.flushed.Store(offset)
+	}
+	return nil
+}
+
+// Point the keymap at a record, unless it already holds a newer one for the
+// key, and count whichever record lost as dead. Going by version rather than
+// position keeps the index right however segments were merged. The key's leaf
+// in the Merkle tree swaps the old version for the new.
+// The caller must hold Keymap.FileLock.
+func (s *KVstore) index(key string, keyinfo *kmap.KeyInfo, tombstone bool) {
+	bucket := Bucket(key)
+	prev, ok := s.Keymap.Map[key]
+	if !ok {
+		prev, ok = s.Keymap.Tombstones[key]
+	}
+	if ok {
+		if !prev.Before(keyinfo) {
+			s.segments[keyinfo.Segment].dead += keyinfo.Size
+			return
+		}
+		s.segments[prev.Segment].dead += prev.Size
+		s.leaves[bucket] ^= prev.Digest
+	}
+	s.leaves[bucket] ^= keyinfo.Digest
+
+	if tombstone {
+		delete(s.Keymap.Map, key)
+		s.Keymap.Tombstones[key] = keyinfo
+	} else {
+		delete(s.Keymap.Tombstones, key)
+		s.Keymap.Map[key] = keyinfo
+	}
+}
+
+// Timestamps come from a hybrid logical clock: the wall clock in nanoseconds,
+// pushed past the newest timestamp the store has seen, local or replicated.
+// They are strictly increasing within a store, and a write always comes after
+// every version of the key it has seen.
+// The caller must hold s.mu.
+func (s *KVstore) nextTimestamp() int64 {
+	ts := time.Now().UnixNano()
+	if ts <= s.lastTimestamp {
+		ts = s.lastTimestamp + 1
+	}
+	s.lastTimestamp = ts
+	return ts
+}
+
+// Check a replicated write is newer than the version of the key in the store,
+// and move the clock up to it.
+// The caller must hold s.mu.
+func (s *KVstore) receive(key string, version *kmap.KeyInfo) error {
+	s.Keymap.FileLock.RLock()
+	prev, ok := s.Keymap.Map[key]
+	if !ok {
+		prev, ok = s.Keymap.Tombstones[key]
+	}
+	s.Keymap.FileLock.RUnlock()
+	if ok && !prev.Before(version) {
+		return ErrStaleRecord
+	}
+	if version.Timestamp > s.lastTimestamp {
+		s.lastTimestamp = version.Timestamp
+	}
+	return nil
 }
 
 // Set the passed Key / Value pairing
 func (s *KVstore) Set(record Record) error {
+	return s.set(record, nil)
+}
+
+func (s *KVstore) set(record Record, at *stamp) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	err := s.write(record, false, at)
+	seq := s.written
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.commit(seq)
+
+}
 
-	// Set the current offset to the value of the last offset in the store
-	currentoffset := s.nextoffset
+// Delete the key by appending a tombstone for it. Deleting a key that is not
+// in the store still records the tombstone, so the delete can be replicated.
+func (s *KVstore) Delete(key string) error {
+	return s.DeleteRecord(Record{Key: key})
+}
+
+// DeleteRecord deletes the record's key, keeping the origin and timestamp of
+// the delete
+func (s *KVstore) DeleteRecord(record Record) error {
+	return s.deleteRecord(record, nil)
+}
 
-	key, err := s.buf.WriteString(record.Key)
+func (s *KVstore) deleteRecord(record Record, at *stamp) error {
+	s.mu.Lock()
+	err := s.write(Record{Key: record.Key,
+		Origin:    record.Origin,
+		OriginSeq: record.OriginSeq,
+		Timestamp: record.Timestamp,
+		Clock:     record.Clock}, true, at)
+	seq := s.written
+	s.mu.Unlock()
 	if err != nil {
 		return err
 	}
 
-	// Increment the current offset by the number of bytes written to store the key
-	currentoffset += uint64(key)
+	return s.commit(seq)
+}
+
+// Append a set or a delete of the key, first working out the versions of
+// the key it leaves behind if the store keeps siblings.
+// The caller must hold s.mu.
+func (s *KVstore) write(record Record, tombstone bool, at *stamp) error {
+	if s.Config.Siblings {
+		var err error
+		if record, tombstone, err = s.reconcile(record, tombstone, at); err != nil {
+			return err
+		}
+	}
+	var flags uint8
+	if tombstone {
+		flags = flagTombstone
+	}
+	return s.append(record, flags, at)
+}
+
+// The node and time a new write is made at, when they are decided before the
+// store appends it. Writes through raft are stamped by the leader, so every
+// server applies them the same way. A nil stamp leaves them to the store.
+type stamp struct {
+	origin    string
+	originSeq uint64
+	timestamp int64
+}
 
-	// Write the values as bytes to the buffer
-	value, err := s.buf.Write(record.Value)
+// The node a new write is made on
+func (s *KVstore) writer(at *stamp) string {
+	if at != nil {
+		return at.origin
+	}
+	return s.Config.NodeID
+}
+
+// Append a record to the active segment and point the keymap at it. A
+// replicated record that is older than the key's version in the store is
+// rejected with ErrStaleRecord.
+// The caller must hold s.mu.
+func (s *KVstore) append(record Record, flags uint8, at *stamp) error {
+
+	if record.Origin == "" {
+		record.Origin = s.Config.NodeID
+		record.OriginSeq = s.lastSeq + 1
+		if at != nil {
+			record.Origin, record.OriginSeq = at.origin, at.originSeq
+		}
+	}
+	timestamp := record.Timestamp
+	switch {
+	case timestamp == 0 && at != nil:
+		timestamp = at.timestamp
+		if timestamp > s.lastTimestamp {
+			s.lastTimestamp = timestamp
+		}
+	case timestamp == 0:
+		timestamp = s.nextTimestamp()
+	default:
+		if err := s.receive(record.Key, &kmap.KeyInfo{Timestamp: timestamp, Origin: record.Origin}); err != nil {
+			return err
+		}
+	}
+	data, err := encodeRecord(record, flags, timestamp, s.lastSeq+1)
 	if err != nil {
 		return err
 	}
+	s.lastSeq++
 
-	// Increment the current offset by the number of bytes written to store the value
-	currentoffset += uint64(value)
+	// Roll over to a new segment if the record would overflow the active one
+	if s.active.size > 0 && s.active.size+uint64(len(data)) > s.Config.Segment.MaxBytes {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
 
-	// If we have successful writes to the buffer for key and value, update the store values
-	s.nextoffset = currentoffset
+	// Set the current offset to the value of the last offset in the segment
+	currentoffset := s.active.size
 
-	// Get the number of bytes for the value
-	valueLen := uint64(len(record.Value))
+	// Write the framed record to the buffer
+	n, err := s.buf.Write(data)
+	if err != nil {
+		return err
+	}
 
-	// Update the key in the keymap, and save the map
-	keyinfo := kmap.KeyInfo{Size: valueLen,
-		Offset: uint64(s.nextoffset) - valueLen}
+	// If we have a successful write to the buffer, update the segment size
+	s.active.size = currentoffset + uint64(n)
+	s.written++
+
+	// Update the key in the keymap
+	keyinfo := kmap.KeyInfo{Size: uint64(n),
+		Segment:   s.active.id,
+		Offset:    currentoffset,
+		Timestamp: timestamp,
+		ExpireAt:  expireAt(record.ExpireAt),
+		Seq:       s.lastSeq,
+		Origin:    record.Origin,
+		Digest:    s.digest(record.Key, flags&flagTombstone != 0, timestamp, record.Origin, record.Clock)}
 	s.Keymap.FileLock.Lock()
 	defer s.Keymap.FileLock.Unlock()
-	s.Keymap.Map[record.Key] = &keyinfo
-	s.Keymap.SaveMap()
+	s.index(record.Key, &keyinfo, flags&flagTombstone != 0)
+
+	// Wake up anyone tailing the log
+	close(s.appended)
+	s.appended = make(chan struct{})
+
+	// Journal the update, and fold the journal into a checkpoint once it
+	// grows long enough
+	err = s.journal.Append(kmap.Hint{Key: record.Key,
+		Tombstone: flags&flagTombstone != 0,
+		KeyInfo:   keyinfo})
+	if err != nil {
+		return err
+	}
+	if s.checkpointDue() {
+		return s.checkpoint()
+	}
 
 	return nil
 
 }
 
-// Get the value for the specified key from the store
-// Offset is the offset in the store to read
-// N is the number of bytes to read
+// Close the active segment and start appending to a new one. Closed segments
+// are reopened read only, as they are never written to again.
+// The caller must hold s.mu.
+func (s *KVstore) roll() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.active.file.Sync(); err != nil {
+		return err
+	}
+	s.markSynced(s.written)
+
+	closed, err := openSegment(s.dir, s.name, s.active.id, false)
+	if err != nil {
+		return err
+	}
+	closed.dead = s.active.dead
+	active, err := openSegment(s.dir, s.name, closed.id+1, true)
+	if err != nil {
+		closed.file.Close()
+		return err
+	}
+
+	// Readers may be part way through reading the old file
+	s.segMu.Lock()
+	s.active.file.Close()
+	s.segments[closed.id] = closed
+	s.segments[active.id] = active
+	s.segMu.Unlock()
+	s.active = active
+	s.buf = bufio.NewWriter(active.file)
+
+	// The journal covers everything in the closed segment
+	if err := s.journal.Flush(); err != nil {
+		return err
+	}
+
+	s.Keymap.FileLock.RLock()
+	s.writeHint(closed)
+	s.Keymap.FileLock.RUnlock()
+
+	return nil
+}
+
+// Flush the write buffer to the active segment.
+// The caller must hold s.mu.
+func (s *KVstore) flush() error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	s.active.flushed.Store(s.active.size)
+	return nil
+}
+
+// Get the value for the specified key from the store. Reads do not take the
+// write lock: the record is read in place from its segment, and the write
+// buffer is only flushed when the record has not reached the file yet.
 func (s *KVstore) Get(key string) ([]byte, error) {
-	// Lock the file for safe access
+	record, err := s.GetRecord(key)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// GetRecord gets the whole record for the key, including its expiry
+func (s *KVstore) GetRecord(key string) (Record, error) {
+	record, err := s.readFlushed(func() (LogRecord, error) { return s.read(key, false) })
+	return record.Record, err
+}
+
+// GetVersion gets the latest record for the key whether it is live or not,
+// for replicas to compare their versions of it. A deleted or expired key
+// comes back marked Deleted. ErrKeyNotFound means the store holds nothing at
+// all for the key.
+func (s *KVstore) GetVersion(key string) (LogRecord, error) {
+	return s.readFlushed(func() (LogRecord, error) { return s.read(key, true) })
+}
+
+// Read a record, flushing the write buffer first if the record is still in it
+func (s *KVstore) readFlushed(read func() (LogRecord, error)) (LogRecord, error) {
+	for {
+		record, err := read()
+		if err != errBuffered {
+			return record, err
+		}
+
+		s.mu.Lock()
+		err = s.flush()
+		s.mu.Unlock()
+		if err != nil {
+			return LogRecord{}, err
+		}
+	}
+}
+
+// Returned by read when the record is still in the write buffer
+var errBuffered = errors.New("record is buffered")
+
+// Read the key's record, or its tombstone or expired record too if deleted
+// is set
+func (s *KVstore) read(key string, deleted bool) (LogRecord, error) {
+	// Hold the keymap until the read is done, so a merge cannot move the
+	// record in between
+	s.Keymap.FileLock.RLock()
+	defer s.Keymap.FileLock.RUnlock()
+	s.segMu.RLock()
+	defer s.segMu.RUnlock()
+
+	keyInfo, ok := s.Keymap.Map[key]
+	live := ok && !keyInfo.Expired(time.Now().UnixNano())
+	if !live && !ok && deleted {
+		keyInfo, ok = s.Keymap.Tombstones[key]
+	}
+	if !ok || (!live && !deleted) {
+		return LogRecord{}, ErrKeyNotFound
+	}
+	record, err := s.readAt(key, keyInfo)
+	record.Deleted = !live
+	return record, err
+
+}
+
+// Read the record the keymap entry for the key points at, checking it is the
+// one. The caller must hold Keymap.FileLock and segMu.
+func (s *KVstore) readAt(key string, keyInfo *kmap.KeyInfo) (LogRecord, error) {
+	seg := s.segments[keyInfo.Segment]
+	if keyInfo.Offset+keyInfo.Size > seg.flushed.Load() {
+		return LogRecord{}, errBuffered
+	}
+
+	// Read and verify the record at the given offset
+	record, h, err := readRecord(seg.file, keyInfo.Offset, seg.flushed.Load())
+	if err != nil {
+		return LogRecord{}, err
+	}
+
+	// Validate the record is the one the keymap points at
+	if h.size() != keyInfo.Size || record.Key != key {
+		return LogRecord{}, fmt.Errorf("%w: keymap entry for %q does not match record", ErrCorruptRecord, key)
+	}
+
+	return LogRecord{Record: record, Offset: h.seq, Deleted: h.flags&flagTombstone != 0}, nil
+}
+
+// Evict drops the key from the store without a tombstone, once it has been
+// handed off to the nodes that own it now. Nothing is written to the log, so
+// nothing is replicated and the owners keep the key. Only the version with the
+// given timestamp and origin is dropped, and Evict reports whether it was; a
+// newer version written since stays. The eviction is journaled, so the key
+// stays gone after a restart.
+func (s *KVstore) Evict(key string, timestamp int64, origin string) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.Keymap.FileLock.Lock()
+	defer s.Keymap.FileLock.Unlock()
 
-	// Flush any pending writes to disk
-	s.buf.Flush()
+	keyinfo, ok := s.evict(key, &kmap.KeyInfo{Timestamp: timestamp, Origin: origin})
+	if !ok {
+		return false, nil
+	}
 
+	// The eviction has nothing in the segments to recover it from, so it is
+	// written out as soon as it is journaled
+	err := s.journal.Append(kmap.Hint{Key: key, Evicted: true, KeyInfo: *keyinfo})
+	if err == nil {
+		err = s.flushJournal()
+	}
+	if err != nil {
+		return true, fmt.Errorf("error journaling eviction: %w", err)
+	}
+	if s.checkpointDue() {
+		return true, s.checkpoint()
+	}
+	return true, nil
+}
 
+// Write the journal out, durably if writes are synced as they are made. The
+// records it points at go first, so it never points past the end of a
+// segment on disk.
+// The caller must hold s.mu.
+func (s *KVstore) flushJournal() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if s.Config.Sync.Mode != SyncAlways {
+		return s.journal.Flush()
+	}
+	if err := s.active.file.Sync(); err != nil {
+		return err
+	}
+	s.markSynced(s.written)
+	return s.journal.Sync()
+}
+
+// Drop the key from the keymap if it is at the given version, returning the
+// entry dropped.
+// The caller must hold Keymap.FileLock.
+func (s *KVstore) evict(key string, version *kmap.KeyInfo) (*kmap.KeyInfo, bool) {
+	keymap := s.Keymap.Map
+	keyinfo, ok := keymap[key]
+	if !ok {
+		keymap = s.Keymap.Tombstones
+		keyinfo, ok = keymap[key]
+	}
+	if !ok || keyinfo.Timestamp != version.Timestamp || keyinfo.Origin != version.Origin {
+		return nil, false
+	}
+	delete(keymap, key)
+	s.segments[keyinfo.Segment].dead += keyinfo.Size
+	s.leaves[Bucket(key)] ^= keyinfo.Digest
+	return keyinfo, true
+}
+
+// KeyCount returns the number of keys in the store, live or deleted
+func (s *KVstore) KeyCount() int {
 	s.Keymap.FileLock.RLock()
 	defer s.Keymap.FileLock.RUnlock()
-	s.Keymap.LoadMap()
+	return len(s.Keymap.Map) + len(s.Keymap.Tombstones)
+}
 
-	keyInfo := s.Keymap.Map[key]
-	value := make([]byte, keyInfo.Size)
-	
-	// Read the file at the given offset for the specified number of bytes
-	val, err := s.file.ReadAt(value, int64(keyInfo.Offset))
-	if err != nil {
-		return nil, err
+// Keys returns the live keys in the store
+func (s *KVstore) Keys() []string {
+	s.Keymap.FileLock.RLock()
+	defer s.Keymap.FileLock.RUnlock()
+
+	now := time.Now().UnixNano()
+	keys := make([]string, 0, len(s.Keymap.Map))
+	for k, keyinfo := range s.Keymap.Map {
+		if !keyinfo.Expired(now) {
+			keys = append(keys, k)
+		}
 	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Tombstones returns the keys that have been deleted from the store
+func (s *KVstore) Tombstones() []string {
+	s.Keymap.FileLock.RLock()
+	defer s.Keymap.FileLock.RUnlock()
+
+	keys := make([]string, 0, len(s.Keymap.Tombstones))
+	for k := range s.Keymap.Tombstones {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Close flushes any buffered writes and closes the store, leaving the data
+// on disk so it can be recovered by the next NewKVstore
+func (s *KVstore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Validate size of bytes read aligns with expectation
-	if val != int(keyInfo.Size) {
-		return nil, fmt.Errorf("error retrieving record due to incorrect byte size")
+	select {
+	case <-s.closed:
+		return nil
+	default:
 	}
+	close(s.closed)
 
-	return value, nil
+	s.Keymap.FileLock.RLock()
+	err := s.checkpoint()
+	s.Keymap.FileLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := s.active.file.Sync(); err != nil {
+		return err
+	}
+	s.markSynced(s.written)
+	if err := s.journal.Close(); err != nil {
+		return err
+	}
+	s.segMu.Lock()
+	defer s.segMu.Unlock()
+	return s.closeSegments()
+}
 
+func (s *KVstore) closeSegments() error {
+	for _, seg := range s.segments {
+		if err := seg.file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *KVstore) Remove(dir string) error {
-	
+
 	return os.RemoveAll(dir)
 }
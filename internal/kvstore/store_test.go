@@ -0,0 +1,1350 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kmap "github.com/jscottransom/distributed_godis/internal/keymap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVstore(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"Reopened store recovers keys":          testReopen,
+		"Torn final record is truncated away":   testTornRecord,
+		"Corrupt record fails its checksum":     testCorruptRecord,
+		"Deleted key stays deleted":             testDelete,
+		"Expired keys are hidden then swept":    testExpire,
+		"Version 1 records are still read":      testRecordV1,
+		"Merge reclaims dead records":           testMerge,
+		"Merge collects old tombstones":         testMergeTombstones,
+		"Writes carry on during a merge":        testMergeConcurrent,
+		"Segments roll over at max size":        testSegments,
+		"Closed segments load from hints":       testHints,
+		"Keymap recovers from its journal":      testJournal,
+		"Writes are synced per durability mode": testSyncModes,
+		"Concurrent writes share one fsync":     testGroupCommit,
+		"Reads run alongside writes":            testConcurrentReads,
+		"Log is read back in order":             testLog,
+		"Records keep their origin":             testOrigin,
+		"Concurrent writes converge":            testConverge,
+		"Concurrent writes become siblings":     testSiblings,
+		"Merkle trees find differing ranges":    testMerkleTree,
+		"Handed off keys are evicted":           testEvict,
+		"Evictions survive a restart":           testEvictRestart,
+		"Versions include deleted keys":         testGetVersion,
+		"Snapshots load into an empty store":    testSnapshot,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "store-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			fn(t, dir)
+		})
+	}
+}
+
+func testReopen(t *testing.T, dir string) {
+	s, err := NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Set(Record{Key: "hello", Value: []byte("world")}))
+	require.NoError(t, s.Set(Record{Key: "strange", Value: []byte("fruits")}))
+	require.NoError(t, s.Set(Record{Key: "hello", Value: []byte("again")}))
+	require.NoError(t, s.Close())
+
+	s, err = NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.Equal(t, 2, len(s.Keymap.Map))
+	value, err := s.Get("hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("again"), value)
+	value, err = s.Get("strange")
+	require.NoError(t, err)
+	require.Equal(t, []byte("fruits"), value)
+
+	// New writes land after the recovered records
+	require.NoError(t, s.Set(Record{Key: "new", Value: []byte("key")}))
+	value, err = s.Get("new")
+	require.NoError(t, err)
+	require.Equal(t, []byte("key"), value)
+}
+
+func testTornRecord(t *testing.T, dir string) {
+	s, err := NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	require.NoError(t, s.Set(Record{Key: "hello", Value: []byte("world")}))
+	require.NoError(t, s.Set(Record{Key: "strange", Value: []byte("fruits")}))
+	require.NoError(t, s.Close())
+
+	// Chop the tail off the last record, as a crash mid-write would
+	path := segmentPath(dir, STORE_TEMPLATE, 0)
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, stat.Size()-3))
+
+	s, err = NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, ok := s.Keymap.Map["strange"]
+	require.False(t, ok)
+	value, err := s.Get("hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), value)
+
+	require.NoError(t, s.Set(Record{Key: "strange", Value: []byte("fruits")}))
+	value, err = s.Get("strange")
+	require.NoError(t, err)
+	require.Equal(t, []byte("fruits"), value)
+}
+
+func testCorruptRecord(t *testing.T, dir string) {
+	s, err := NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	require.NoError(t, s.Set(Record{Key: "hello", Value: []byte("world")}))
+	require.NoError(t, s.Set(Record{Key: "strange", Value: []byte("fruits")}))
+
+	// Flip a byte in the value of the first record
+	_, err = s.Get("hello")
+	require.NoError(t, err)
+	f, err := os.OpenFile(segmentPath(dir, STORE_TEMPLATE, 0), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("W"), int64(s.Keymap.Map["hello"].Offset+headerWidth+5))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = s.Get("hello")
+	require.True(t, errors.Is(err, ErrCorruptRecord))
+	value, err := s.Get("strange")
+	require.NoError(t, err)
+	require.Equal(t, []byte("fruits"), value)
+
+	// A length running past the end of the segment is caught before
+	// anything is allocated for it
+	f, err = os.OpenFile(segmentPath(dir, STORE_TEMPLATE, 0), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	length := make([]byte, valueLenWidth)
+	at := int64(s.Keymap.Map["strange"].Offset + valueLenPos)
+	_, err = f.ReadAt(length, at)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, at)
+	require.NoError(t, err)
+	_, err = s.Get("strange")
+	require.ErrorIs(t, err, ErrCorruptRecord)
+	_, err = f.WriteAt(length, at)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, s.Close())
+
+	// Startup does not read values the checkpoint covers
+	s, err = NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	_, err = s.Get("hello")
+	require.True(t, errors.Is(err, ErrCorruptRecord))
+	require.NoError(t, s.Close())
+
+	// When the segment has to be walked, corruption ahead of good records
+	// is not mistaken for a torn write
+	require.NoError(t, os.Remove(dir+"/"+STORE_TEMPLATE+checkpointSuffix))
+	_, err = NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.True(t, errors.Is(err, ErrCorruptRecord))
+}
+
+func testDelete(t *testing.T, dir string) {
+	s, err := NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	require.NoError(t, s.Set(Record{Key: "hello", Value: []byte("world")}))
+	require.NoError(t, s.Set(Record{Key: "strange", Value: []byte("fruits")}))
+	require.NoError(t, s.Delete("hello"))
+
+	_, err = s.Get("hello")
+	require.True(t, errors.Is(err, ErrKeyNotFound))
+	require.Equal(t, []string{"strange"}, s.Keys())
+	require.Equal(t, []string{"hello"}, s.Tombstones())
+	require.NoError(t, s.Close())
+
+	s, err = NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Get("hello")
+	require.True(t, errors.Is(err, ErrKeyNotFound))
+	require.Equal(t, []string{"strange"}, s.Keys())
+	require.Equal(t, []string{"hello"}, s.Tombstones())
+
+	// Setting the key again brings it back
+	require.NoError(t, s.Set(Record{Key: "hello", Value: []byte("again")}))
+	value, err := s.Get("hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("again"), value)
+	require.Empty(t, s.Tombstones())
+}
+
+func testMerge(t *testing.T, dir string) {
+	c := Config{}
+	c.Merge.MinDeadBytes = 1
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.Set(Record{Key: "hello", Value: []byte("world")}))
+	}
+	require.NoError(t, s.Set(Record{Key: "strange", Value: []byte("fruits")}))
+	require.NoError(t, s.Set(Record{Key: "gone", Value: []byte("soon")}))
+	require.NoError(t, s.Delete("gone"))
+
+	dead, total := s.DeadBytes()
+	require.NotZero(t, dead)
+
+	reclaimed, err := s.MaybeMerge()
+	require.NoError(t, err)
+	require.Equal(t, dead, reclaimed)
+
+	dead, merged := s.DeadBytes()
+	require.Zero(t, dead)
+	require.Equal(t, total-reclaimed, merged)
+	stat, err := os.Stat(segmentPath(dir, STORE_TEMPLATE, 0))
+	require.NoError(t, err)
+	require.Equal(t, int64(merged), stat.Size())
+
+	// Nothing left to reclaim
+	reclaimed, err = s.MaybeMerge()
+	require.NoError(t, err)
+	require.Zero(t, reclaimed)
+
+	value, err := s.Get("hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), value)
+
+	// Writes after the merge land at the end of the merged file
+	require.NoError(t, s.Set(Record{Key: "strange", Value: []byte("fruit")}))
+	require.NoError(t, s.Close())
+
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.Equal(t, []string{"hello", "strange"}, s.Keys())
+	require.Equal(t, []string{"gone"}, s.Tombstones())
+	value, err = s.Get("strange")
+	require.NoError(t, err)
+	require.Equal(t, []byte("fruit"), value)
+}
+
+func testMergeTombstones(t *testing.T, dir string) {
+	c := Config{}
+	c.Merge.MinDeadBytes = 1
+	c.Tombstone.TTL = time.Hour
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+
+	old := time.Now().Add(-2 * time.Hour).UnixNano()
+	require.NoError(t, s.Set(Record{Key: "old", Value: []byte("value"), Origin: "peer", OriginSeq: 1, Timestamp: old}))
+	require.NoError(t, s.DeleteRecord(Record{Key: "old", Origin: "peer", OriginSeq: 2, Timestamp: old + 1}))
+	require.NoError(t, s.Set(Record{Key: "recent", Value: []byte("value")}))
+	require.NoError(t, s.Delete("recent"))
+	require.NoError(t, s.Set(Record{Key: "hello", Value: []byte("world")}))
+
+	_, err = s.Merge()
+	require.NoError(t, err)
+	require.Equal(t, []string{"recent"}, s.Tombstones())
+	tree, err := s.MerkleTree(nil)
+	require.NoError(t, err)
+	all, err := s.MerkleTree(func(key string) bool { return true })
+	require.NoError(t, err)
+	require.Equal(t, all, tree)
+	require.NoError(t, s.Close())
+
+	// The key stays gone after a restart
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, []string{"hello"}, s.Keys())
+	require.Equal(t, []string{"recent"}, s.Tombstones())
+	_, err = s.GetVersion("old")
+	require.True(t, errors.Is(err, ErrKeyNotFound))
+}
+
+func testMergeConcurrent(t *testing.T, dir string) {
+	c := Config{}
+	c.Segment.MaxBytes = 1024
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("old")}))
+	}
+
+	// Keys overwritten, deleted or evicted while a merge copies their old
+	// records keep their latest version
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 5; i++ {
+			if _, err := s.Merge(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		switch i % 3 {
+		case 0:
+			require.NoError(t, s.Set(Record{Key: key, Value: []byte("new")}))
+		case 1:
+			require.NoError(t, s.Delete(key))
+		case 2:
+			record, err := s.GetRecord(key)
+			require.NoError(t, err)
+			_, err = s.Evict(key, record.Timestamp, record.Origin)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, <-done)
+
+	check := func(s *KVstore) {
+		for i := 0; i < 100; i++ {
+			value, err := s.Get(fmt.Sprintf("key%02d", i))
+			if i%3 == 0 {
+				require.NoError(t, err)
+				require.Equal(t, []byte("new"), value)
+			} else {
+				require.ErrorIs(t, err, ErrKeyNotFound)
+			}
+		}
+		require.Len(t, s.Tombstones(), 33)
+	}
+	check(s)
+	_, err = s.Merge()
+	require.NoError(t, err)
+	dead, _ := s.DeadBytes()
+	require.Zero(t, dead)
+	require.NoError(t, s.Close())
+
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	defer s.Close()
+	check(s)
+}
+
+func testSegments(t *testing.T, dir string) {
+	c := Config{}
+	c.Segment.MaxBytes = 3 * (headerWidth + 10)
+	c.Merge.MinDeadBytes = 1
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+
+	// Each record is headerWidth + 10 bytes, so three fit in a segment
+	for i := 0; i < 7; i++ {
+		require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("value")}))
+	}
+	ids, err := listSegments(dir, STORE_TEMPLATE)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1, 2}, ids)
+	require.Equal(t, uint32(2), s.Keymap.Map["key06"].Segment)
+
+	// Closed segments are read only
+	_, err = s.segments[0].file.Write([]byte("nope"))
+	require.Error(t, err)
+
+	// Overwrite everything in the first two segments, then merge them
+	for i := 0; i < 6; i++ {
+		require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("VALUE")}))
+	}
+	require.NoError(t, s.Delete("key06"))
+	_, err = s.Merge()
+	require.NoError(t, err)
+
+	ids, err = listSegments(dir, STORE_TEMPLATE)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1, 2, 5}, ids)
+	require.NoError(t, s.Close())
+
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 6; i++ {
+		value, err := s.Get(fmt.Sprintf("key%02d", i))
+		require.NoError(t, err)
+		require.Equal(t, []byte("VALUE"), value)
+	}
+	require.Equal(t, []string{"key06"}, s.Tombstones())
+}
+
+func testHints(t *testing.T, dir string) {
+	c := Config{}
+	c.Segment.MaxBytes = 3 * (headerWidth + 10)
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 7; i++ {
+		require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("value")}))
+	}
+	require.NoError(t, s.Delete("key01"))
+	require.NoError(t, s.Close())
+
+	// Only the closed segments have hints
+	for id, exists := range map[uint32]bool{0: true, 1: true, 2: false} {
+		_, err := os.Stat(hintPath(dir, STORE_TEMPLATE, id))
+		require.Equal(t, exists, err == nil)
+	}
+
+	// Damage a value in the first segment. Startup does not read values
+	// from segments with hints, so only reading the key notices.
+	f, err := os.OpenFile(segmentPath(dir, STORE_TEMPLATE, 0), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("V"), int64(headerWidth+5))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	require.Equal(t, []string{"key00", "key02", "key03", "key04", "key05", "key06"}, s.Keys())
+	require.Equal(t, []string{"key01"}, s.Tombstones())
+	_, err = s.Get("key00")
+	require.True(t, errors.Is(err, ErrCorruptRecord))
+	value, err := s.Get("key04")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	require.NoError(t, s.Close())
+
+	// A hint that does not match its segment is ignored, and rewritten
+	require.NoError(t, os.Truncate(segmentPath(dir, STORE_TEMPLATE, 1), headerWidth+10))
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	require.Equal(t, []string{"key00", "key02", "key03", "key06"}, s.Keys())
+	require.NoError(t, s.Close())
+
+	size, hints, err := kmap.ReadHint(hintPath(dir, STORE_TEMPLATE, 1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(headerWidth+10), size)
+	require.Equal(t, 1, len(hints))
+	require.Equal(t, "key03", hints[0].Key)
+}
+
+func testJournal(t *testing.T, dir string) {
+	c := Config{}
+	c.Checkpoint.Entries = 4
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+
+	// The journal is folded into a checkpoint once it is long enough
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("value")}))
+	}
+	require.Equal(t, uint64(1), s.journal.Entries())
+	_, hints, err := kmap.ReadCheckpoint(dir + "/" + STORE_TEMPLATE + checkpointSuffix)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(hints))
+
+	// One update reaches the journal file, the next only reaches the segment
+	require.NoError(t, s.Delete("key00"))
+	require.NoError(t, s.buf.Flush())
+	require.NoError(t, s.journal.Flush())
+	require.NoError(t, s.Set(Record{Key: "key05", Value: []byte("value")}))
+	require.NoError(t, s.buf.Flush())
+
+	// Damage a value the checkpoint covers, then reopen without closing,
+	// as if the node had crashed
+	f, err := os.OpenFile(segmentPath(dir, STORE_TEMPLATE, 0), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("V"), int64(s.Keymap.Map["key01"].Offset+headerWidth+5))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.Equal(t, []string{"key01", "key02", "key03", "key04", "key05"}, s.Keys())
+	require.Equal(t, []string{"key00"}, s.Tombstones())
+	_, err = s.Get("key01")
+	require.True(t, errors.Is(err, ErrCorruptRecord))
+	value, err := s.Get("key05")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	// Past the configured length, the journal grows as long as the keymap
+	// before it is folded in
+	for i := 6; i < 10; i++ {
+		require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("value")}))
+	}
+	for i := 1; i < 6; i++ {
+		require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("again")}))
+	}
+	require.Equal(t, uint64(9), s.journal.Entries())
+	require.NoError(t, s.Set(Record{Key: "key06", Value: []byte("again")}))
+	require.Equal(t, uint64(0), s.journal.Entries())
+}
+
+func testSyncModes(t *testing.T, dir string) {
+	// Size of the active segment on disk, without flushing the buffer
+	onDisk := func(s *KVstore) int64 {
+		info, err := os.Stat(segmentPath(dir, STORE_TEMPLATE, s.active.id))
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	c := Config{}
+	c.Sync.Mode = SyncNone
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	require.NoError(t, s.Set(Record{Key: "none", Value: []byte("value")}))
+	require.Equal(t, int64(0), onDisk(s))
+	require.NoError(t, s.Close())
+
+	// Acknowledged writes have reached the segment
+	c.Sync.Mode = SyncAlways
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	require.NoError(t, s.Set(Record{Key: "always", Value: []byte("value")}))
+	require.NoError(t, s.Delete("none"))
+	require.Equal(t, int64(s.active.size), onDisk(s))
+	require.Equal(t, s.written, s.synced.Load())
+	require.NoError(t, s.Close())
+
+	c.Sync.Mode = SyncInterval
+	c.Sync.Interval = 10 * time.Millisecond
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Set(Record{Key: "interval", Value: []byte("value")}))
+	require.Eventually(t, func() bool {
+		return s.synced.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+	s.mu.Lock()
+	require.Equal(t, int64(s.active.size), onDisk(s))
+	s.mu.Unlock()
+
+	c.Sync.Mode = "sometimes"
+	_, err = NewKVstore(t.TempDir(), STORE_TEMPLATE, c)
+	require.Error(t, err)
+}
+
+func testGroupCommit(t *testing.T, dir string) {
+	s, err := NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Hold back the fsync until every writer has appended its record, so
+	// they all queue up behind a single sync
+	writers := 16
+	s.syncMu.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("value")}))
+		}(i)
+	}
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.written == uint64(writers)
+	}, time.Second, time.Millisecond)
+	s.syncMu.Unlock()
+	wg.Wait()
+
+	require.Equal(t, uint64(1), s.syncs.Load())
+	require.Equal(t, uint64(writers), s.synced.Load())
+	require.Equal(t, writers, len(s.Keys()))
+}
+
+func testConcurrentReads(t *testing.T, dir string) {
+	c := Config{}
+	c.Sync.Mode = SyncNone
+	c.Segment.MaxBytes = 1024
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("value")}))
+	}
+
+	// Writers roll segments over and merge them away underneath the readers,
+	// which must always find the latest value, even if it is still buffered
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i%10), Value: []byte("value")}))
+			if i%100 == 0 {
+				_, err := s.Merge()
+				require.NoError(t, err)
+			}
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				value, err := s.Get(fmt.Sprintf("key%02d", (i+r)%10))
+				require.NoError(t, err)
+				require.Equal(t, []byte("value"), value)
+			}
+		}(r)
+	}
+
+	// A key written without a flush is read back straight away
+	require.NoError(t, s.Set(Record{Key: "fresh", Value: []byte("buffered")}))
+	value, err := s.Get("fresh")
+	require.NoError(t, err)
+	require.Equal(t, []byte("buffered"), value)
+
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	wg.Wait()
+}
+
+func benchmarkStore(b *testing.B, keys int) *KVstore {
+	dir := b.TempDir()
+	c := Config{}
+	c.Sync.Mode = SyncNone
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(b, err)
+	b.Cleanup(func() { s.Close() })
+
+	value := make([]byte, 256)
+	for i := 0; i < keys; i++ {
+		require.NoError(b, s.Set(Record{Key: fmt.Sprintf("key%06d", i), Value: value}))
+	}
+	return s
+}
+
+// Run with -cpu 1,2,4,8 to see reads scale across cores
+func BenchmarkGet(b *testing.B) {
+	keys := 10000
+	s := benchmarkStore(b, keys)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := s.Get(fmt.Sprintf("key%06d", i%keys)); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+// Reads with a writer appending in the background
+func BenchmarkGetWhileWriting(b *testing.B) {
+	keys := 10000
+	s := benchmarkStore(b, keys)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		value := make([]byte, 256)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := s.Set(Record{Key: fmt.Sprintf("new%06d", i), Value: value}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := s.Get(fmt.Sprintf("key%06d", i%keys)); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+}
+
+func testExpire(t *testing.T, dir string) {
+	s, err := NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+
+	expireAt := time.Now().Add(time.Hour).Round(0)
+	require.NoError(t, s.Set(Record{Key: "later", Value: []byte("value"), ExpireAt: expireAt}))
+	require.NoError(t, s.Set(Record{Key: "soon", Value: []byte("value"), ExpireAt: time.Now().Add(50 * time.Millisecond)}))
+	require.NoError(t, s.Set(Record{Key: "never", Value: []byte("value")}))
+	require.NoError(t, s.Close())
+
+	// The expiry survives a restart, whether the keymap comes from the
+	// checkpoint or from walking the segments
+	require.NoError(t, os.Remove(dir+"/"+STORE_TEMPLATE+checkpointSuffix))
+	s, err = NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	record, err := s.GetRecord("later")
+	require.NoError(t, err)
+	require.True(t, expireAt.Equal(record.ExpireAt))
+	ttl, err := s.TTL("never")
+	require.NoError(t, err)
+	require.Equal(t, NoExpiry, ttl)
+
+	require.NoError(t, s.Persist("later"))
+	ttl, err = s.TTL("later")
+	require.NoError(t, err)
+	require.Equal(t, NoExpiry, ttl)
+	require.NoError(t, s.Expire("never", expireAt))
+	ttl, err = s.TTL("never")
+	require.NoError(t, err)
+	require.True(t, ttl > 0 && ttl <= time.Hour)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = s.Get("soon")
+	require.Equal(t, ErrKeyNotFound, err)
+	_, err = s.TTL("soon")
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, ErrKeyNotFound, s.Expire("soon", expireAt))
+	require.Equal(t, []string{"later", "never"}, s.Keys())
+
+	// Only keys that are still expired are swept
+	swept, err := s.SweepExpired()
+	require.NoError(t, err)
+	require.Equal(t, 1, swept)
+	require.Equal(t, []string{"soon"}, s.Tombstones())
+	swept, err = s.SweepExpired()
+	require.NoError(t, err)
+	require.Equal(t, 0, swept)
+
+	// The sweep's tombstone is as old as the expiry, so it loses to a write
+	// made after the key expired that only arrives after the sweep
+	require.NoError(t, s.Set(Record{Key: "reset", Value: []byte("old"), ExpireAt: time.Now().Add(10 * time.Millisecond)}))
+	time.Sleep(20 * time.Millisecond)
+	written := time.Now().UnixNano()
+	swept, err = s.SweepExpired()
+	require.NoError(t, err)
+	require.Equal(t, 1, swept)
+	require.NoError(t, s.Set(Record{Key: "reset", Value: []byte("new"), Origin: "other", OriginSeq: 1, Timestamp: written}))
+	value, err := s.Get("reset")
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), value)
+}
+
+func testRecordV1(t *testing.T, dir string) {
+	// A record written before records carried an expiry
+	b := make([]byte, headerV1Width+len("old")+len("value"))
+	enc.PutUint16(b[magicPos:], recordMagic)
+	b[versionPos] = 1
+	enc.PutUint64(b[timestampPos:], 1)
+	enc.PutUint32(b[keyLenPos:], uint32(len("old")))
+	enc.PutUint32(b[valueLenPos:], uint32(len("value")))
+	copy(b[headerV1Width:], "old")
+	copy(b[headerV1Width+len("old"):], "value")
+	enc.PutUint32(b[crcPos:], crc32.Checksum(b[magicPos:], crcTable))
+	require.NoError(t, os.WriteFile(segmentPath(dir, STORE_TEMPLATE, 0), b, 0644))
+
+	s, err := NewKVstore(dir, STORE_TEMPLATE, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	record, err := s.GetRecord("old")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), record.Value)
+	require.True(t, record.ExpireAt.IsZero())
+
+	// New records are appended after it in the current version
+	require.NoError(t, s.Set(Record{Key: "new", Value: []byte("value")}))
+	require.Equal(t, uint64(len(b)), s.Keymap.Map["new"].Offset)
+	value, err := s.Get("new")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+}
+
+func testLog(t *testing.T, dir string) {
+	c := Config{}
+	c.Segment.MaxBytes = 3 * (headerWidth + 10)
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, s.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("value")}))
+	}
+	require.NoError(t, s.Delete("key01"))
+
+	// Records come back in order across segments, with tombstones
+	records, err := s.NewLogReader(0).Read(10)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(records))
+	for i, record := range records {
+		require.Equal(t, uint64(i+1), record.Offset)
+	}
+	require.Equal(t, "key01", records[4].Key)
+	require.True(t, records[4].Deleted)
+
+	// A reader picks up from its offset, and waits at the end of the log
+	reader := s.NewLogReader(3)
+	records, err = reader.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4}, []uint64{records[0].Offset, records[1].Offset})
+	records, err = reader.Read(10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	records, err = reader.Read(10)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	appended := s.Appended()
+	require.NoError(t, s.Set(Record{Key: "key00", Value: []byte("again")}))
+	<-appended
+	records, err = reader.Read(10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	require.Equal(t, uint64(6), records[0].Offset)
+	require.Equal(t, []byte("again"), records[0].Value)
+	require.Equal(t, uint64(7), reader.Offset())
+
+	// After a merge, overwritten records are gone but offsets are kept
+	_, err = s.Merge()
+	require.NoError(t, err)
+	records, err = s.NewLogReader(0).Read(10)
+	require.NoError(t, err)
+	var offsets []uint64
+	for _, record := range records {
+		offsets = append(offsets, record.Offset)
+	}
+	require.Equal(t, []uint64{3, 4, 5, 6}, offsets)
+
+	// Offsets carry on where they left off after a restart
+	require.NoError(t, s.Close())
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Set(Record{Key: "key04", Value: []byte("value")}))
+	records, err = s.NewLogReader(7).Read(10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+	require.Equal(t, uint64(7), records[0].Offset)
+}
+
+func testOrigin(t *testing.T, dir string) {
+	c := Config{NodeID: "a"}
+	s, err := NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+
+	// Local writes are stamped with the node, replicated ones keep theirs
+	require.NoError(t, s.Set(Record{Key: "local", Value: []byte("value")}))
+	require.NoError(t, s.Set(Record{Key: "remote", Value: []byte("value"), Origin: "b", OriginSeq: 7}))
+	require.NoError(t, s.DeleteRecord(Record{Key: "gone", Origin: "c", OriginSeq: 3}))
+	require.NoError(t, s.Expire("remote", time.Now().Add(time.Hour)))
+
+	// An origin longer than the header can give the length of is refused,
+	// and nothing is written
+	long := strings.Repeat("o", math.MaxUint16+1)
+	err = s.Set(Record{Key: "long", Value: []byte("value"), Origin: long, OriginSeq: 1})
+	require.True(t, errors.Is(err, ErrRecordTooLarge))
+	require.NoError(t, s.Close())
+
+	s, err = NewKVstore(dir, STORE_TEMPLATE, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	records, err := s.NewLogReader(0).Read(10)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(records))
+	require.Equal(t, "local", records[0].Key)
+	require.Equal(t, "a", records[0].Origin)
+	require.Equal(t, uint64(1), records[0].OriginSeq)
+	require.Equal(t, "remote", records[1].Key)
+	require.Equal(t, "b", records[1].Origin)
+	require.Equal(t, uint64(7), records[1].OriginSeq)
+	require.Equal(t, "gone", records[2].Key)
+	require.True(t, records[2].Deleted)
+	require.Equal(t, "c", records[2].Origin)
+	require.Equal(t, uint64(3), records[2].OriginSeq)
+
+	// A new expiry is a write of its own on this node
+	require.Equal(t, "remote", records[3].Key)
+	require.Equal(t, "a", records[3].Origin)
+	require.Equal(t, records[3].Offset, records[3].OriginSeq)
+	require.Equal(t, []byte("value"), records[3].Value)
+}
+
+func testConverge(t *testing.T, dir string) {
+	for _, node := range []string{"a", "b"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, node), 0755))
+	}
+	a, err := NewKVstore(filepath.Join(dir, "a"), STORE_TEMPLATE, Config{NodeID: "a"})
+	require.NoError(t, err)
+	defer func() { a.Close() }()
+	b, err := NewKVstore(filepath.Join(dir, "b"), STORE_TEMPLATE, Config{NodeID: "b"})
+	require.NoError(t, err)
+	defer b.Close()
+
+	// The same key written on both nodes, then swapped in either order
+	require.NoError(t, a.Set(Record{Key: "key", Value: []byte("a")}))
+	require.NoError(t, b.Set(Record{Key: "key", Value: []byte("b")}))
+	fromA, err := a.GetRecord("key")
+	require.NoError(t, err)
+	fromB, err := b.GetRecord("key")
+	require.NoError(t, err)
+	require.True(t, fromA.Timestamp < fromB.Timestamp)
+
+	require.ErrorIs(t, b.Set(fromA), ErrStaleRecord)
+	require.NoError(t, a.Set(fromB))
+	for _, s := range []*KVstore{a, b} {
+		value, err := s.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("b"), value)
+	}
+
+	// A write after a replicated one is stamped after it, whatever the clock
+	ahead := Record{Key: "clock", Value: []byte("b"), Origin: "b", OriginSeq: 9,
+		Timestamp: time.Now().Add(time.Hour).UnixNano()}
+	require.NoError(t, a.Set(ahead))
+	require.NoError(t, a.Set(Record{Key: "clock", Value: []byte("a")}))
+	record, err := a.GetRecord("clock")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), record.Value)
+	require.True(t, record.Timestamp > ahead.Timestamp)
+
+	// Ties go to the higher origin, on every node and after a restart
+	tie := time.Now().Add(2 * time.Hour).UnixNano()
+	require.NoError(t, a.Set(Record{Key: "tie", Value: []byte("c"), Origin: "c", OriginSeq: 1, Timestamp: tie}))
+	require.NoError(t, a.DeleteRecord(Record{Key: "tie", Origin: "d", OriginSeq: 1, Timestamp: tie}))
+	require.ErrorIs(t, a.Set(Record{Key: "tie", Value: []byte("c"), Origin: "c", OriginSeq: 1, Timestamp: tie}), ErrStaleRecord)
+	_, err = a.Get("tie")
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, a.Close())
+	a, err = NewKVstore(filepath.Join(dir, "a"), STORE_TEMPLATE, Config{NodeID: "a"})
+	require.NoError(t, err)
+	_, err = a.Get("tie")
+	require.Equal(t, ErrKeyNotFound, err)
+}
+
+func testSiblings(t *testing.T, dir string) {
+	var stores []*KVstore
+	for _, node := range []string{"a", "b"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, node), 0755))
+		s, err := NewKVstore(filepath.Join(dir, node), STORE_TEMPLATE, Config{NodeID: node, Siblings: true})
+		require.NoError(t, err)
+		defer s.Close()
+		stores = append(stores, s)
+	}
+	a, b := stores[0], stores[1]
+
+	// Copy the latest record for the key from one store to the other, as
+	// the replicator does
+	replicate := func(from, to *KVstore, key string) error {
+		records, err := from.NewLogReader(0).Read(100)
+		require.NoError(t, err)
+		for i := len(records) - 1; i >= 0; i-- {
+			if record := records[i]; record.Key == key {
+				if record.Deleted {
+					return to.DeleteRecord(record.Record)
+				}
+				return to.Set(record.Record)
+			}
+		}
+		return nil
+	}
+
+	// Writes made on both nodes without seeing each other are both kept,
+	// the same way on each
+	require.NoError(t, a.Set(Record{Key: "cart", Value: []byte("apples")}))
+	require.NoError(t, b.Set(Record{Key: "cart", Value: []byte("pears")}))
+	require.NoError(t, replicate(a, b, "cart"))
+	require.NoError(t, replicate(b, a, "cart"))
+	var contexts []VectorClock
+	for _, s := range stores {
+		record, err := s.GetRecord("cart")
+		require.NoError(t, err)
+		require.Equal(t, 2, len(record.Siblings))
+		require.Equal(t, []byte("apples"), record.Siblings[0].Value)
+		require.Equal(t, []byte("pears"), record.Siblings[1].Value)
+		require.Equal(t, VectorClock{"a": 1, "b": 1}, record.Clock)
+		contexts = append(contexts, record.Clock)
+	}
+
+	// Replaying what was already merged changes nothing
+	require.ErrorIs(t, replicate(a, b, "cart"), ErrStaleRecord)
+
+	// A write with the context resolves the siblings on every node
+	require.NoError(t, a.Set(Record{Key: "cart", Value: []byte("apples,pears"), Clock: contexts[0]}))
+	require.NoError(t, replicate(a, b, "cart"))
+	for _, s := range stores {
+		record, err := s.GetRecord("cart")
+		require.NoError(t, err)
+		require.Equal(t, []Sibling{{Value: []byte("apples,pears"), Clock: VectorClock{"a": 2, "b": 1}}}, record.Siblings)
+		require.Equal(t, []byte("apples,pears"), record.Value)
+	}
+
+	// A write without a context sits alongside what is there
+	require.NoError(t, b.Set(Record{Key: "cart", Value: []byte("plums")}))
+	record, err := b.GetRecord("cart")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(record.Siblings))
+
+	// Deleting with the context removes every version it has seen, and
+	// survives a restart
+	require.NoError(t, b.DeleteRecord(Record{Key: "cart", Clock: record.Clock}))
+	_, err = b.Get("cart")
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, replicate(b, a, "cart"))
+	_, err = a.Get("cart")
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, b.Close())
+	b, err = NewKVstore(filepath.Join(dir, "b"), STORE_TEMPLATE, Config{NodeID: "b", Siblings: true})
+	require.NoError(t, err)
+	defer b.Close()
+	_, err = b.Get("cart")
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// The old versions arriving late do not bring the key back
+	require.ErrorIs(t, b.Set(Record{Key: "cart", Value: []byte("apples"), Origin: "a", OriginSeq: 1,
+		Timestamp: 1, Clock: VectorClock{"a": 1}}), ErrStaleRecord)
+}
+
+func testMerkleTree(t *testing.T, dir string) {
+	var stores []*KVstore
+	for _, node := range []string{"a", "b"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, node), 0755))
+		s, err := NewKVstore(filepath.Join(dir, node), STORE_TEMPLATE, Config{NodeID: node})
+		require.NoError(t, err)
+		defer s.Close()
+		stores = append(stores, s)
+	}
+	a, b := stores[0], stores[1]
+
+	// Replicas holding the same versions have the same tree
+	for i := 0; i < 20; i++ {
+		require.NoError(t, a.Set(Record{Key: fmt.Sprintf("key%02d", i), Value: []byte("value")}))
+	}
+	require.NoError(t, a.Delete("key03"))
+	records, err := a.NewLogReader(0).Read(100)
+	require.NoError(t, err)
+	for _, record := range records {
+		if record.Deleted {
+			require.NoError(t, b.DeleteRecord(record.Record))
+		} else {
+			require.NoError(t, b.Set(record.Record))
+		}
+	}
+	treeA, err := a.MerkleTree(nil)
+	require.NoError(t, err)
+	treeB, err := b.MerkleTree(nil)
+	require.NoError(t, err)
+	require.Equal(t, treeA, treeB)
+	require.Empty(t, treeA.Diff(treeB))
+
+	// A key written on one side shows up as its range, which holds it
+	require.NoError(t, a.Set(Record{Key: "key07", Value: []byte("newer")}))
+	treeA, err = a.MerkleTree(nil)
+	require.NoError(t, err)
+	buckets := treeA.Diff(treeB)
+	require.Equal(t, []uint32{Bucket("key07")}, buckets)
+	ranged, err := a.RangeRecords(buckets, nil)
+	require.NoError(t, err)
+	var found bool
+	for _, record := range ranged {
+		require.Equal(t, Bucket("key07"), Bucket(record.Key))
+		if record.Key == "key07" {
+			require.Equal(t, []byte("newer"), record.Value)
+			found = true
+		}
+	}
+	require.True(t, found)
+
+	// Every range at once holds every key once
+	var every []uint32
+	for bucket := uint32(0); bucket < merkleLeaves; bucket++ {
+		every = append(every, bucket)
+	}
+	ranged, err = a.RangeRecords(every, nil)
+	require.NoError(t, err)
+	require.Equal(t, a.KeyCount(), len(ranged))
+
+	// Deleted keys are compared too
+	require.NoError(t, b.Delete("key11"))
+	treeB, err = b.MerkleTree(nil)
+	require.NoError(t, err)
+	require.Contains(t, treeA.Diff(treeB), Bucket("key11"))
+
+	// Keys left out are not compared, nor sent
+	keep := func(key string) bool { return key != "key07" && key != "key11" }
+	treeA, err = a.MerkleTree(keep)
+	require.NoError(t, err)
+	treeB, err = b.MerkleTree(keep)
+	require.NoError(t, err)
+	require.Empty(t, treeA.Diff(treeB))
+	ranged, err = a.RangeRecords([]uint32{Bucket("key07")}, keep)
+	require.NoError(t, err)
+	for _, record := range ranged {
+		require.NotEqual(t, "key07", record.Key)
+	}
+
+	// The tree kept up to date through evictions, merges and restarts is
+	// the one walking every key builds
+	all := func(key string) bool { return true }
+	version, err := a.GetVersion("key05")
+	require.NoError(t, err)
+	evicted, err := a.Evict("key05", version.Timestamp, version.Origin)
+	require.NoError(t, err)
+	require.True(t, evicted)
+	_, err = a.Merge()
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		treeA, err = a.MerkleTree(nil)
+		require.NoError(t, err)
+		walked, err := a.MerkleTree(all)
+		require.NoError(t, err)
+		require.Equal(t, walked, treeA)
+		require.Contains(t, treeA.Diff(treeB), Bucket("key05"))
+
+		require.NoError(t, a.Close())
+		a, err = NewKVstore(filepath.Join(dir, "a"), STORE_TEMPLATE, Config{NodeID: "a"})
+		require.NoError(t, err)
+		defer a.Close()
+	}
+}
+
+func testEvict(t *testing.T, dir string) {
+	s, err := NewKVstore(dir, STORE_TEMPLATE, Config{NodeID: "a"})
+	require.NoError(t, err)
+	require.NoError(t, s.Set(Record{Key: "moved", Value: []byte("value")}))
+	require.NoError(t, s.Set(Record{Key: "kept", Value: []byte("value")}))
+	moved, err := s.GetRecord("moved")
+	require.NoError(t, err)
+	kept, err := s.GetRecord("kept")
+	require.NoError(t, err)
+
+	// Only the version handed off is evicted, and no tombstone is written
+	require.NoError(t, s.Set(Record{Key: "kept", Value: []byte("newer")}))
+	evicted, err := s.Evict("kept", kept.Timestamp, kept.Origin)
+	require.NoError(t, err)
+	require.False(t, evicted)
+	evicted, err = s.Evict("moved", moved.Timestamp, moved.Origin)
+	require.NoError(t, err)
+	require.True(t, evicted)
+	evicted, err = s.Evict("moved", moved.Timestamp, moved.Origin)
+	require.NoError(t, err)
+	require.False(t, evicted)
+	_, err = s.Get("moved")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.Equal(t, []string{"kept"}, s.Keys())
+	require.Empty(t, s.Tombstones())
+	records, err := s.NewLogReader(0).Read(100)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	// The eviction is journaled, so the key stays gone after reopening
+	// without closing, as if the node had crashed, and merging leaves it
+	// behind for good
+	s, err = NewKVstore(dir, STORE_TEMPLATE, Config{NodeID: "a"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"kept"}, s.Keys())
+	_, err = s.Merge()
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	s, err = NewKVstore(dir, STORE_TEMPLATE, Config{NodeID: "a"})
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, []string{"kept"}, s.Keys())
+}
+
+func testEvictRestart(t *testing.T, dir string) {
+	s, err := NewKVstore(dir, STORE_TEMPLATE, Config{NodeID: "a"})
+	require.NoError(t, err)
+	require.NoError(t, s.Set(Record{Key: "a", Value: []byte("value")}))
+	require.NoError(t, s.Set(Record{Key: "b", Value: []byte("value")}))
+	b, err := s.GetRecord("b")
+	require.NoError(t, err)
+	evicted, err := s.Evict("b", b.Timestamp, b.Origin)
+	require.NoError(t, err)
+	require.True(t, evicted)
+
+	// The checkpoint taken on close no longer holds the key, but still
+	// covers its record, which is not indexed again
+	require.NoError(t, s.Close())
+	s, err = NewKVstore(dir, STORE_TEMPLATE, Config{NodeID: "a"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, s.Keys())
+
+	// Nor after writing past it and restarting again
+	require.NoError(t, s.Set(Record{Key: "c", Value: []byte("value")}))
+	require.NoError(t, s.Close())
+	s, err = NewKVstore(dir, STORE_TEMPLATE, Config{NodeID: "a"})
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, []string{"a", "c"}, s.Keys())
+}
+
+func testGetVersion(t *testing.T, dir string) {
+	s, err := NewKVstore(dir, STORE_TEMPLATE, Config{NodeID: "a"})
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.GetVersion("key")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, s.Set(Record{Key: "key", Value: []byte("value")}))
+	set, err := s.GetVersion("key")
+	require.NoError(t, err)
+	require.False(t, set.Deleted)
+	require.Equal(t, []byte("value"), set.Value)
+	require.Equal(t, "a", set.Origin)
+
+	// A deleted key keeps the version of its tombstone, and so does an
+	// expired one of the record it expired with
+	require.NoError(t, s.Delete("key"))
+	deleted, err := s.GetVersion("key")
+	require.NoError(t, err)
+	require.True(t, deleted.Deleted)
+	require.Greater(t, deleted.Timestamp, set.Timestamp)
+
+	require.NoError(t, s.Set(Record{Key: "expired", Value: []byte("value"), ExpireAt: time.Now().Add(-time.Second)}))
+	expired, err := s.GetVersion("expired")
+	require.NoError(t, err)
+	require.True(t, expired.Deleted)
+	_, err = s.GetRecord("expired")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func testSnapshot(t *testing.T, dir string) {
+	config := Config{}
+	config.Segment.MaxBytes = 256
+	for _, name := range []string{"src", "full", "dst"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+	}
+	src, err := NewKVstore(filepath.Join(dir, "src"), STORE_TEMPLATE, config)
+	require.NoError(t, err)
+	defer src.Close()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, src.Set(Record{Key: fmt.Sprintf("key%d", i), Value: []byte("value")}))
+	}
+	require.NoError(t, src.Delete("key0"))
+	require.Greater(t, len(src.segments), 1)
+
+	// Writes after the snapshot is taken are not in it
+	snapshot, err := src.Snapshot()
+	require.NoError(t, err)
+	defer snapshot.Close()
+	require.NoError(t, src.Set(Record{Key: "later", Value: []byte("value")}))
+	type chunk struct {
+		name string
+		data []byte
+	}
+	var chunks []chunk
+	require.NoError(t, snapshot.Chunks(100, func(name string, data []byte) error {
+		chunks = append(chunks, chunk{name, append([]byte(nil), data...)})
+		return nil
+	}))
+	next := func() func() (string, []byte, error) {
+		i := 0
+		return func() (string, []byte, error) {
+			if i == len(chunks) {
+				return "", nil, io.EOF
+			}
+			i++
+			return chunks[i-1].name, chunks[i-1].data, nil
+		}
+	}
+
+	// A store that has taken writes is left alone
+	full, err := NewKVstore(filepath.Join(dir, "full"), STORE_TEMPLATE, config)
+	require.NoError(t, err)
+	defer full.Close()
+	require.NoError(t, full.Set(Record{Key: "mine", Value: []byte("value")}))
+	require.ErrorIs(t, full.LoadSnapshot(next()), ErrStoreNotEmpty)
+	require.Equal(t, []string{"mine"}, full.Keys())
+
+	dst, err := NewKVstore(filepath.Join(dir, "dst"), STORE_TEMPLATE, config)
+	require.NoError(t, err)
+
+	// A snapshot that cannot be recovered from leaves the store as it was
+	good := chunks
+	chunks = nil
+	for _, c := range good {
+		switch c.name {
+		case snapshotCheckpoint:
+			c.data = []byte("garbage")
+		case "000000":
+			c.data = append([]byte{c.data[0] ^ 0xff}, c.data[1:]...)
+		}
+		chunks = append(chunks, c)
+	}
+	require.Error(t, dst.LoadSnapshot(next()))
+	require.Empty(t, dst.Keys())
+	require.NoError(t, dst.Set(Record{Key: "mine", Value: []byte("value")}))
+	require.NoError(t, dst.Close())
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "dst")))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "dst"), 0755))
+	chunks = good
+
+	// Reads carry on while the snapshot is loaded
+	dst, err = NewKVstore(filepath.Join(dir, "dst"), STORE_TEMPLATE, config)
+	require.NoError(t, err)
+	done := make(chan struct{})
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				dst.Get("key19")
+				dst.Keys()
+			}
+		}
+	}()
+	require.NoError(t, dst.LoadSnapshot(next()))
+	close(done)
+	<-read
+	require.Equal(t, snapshot.Seq, dst.lastSeq)
+	require.Len(t, dst.Keys(), 19)
+	require.Equal(t, []string{"key0"}, dst.Tombstones())
+	_, err = dst.Get("later")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	value, err := dst.Get("key19")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	// The loaded store takes writes after the snapshot's, and survives a
+	// restart
+	require.NoError(t, dst.Set(Record{Key: "new", Value: []byte("value")}))
+	require.Equal(t, snapshot.Seq+1, dst.lastSeq)
+	require.NoError(t, dst.Close())
+	dst, err = NewKVstore(filepath.Join(dir, "dst"), STORE_TEMPLATE, config)
+	require.NoError(t, err)
+	defer dst.Close()
+	require.Len(t, dst.Keys(), 20)
+	entries, err := os.ReadDir(filepath.Join(dir, "dst"))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.False(t, entry.IsDir(), entry.Name())
+	}
+}
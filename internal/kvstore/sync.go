@@ -0,0 +1,104 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Durability modes, deciding when a write is fsynced to disk
+const (
+	// Fsync before the write is acknowledged
+	SyncAlways = "always"
+	// Fsync in the background every Sync.Interval
+	SyncInterval = "interval"
+	// Leave it to the operating system
+	SyncNone = "none"
+)
+
+// Wait until the write with the given sequence number is durable, according
+// to the durability mode. Concurrent writers are committed as a group: the
+// first one in fsyncs everything written so far, and the writers queued up
+// behind it find their records already synced.
+func (s *KVstore) commit(seq uint64) error {
+	if s.Config.Sync.Mode != SyncAlways {
+		return nil
+	}
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	if s.synced.Load() >= seq {
+		return nil
+	}
+	return s.sync()
+}
+
+// Sync flushes the buffered writes and fsyncs the active segment
+func (s *KVstore) Sync() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	return s.sync()
+}
+
+// The caller must hold s.syncMu. The fsync runs without s.mu, so writers
+// can keep appending to the buffer for the next group while it runs.
+func (s *KVstore) sync() error {
+	s.mu.Lock()
+	seq := s.written
+	err := s.flush()
+	file := s.active.file
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error flushing store: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		// The segment was rolled over in the meantime, which syncs it first
+		if errors.Is(err, os.ErrClosed) && s.synced.Load() >= seq {
+			return nil
+		}
+		return fmt.Errorf("error syncing store: %w", err)
+	}
+	s.syncs.Add(1)
+	s.markSynced(seq)
+
+	return nil
+}
+
+// Record that every write up to seq is durable
+func (s *KVstore) markSynced(seq uint64) {
+	for {
+		synced := s.synced.Load()
+		if synced >= seq || s.synced.CompareAndSwap(synced, seq) {
+			return
+		}
+	}
+}
+
+// Periodically fsync the store when running in interval mode
+func (s *KVstore) syncLoop() {
+	ticker := time.NewTicker(s.Config.Sync.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			pending := s.written > s.synced.Load()
+			s.mu.Unlock()
+			if !pending {
+				continue
+			}
+			if err := s.Sync(); err != nil {
+				zap.L().Named("kvstore").Error("failed to sync store", zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package kvstore
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// VectorClock counts the writes to a key made on each node. A version of a
+// key whose clock descends another's has seen it, and replaces it; versions
+// where neither clock descends the other were written concurrently.
+type VectorClock map[string]uint64
+
+// Descends reports whether c has seen every write o has
+func (c VectorClock) Descends(o VectorClock) bool {
+	for node, n := range o {
+		if c[node] < n {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal reports whether c and o have seen the same writes
+func (c VectorClock) Equal(o VectorClock) bool {
+	return c.Descends(o) && o.Descends(c)
+}
+
+// Merge returns a clock that has seen every write c or o has
+func (c VectorClock) Merge(o VectorClock) VectorClock {
+	merged := make(VectorClock, len(c))
+	for node, n := range c {
+		merged[node] = n
+	}
+	for node, n := range o {
+		if n > merged[node] {
+			merged[node] = n
+		}
+	}
+	return merged
+}
+
+// Bytes encodes the clock, with its nodes in order so equal clocks encode the
+// same:
+//
+//	count | (node length | node | counter)...
+func (c VectorClock) Bytes() []byte {
+	nodes := make([]string, 0, len(c))
+	size := 2
+	for node := range c {
+		nodes = append(nodes, node)
+		size += 2 + len(node) + 8
+	}
+	sort.Strings(nodes)
+
+	b := make([]byte, size)
+	enc.PutUint16(b, uint16(len(nodes)))
+	pos := 2
+	for _, node := range nodes {
+		enc.PutUint16(b[pos:], uint16(len(node)))
+		pos += 2
+		pos += copy(b[pos:], node)
+		enc.PutUint64(b[pos:], c[node])
+		pos += 8
+	}
+	return b
+}
+
+// Context returns the clock as sent over the wire, the causal context a
+// client passes back with its next write, with no clock sent as nothing
+func (c VectorClock) Context() []byte {
+	if c == nil {
+		return nil
+	}
+	return c.Bytes()
+}
+
+// ParseVectorClock decodes a clock encoded by Bytes. Nothing at all decodes
+// as the empty clock.
+func ParseVectorClock(b []byte) (VectorClock, error) {
+	c, n, err := decodeVectorClock(b)
+	if err == nil && n != len(b) {
+		err = fmt.Errorf("invalid vector clock: %d trailing bytes", len(b)-n)
+	}
+	return c, err
+}
+
+// Decode the clock at the start of b, returning it with its encoded length
+func decodeVectorClock(b []byte) (VectorClock, int, error) {
+	if len(b) == 0 {
+		return nil, 0, nil
+	}
+	if len(b) < 2 {
+		return nil, 0, fmt.Errorf("invalid vector clock: truncated")
+	}
+	// Every node takes at least its name length and counter
+	count := int(enc.Uint16(b))
+	if count > (len(b)-2)/10 {
+		return nil, 0, fmt.Errorf("invalid vector clock: truncated")
+	}
+	c := make(VectorClock, count)
+	pos := 2
+	for i := 0; i < count; i++ {
+		if len(b) < pos+2 {
+			return nil, 0, fmt.Errorf("invalid vector clock: truncated")
+		}
+		end := pos + 2 + int(enc.Uint16(b[pos:]))
+		if len(b) < end+8 {
+			return nil, 0, fmt.Errorf("invalid vector clock: truncated")
+		}
+		c[string(b[pos+2:end])] = enc.Uint64(b[end:])
+		pos = end + 8
+	}
+	return c, pos, nil
+}
+
+// Sibling is one of several versions of a key written concurrently
+type Sibling struct {
+	Value []byte
+	Clock VectorClock
+}
+
+// Encode siblings as a record value:
+//
+//	count | (clock | value length | value)...
+func encodeSiblings(siblings []Sibling) []byte {
+	b := make([]byte, 4)
+	enc.PutUint32(b, uint32(len(siblings)))
+	for _, sibling := range siblings {
+		b = append(b, sibling.Clock.Bytes()...)
+		b = enc.AppendUint32(b, uint32(len(sibling.Value)))
+		b = append(b, sibling.Value...)
+	}
+	return b
+}
+
+func decodeSiblings(b []byte) ([]Sibling, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("%w: truncated siblings", ErrCorruptRecord)
+	}
+	// Every sibling takes at least an empty clock and its value length
+	count := enc.Uint32(b)
+	if uint64(count) > uint64(len(b)-4)/6 {
+		return nil, fmt.Errorf("%w: truncated siblings", ErrCorruptRecord)
+	}
+	siblings := make([]Sibling, 0, count)
+	pos := 4
+	for i := uint32(0); i < count; i++ {
+		clock, n, err := decodeVectorClock(b[pos:])
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("%w: bad sibling clock", ErrCorruptRecord)
+		}
+		pos += n
+		if len(b) < pos+4 {
+			return nil, fmt.Errorf("%w: truncated siblings", ErrCorruptRecord)
+		}
+		end := pos + 4 + int(enc.Uint32(b[pos:]))
+		if len(b) < end {
+			return nil, fmt.Errorf("%w: truncated siblings", ErrCorruptRecord)
+		}
+		siblings = append(siblings, Sibling{Value: b[pos+4 : end], Clock: clock})
+		pos = end
+	}
+	return siblings, nil
+}
+
+// Siblings are kept in the order of their encoded clocks, so every node lists
+// them the same way
+func sortSiblings(siblings []Sibling) {
+	sort.Slice(siblings, func(i, j int) bool {
+		return string(siblings[i].Clock.Bytes()) < string(siblings[j].Clock.Bytes())
+	})
+}
+
+// Whether one of the siblings is the version with the given clock
+func hasSibling(siblings []Sibling, clock VectorClock) bool {
+	for _, sibling := range siblings {
+		if sibling.Clock.Equal(clock) {
+			return true
+		}
+	}
+	return false
+}
+
+// Work out the record a write leaves behind for its key when the store keeps
+// siblings. A write made here replaces the versions its clock, the causal
+// context the key was read with, has seen, and sits alongside the rest. A
+// replicated record carries every version of the key on the node it came
+// from, and is merged with the versions here, keeping whichever versions
+// neither side has seen replaced. It returns the record along with whether
+// the key is left with no versions at all, and so deleted.
+// The caller must hold s.mu.
+func (s *KVstore) reconcile(record Record, tombstone bool, at *stamp) (Record, bool, error) {
+	if err := s.flush(); err != nil {
+		return record, tombstone, err
+	}
+	clock, versions, err := s.versions(record.Key)
+	if err != nil {
+		return record, tombstone, err
+	}
+
+	out := Record{Key: record.Key,
+		ExpireAt:  record.ExpireAt,
+		Origin:    record.Origin,
+		OriginSeq: record.OriginSeq,
+		Siblings:  []Sibling{}}
+	if record.Timestamp == 0 {
+		node := s.writer(at)
+		written := record.Clock.Merge(VectorClock{node: clock[node] + 1})
+		if !tombstone {
+			out.Siblings = append(out.Siblings, Sibling{Value: record.Value, Clock: written})
+		}
+		for _, version := range versions {
+			if !record.Clock.Descends(version.Clock) {
+				out.Siblings = append(out.Siblings, version)
+			}
+		}
+		out.Clock = clock.Merge(written)
+	} else {
+		if len(record.Clock) > 0 && clock.Descends(record.Clock) {
+			return record, tombstone, ErrStaleRecord
+		}
+		incoming := record.Siblings
+		if incoming == nil && !tombstone {
+			incoming = []Sibling{{Value: record.Value, Clock: record.Clock}}
+		}
+		for _, version := range versions {
+			if hasSibling(incoming, version.Clock) || !record.Clock.Descends(version.Clock) {
+				out.Siblings = append(out.Siblings, version)
+			}
+		}
+		for _, version := range incoming {
+			// Versions without a clock come from nodes not keeping siblings
+			if !hasSibling(versions, version.Clock) && (len(version.Clock) == 0 || !clock.Descends(version.Clock)) {
+				out.Siblings = append(out.Siblings, version)
+			}
+		}
+		out.Clock = clock.Merge(record.Clock)
+
+		// The merged record is stamped afresh, after the one it came in with
+		if record.Timestamp > s.lastTimestamp {
+			s.lastTimestamp = record.Timestamp
+		}
+	}
+	if len(out.Siblings) == 0 {
+		out.Siblings = nil
+		return out, true, nil
+	}
+	sortSiblings(out.Siblings)
+	out.Value = out.Siblings[0].Value
+	return out, false, nil
+}
+
+// The clock of the key and its live versions, for a write to build on. A
+// deleted or expired key has a clock but no versions.
+// The caller must hold s.mu, with the write buffer flushed.
+func (s *KVstore) versions(key string) (VectorClock, []Sibling, error) {
+	s.Keymap.FileLock.RLock()
+	defer s.Keymap.FileLock.RUnlock()
+	s.segMu.RLock()
+	defer s.segMu.RUnlock()
+
+	keyInfo, live := s.Keymap.Map[key]
+	if !live {
+		var ok bool
+		if keyInfo, ok = s.Keymap.Tombstones[key]; !ok {
+			return nil, nil, nil
+		}
+	}
+	seg := s.segments[keyInfo.Segment]
+	record, _, err := readRecord(seg.file, keyInfo.Offset, seg.flushed.Load())
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case !live || keyInfo.Expired(time.Now().UnixNano()):
+		return record.Clock, nil, nil
+	case record.Siblings != nil:
+		return record.Clock, record.Siblings, nil
+	}
+	return record.Clock, []Sibling{{Value: record.Value, Clock: record.Clock}}, nil
+}
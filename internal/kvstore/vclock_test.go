@@ -0,0 +1,43 @@
+package kvstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVectorClock(t *testing.T) {
+	a := VectorClock{"a": 2, "b": 1}
+	b := VectorClock{"a": 1, "b": 2}
+
+	require.True(t, a.Descends(VectorClock{"a": 1}))
+	require.True(t, a.Descends(nil))
+	require.False(t, a.Descends(b))
+	require.False(t, b.Descends(a))
+
+	merged := a.Merge(b)
+	require.Equal(t, VectorClock{"a": 2, "b": 2}, merged)
+	require.True(t, merged.Descends(a) && merged.Descends(b))
+	require.True(t, merged.Equal(VectorClock{"b": 2, "a": 2}))
+
+	parsed, err := ParseVectorClock(merged.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, merged, parsed)
+	parsed, err = ParseVectorClock(nil)
+	require.NoError(t, err)
+	require.Nil(t, parsed)
+	_, err = ParseVectorClock(merged.Bytes()[:5])
+	require.Error(t, err)
+
+	siblings := []Sibling{{Value: []byte("one"), Clock: a}, {Value: []byte("two"), Clock: b}}
+	decoded, err := decodeSiblings(encodeSiblings(siblings))
+	require.NoError(t, err)
+	require.Equal(t, siblings, decoded)
+
+	// Counts larger than what follows could hold are refused before
+	// anything is allocated for them
+	_, err = decodeSiblings([]byte{0xff, 0xff, 0xff, 0xff, 0, 0})
+	require.ErrorIs(t, err, ErrCorruptRecord)
+	_, err = ParseVectorClock([]byte{0xff, 0xff})
+	require.Error(t, err)
+}
@@ -0,0 +1,62 @@
+package kvstore
+
+import (
+	"time"
+
+	api "github.com/jscottransom/distributed_godis/api"
+)
+
+// UnixMilli returns an expiry in Unix milliseconds as sent over the wire,
+// with the zero time sent as 0
+func UnixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// FromUnixMilli reads back an expiry sent by UnixMilli
+func FromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// APIRecord returns the record as sent over the wire
+func APIRecord(record LogRecord) *api.LogRecord {
+	return &api.LogRecord{
+		Offset:    record.Offset,
+		Key:       record.Key,
+		Value:     record.Value,
+		Deleted:   record.Deleted,
+		ExpireAt:  UnixMilli(record.ExpireAt),
+		Origin:    record.Origin,
+		OriginSeq: record.OriginSeq,
+		Timestamp: record.Timestamp,
+		Context:   record.Clock.Context(),
+		Siblings:  APISiblings(record.Siblings),
+	}
+}
+
+// APISiblings returns the siblings as sent over the wire
+func APISiblings(siblings []Sibling) []*api.Sibling {
+	var out []*api.Sibling
+	for _, sibling := range siblings {
+		out = append(out, &api.Sibling{Value: sibling.Value, Clock: sibling.Clock.Bytes()})
+	}
+	return out
+}
+
+// ParseSiblings reads back siblings sent by APISiblings
+func ParseSiblings(siblings []*api.Sibling) ([]Sibling, error) {
+	var out []Sibling
+	for _, sibling := range siblings {
+		clock, err := ParseVectorClock(sibling.Clock)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Sibling{Value: sibling.Value, Clock: clock})
+	}
+	return out, nil
+}
@@ -0,0 +1,95 @@
+package loadbalance
+
+import (
+	"sync/atomic"
+
+	api "github.com/jscottransom/distributed_godis/api"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+// Methods that write, which go to the leader when there is one
+var writes = map[string]bool{
+	api.GodisService_SetKey_FullMethodName:    true,
+	api.GodisService_SetStream_FullMethodName: true,
+	api.GodisService_DeleteKey_FullMethodName: true,
+	api.GodisService_Expire_FullMethodName:    true,
+	api.GodisService_Persist_FullMethodName:   true,
+}
+
+type pickerBuilder struct{}
+
+var _ base.PickerBuilder = (*pickerBuilder)(nil)
+
+// Build a picker for the servers ready to take requests, sorted by what
+// they do with writes
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{}
+	for sc, scInfo := range info.ReadySCs {
+		switch role(scInfo.Address) {
+		case api.Role_LEADER:
+			p.leader = sc
+		case api.Role_FOLLOWER:
+			p.followers = append(p.followers, sc)
+		case api.Role_REPLICA:
+			p.replicas = append(p.replicas, sc)
+		default:
+			p.peers = append(p.peers, sc)
+		}
+	}
+	return p
+}
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &pickerBuilder{}, base.Config{}))
+}
+
+// Picker sends writes to the raft leader, and spreads reads across its
+// followers. Without a leader, as with async replication, every request is
+// spread across the peers. Read-only replicas take their share of the reads,
+// but are never sent writes.
+type Picker struct {
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	peers     []balancer.SubConn
+	replicas  []balancer.SubConn
+	current   atomic.Uint64
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var result balancer.PickResult
+	write := writes[info.FullMethodName]
+	switch {
+	case write && p.leader != nil:
+		result.SubConn = p.leader
+	case write && len(p.followers) > 0:
+		result.SubConn = p.next(p.followers)
+	case write && len(p.peers) > 0:
+		result.SubConn = p.next(p.peers)
+	case !write && len(p.followers)+len(p.peers)+len(p.replicas) > 0:
+		result.SubConn = p.next(p.followers, p.peers, p.replicas)
+	case p.leader != nil:
+		result.SubConn = p.leader
+	default:
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+// The next of the servers across the groups given, round robin
+func (p *Picker) next(groups ...[]balancer.SubConn) balancer.SubConn {
+	var n int
+	for _, scs := range groups {
+		n += len(scs)
+	}
+	i := int((p.current.Add(1) - 1) % uint64(n))
+	for _, scs := range groups {
+		if i < len(scs) {
+			return scs[i]
+		}
+		i -= len(scs)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+
+	api "github.com/jscottransom/distributed_godis/api"
+)
+
+func TestPicker(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"No servers are ready":            testPickerNoSubConns,
+		"Writes go to the leader":         testPickerWritesToLeader,
+		"Reads are spread over followers": testPickerReadsFromFollowers,
+		"Peers take reads and writes":     testPickerPeers,
+		"Replicas only take reads":        testPickerReplicas,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testPickerNoSubConns(t *testing.T) {
+	picker := (&pickerBuilder{}).Build(base.PickerBuildInfo{})
+	for _, method := range []string{api.GodisService_SetKey_FullMethodName, api.GodisService_GetKey_FullMethodName} {
+		_, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+	}
+}
+
+func testPickerWritesToLeader(t *testing.T) {
+	picker, subConns := setupPicker(api.Role_LEADER, api.Role_FOLLOWER, api.Role_FOLLOWER)
+	for _, method := range []string{
+		api.GodisService_SetKey_FullMethodName,
+		api.GodisService_DeleteKey_FullMethodName,
+		api.GodisService_SetStream_FullMethodName,
+	} {
+		for i := 0; i < 3; i++ {
+			result, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+			require.NoError(t, err)
+			require.Equal(t, subConns[0], result.SubConn)
+		}
+	}
+}
+
+func testPickerReadsFromFollowers(t *testing.T) {
+	picker, subConns := setupPicker(api.Role_LEADER, api.Role_FOLLOWER, api.Role_FOLLOWER)
+	picked := make(map[balancer.SubConn]int)
+	for i := 0; i < 4; i++ {
+		result, err := picker.Pick(balancer.PickInfo{FullMethodName: api.GodisService_GetKey_FullMethodName})
+		require.NoError(t, err)
+		picked[result.SubConn]++
+	}
+	require.Equal(t, map[balancer.SubConn]int{subConns[1]: 2, subConns[2]: 2}, picked)
+
+	// The leader serves reads once it is the only one left
+	picker, subConns = setupPicker(api.Role_LEADER)
+	result, err := picker.Pick(balancer.PickInfo{FullMethodName: api.GodisService_GetKey_FullMethodName})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], result.SubConn)
+}
+
+func testPickerPeers(t *testing.T) {
+	picker, subConns := setupPicker(api.Role_PEER, api.Role_PEER)
+	picked := make(map[balancer.SubConn]int)
+	for i := 0; i < 2; i++ {
+		for _, method := range []string{api.GodisService_SetKey_FullMethodName, api.GodisService_GetKey_FullMethodName} {
+			result, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+			require.NoError(t, err)
+			picked[result.SubConn]++
+		}
+	}
+	require.Equal(t, map[balancer.SubConn]int{subConns[0]: 2, subConns[1]: 2}, picked)
+}
+
+func testPickerReplicas(t *testing.T) {
+	picker, subConns := setupPicker(api.Role_PEER, api.Role_REPLICA)
+	for i := 0; i < 2; i++ {
+		result, err := picker.Pick(balancer.PickInfo{FullMethodName: api.GodisService_SetKey_FullMethodName})
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], result.SubConn)
+	}
+	picked := make(map[balancer.SubConn]int)
+	for i := 0; i < 4; i++ {
+		result, err := picker.Pick(balancer.PickInfo{FullMethodName: api.GodisService_GetKey_FullMethodName})
+		require.NoError(t, err)
+		picked[result.SubConn]++
+	}
+	require.Equal(t, map[balancer.SubConn]int{subConns[0]: 2, subConns[1]: 2}, picked)
+
+	// Writes wait rather than go to a replica
+	picker, _ = setupPicker(api.Role_REPLICA)
+	_, err := picker.Pick(balancer.PickInfo{FullMethodName: api.GodisService_SetKey_FullMethodName})
+	require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+}
+
+// Build a picker over ready servers with the given roles
+func setupPicker(roles ...api.Role) (balancer.Picker, []balancer.SubConn) {
+	var subConns []balancer.SubConn
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for _, role := range roles {
+		sc := &subConn{}
+		info.ReadySCs[sc] = base.SubConnInfo{
+			Address: resolver.Address{Attributes: attributes.New(roleKey{}, role)},
+		}
+		subConns = append(subConns, sc)
+	}
+	return (&pickerBuilder{}).Build(info), subConns
+}
+
+type subConn struct {
+	balancer.SubConn
+}
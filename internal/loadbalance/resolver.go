@@ -0,0 +1,164 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/jscottransom/distributed_godis/api"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the scheme clients dial the cluster with, as in
+// "godis:///127.0.0.1:8401", and the name of the balancer that spreads their
+// requests across it. The address is any member of the cluster.
+const Name = "godis"
+
+// How often to ask the cluster for its members again, to pick up those that
+// have joined
+const refreshInterval = 10 * time.Second
+
+// The attribute holding a server's role
+type roleKey struct{}
+
+// Builder builds resolvers that find the members of the cluster through the
+// GetServers RPC of the address dialed
+type Builder struct{}
+
+var _ resolver.Builder = (*Builder)(nil)
+
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	creds := opts.DialCreds
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(target.Endpoint(), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("error dialing %s: %w", target.Endpoint(), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Resolver{
+		clientConn:    cc,
+		resolverConn:  conn,
+		serviceConfig: cc.ParseServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name)),
+		logger:        zap.L().Named("resolver"),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	go r.refreshLoop()
+	return r, nil
+}
+
+func (b *Builder) Scheme() string {
+	return Name
+}
+
+func init() {
+	resolver.Register(&Builder{})
+}
+
+// Resolver keeps a client's connection up to date with the members of the
+// cluster
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *zap.Logger
+	closed        bool
+	// Cancelled on close, along with any resolve still waiting on the cluster
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Resolves started, and the latest one handed to the connection, so a
+	// slow resolve never overwrites the members a later one found
+	started, applied uint64
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+// ResolveNow asks the cluster for its members, and hands them to the
+// client's connection along with their roles. The lock is not held while the
+// cluster answers, so a server that is slow to does not hold up Close.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.started++
+	resolve := r.started
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.ctx, refreshInterval)
+	defer cancel()
+	client := api.NewGodisServiceClient(r.resolverConn)
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || resolve < r.applied {
+		return
+	}
+	r.applied = resolve
+	if err != nil {
+		r.logger.Error("failed to resolve servers", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(roleKey{}, server.Role),
+		})
+	}
+	if err := r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Error("failed to update servers", zap.Error(err))
+	}
+}
+
+func (r *Resolver) refreshLoop() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+func (r *Resolver) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.cancel()
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close conn", zap.Error(err))
+	}
+}
+
+// The role of the server at the address, as the resolver found it
+func role(addr resolver.Address) api.Role {
+	role, _ := addr.Attributes.Value(roleKey{}).(api.Role)
+	return role
+}
@@ -0,0 +1,151 @@
+package loadbalance_test
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+
+	api "github.com/jscottransom/distributed_godis/api"
+	"github.com/jscottransom/distributed_godis/internal/auth"
+	"github.com/jscottransom/distributed_godis/internal/config"
+	"github.com/jscottransom/distributed_godis/internal/loadbalance"
+	"github.com/jscottransom/distributed_godis/internal/server"
+)
+
+func TestResolver(t *testing.T) {
+	r, conn, teardown := setupResolver(t, servers{})
+	defer teardown()
+	defer r.Close()
+
+	// Every member is handed to the connection, along with its role
+	require.Equal(t, []string{"127.0.0.1:9001", "127.0.0.1:9002"}, conn.addrs())
+	require.NotNil(t, conn.state.ServiceConfig)
+}
+
+func TestResolverClose(t *testing.T) {
+	lister := &stalling{entered: make(chan struct{}), release: make(chan struct{})}
+	r, _, teardown := setupResolver(t, lister)
+	defer teardown()
+	defer close(lister.release)
+
+	// Closing does not wait on a resolve the cluster is slow to answer, and
+	// the resolve gives up
+	resolved := make(chan struct{})
+	go func() {
+		r.ResolveNow(resolver.ResolveNowOptions{})
+		close(resolved)
+	}()
+	<-lister.entered
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	for _, done := range []chan struct{}{closed, resolved} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("resolver held up by a slow server")
+		}
+	}
+}
+
+func setupResolver(t *testing.T, lister server.ServerLister) (resolver.Resolver, *clientConn, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(&server.Config{
+		Authorizer:   auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		ServerLister: lister,
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	target, err := url.Parse(fmt.Sprintf("%s:///%s", loadbalance.Name, l.Addr()))
+	require.NoError(t, err)
+	conn := &clientConn{}
+	r, err := (&loadbalance.Builder{}).Build(
+		resolver.Target{URL: *target},
+		conn,
+		resolver.BuildOptions{DialCreds: credentials.NewTLS(clientTLSConfig)},
+	)
+	require.NoError(t, err)
+	return r, conn, srv.Stop
+}
+
+// Lists a leader and a follower
+type servers struct{}
+
+func (servers) GetServers() ([]*api.Server, error) {
+	return []*api.Server{
+		{Id: "leader", RpcAddr: "127.0.0.1:9001", Role: api.Role_LEADER},
+		{Id: "follower", RpcAddr: "127.0.0.1:9002", Role: api.Role_FOLLOWER},
+	}, nil
+}
+
+// Answers the first listing, and stalls on the rest until released
+type stalling struct {
+	calls   atomic.Int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *stalling) GetServers() ([]*api.Server, error) {
+	if s.calls.Add(1) > 1 {
+		close(s.entered)
+		<-s.release
+	}
+	return servers{}.GetServers()
+}
+
+// Keeps the state the resolver hands it
+type clientConn struct {
+	resolver.ClientConn
+	state resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.state = state
+	return nil
+}
+
+func (c *clientConn) ReportError(error) {}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
+
+func (c *clientConn) addrs() []string {
+	var addrs []string
+	for _, addr := range c.state.Addresses {
+		addrs = append(addrs, addr.Addr)
+	}
+	return addrs
+}
@@ -0,0 +1,280 @@
+package ring
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Ring partitions the keyspace across the cluster with consistent hashing.
+// Every node takes a number of virtual points on a ring of hashes, and a key
+// is owned by the nodes of the first points at or after its own hash, going
+// round until it has ReplicationFactor distinct owners. A node joining or
+// leaving only moves the keys next to its points. A node that has failed
+// keeps its points, but is passed over for the next node round until it is
+// back.
+type Ring struct {
+	Config
+	mu     sync.RWMutex
+	nodes  map[string]string // RPC address of each node, by name
+	down   map[string]bool   // Nodes that have failed
+	points []point           // Sorted by hash
+}
+
+type Config struct {
+	// The local node, which is always on the ring
+	NodeName string
+	RPCAddr  string
+	// Number of nodes each key is stored on. Zero stores every key on every
+	// node.
+	ReplicationFactor int
+	// Number of points each node takes on the ring; more spread the keys
+	// more evenly
+	VirtualNodes int
+	// The local node is a read-only replica, which stays off the ring
+	Replica bool
+}
+
+type point struct {
+	hash uint64
+	name string
+}
+
+func New(config Config) *Ring {
+	if config.VirtualNodes == 0 {
+		config.VirtualNodes = 64
+	}
+	r := &Ring{Config: config,
+		nodes: make(map[string]string),
+		down:  make(map[string]bool)}
+	if !config.Replica {
+		r.Join(config.NodeName, config.RPCAddr)
+	}
+	return r
+}
+
+// Join adds the node's points to the ring. It is called as members join the
+// cluster, or come back after failing.
+func (r *Ring) Join(name, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.down, name)
+	if _, ok := r.nodes[name]; ok {
+		r.nodes[name] = addr
+		return nil
+	}
+	r.nodes[name] = addr
+	for i := 0; i < r.Config.VirtualNodes; i++ {
+		r.points = append(r.points, point{hash: hash(name + "#" + strconv.Itoa(i)), name: name})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].name < r.points[j].name
+	})
+	return nil
+}
+
+// JoinReplica keeps a read-only replica off the ring, as it takes no writes
+// and owns none of the keyspace. A member that was on the ring before is
+// taken off it.
+func (r *Ring) JoinReplica(name, addr string) error {
+	return r.Leave(name)
+}
+
+// Leave takes the node's points off the ring, handing its keys to the next
+// nodes round. The local node never leaves its own ring, unless it is a
+// replica that was never on it.
+func (r *Ring) Leave(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.nodes[name]; !ok || name == r.Config.NodeName {
+		return nil
+	}
+	delete(r.nodes, name)
+	delete(r.down, name)
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.name != name {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+	return nil
+}
+
+// Fail marks the node as down, so its keys go to the next nodes round until
+// it joins again. The local node never fails on its own ring.
+func (r *Ring) Fail(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.nodes[name]; ok && name != r.Config.NodeName {
+		r.down[name] = true
+	}
+	return nil
+}
+
+// Owners returns the names of the nodes the key is stored on, in ring order
+func (r *Ring) Owners(key string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.owners(key, false)
+}
+
+// DownOwners returns the names of the nodes that would own the key were they
+// not down
+func (r *Ring) DownOwners(key string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.down) == 0 {
+		return nil
+	}
+	var down []string
+	for _, name := range r.owners(key, true) {
+		if r.down[name] {
+			down = append(down, name)
+		}
+	}
+	return down
+}
+
+// The owners of the key, counting the nodes that are down if asked to.
+// The caller must hold r.mu.
+func (r *Ring) owners(key string, withDown bool) []string {
+	nodes := len(r.nodes)
+	if !withDown {
+		nodes -= len(r.down)
+	}
+	n := r.Config.ReplicationFactor
+	if n <= 0 || n > nodes {
+		n = nodes
+	}
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	owners := make([]string, 0, n)
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		name := r.points[(start+i)%len(r.points)].name
+		if (withDown || !r.down[name]) && !contains(owners, name) {
+			owners = append(owners, name)
+		}
+	}
+	return owners
+}
+
+// OwnerAddrs returns the RPC addresses of the other nodes the key is stored
+// on, in ring order, and whether the local node is one of its owners too
+func (r *Ring) OwnerAddrs(key string) ([]string, bool) {
+	owners := r.Owners(key)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	addrs := make([]string, 0, len(owners))
+	local := false
+	for _, name := range owners {
+		if name == r.Config.NodeName {
+			local = true
+			continue
+		}
+		addrs = append(addrs, r.nodes[name])
+	}
+	return addrs, local
+}
+
+// Addr returns the RPC address of the node, if it is on the ring
+func (r *Ring) Addr(name string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	addr, ok := r.nodes[name]
+	return addr, ok
+}
+
+// Snapshot returns a copy of the ring as it is now, which no longer follows
+// nodes joining or leaving
+func (r *Ring) Snapshot() *Ring {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	snapshot := &Ring{Config: r.Config,
+		nodes:  make(map[string]string, len(r.nodes)),
+		down:   make(map[string]bool, len(r.down)),
+		points: append([]point(nil), r.points...)}
+	for name, addr := range r.nodes {
+		snapshot.nodes[name] = addr
+	}
+	for name := range r.down {
+		snapshot.down[name] = true
+	}
+	return snapshot
+}
+
+// Owns reports whether the key is stored on the local node
+func (r *Ring) Owns(key string) bool {
+	return contains(r.Owners(key), r.Config.NodeName)
+}
+
+// OwnedBy reports whether the key is stored on every one of the named nodes
+func (r *Ring) OwnedBy(key string, names ...string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Every node that is up holds every key, without walking the ring
+	if r.holdAll(names) {
+		return true
+	}
+
+	owners := r.owners(key, false)
+	for _, name := range names {
+		if !contains(owners, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// HoldAll reports whether every key is stored on every one of the named
+// nodes, as when each node that is up holds a copy of the whole keyspace
+func (r *Ring) HoldAll(names ...string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.holdAll(names)
+}
+
+func (r *Ring) holdAll(names []string) bool {
+	up := len(r.nodes) - len(r.down)
+	if r.Config.ReplicationFactor > 0 && r.Config.ReplicationFactor < up {
+		return false
+	}
+	for _, name := range names {
+		if _, ok := r.nodes[name]; !ok || r.down[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// FNV alone leaves the points of names that differ only in their last few
+// bytes close together, so its hash is mixed to spread them round the ring
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package ring_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jscottransom/distributed_godis/internal/ring"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRing(t *testing.T) {
+	r := ring.New(ring.Config{NodeName: "0", RPCAddr: "addr0", ReplicationFactor: 2})
+	for i := 1; i < 4; i++ {
+		require.NoError(t, r.Join(fmt.Sprintf("%d", i), fmt.Sprintf("addr%d", i)))
+	}
+
+	// Every key has distinct owners, and the keys are spread across every node
+	before := make(map[string][]string)
+	held := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owners := r.Owners(key)
+		require.Len(t, owners, 2)
+		require.NotEqual(t, owners[0], owners[1])
+		for _, owner := range owners {
+			held[owner]++
+		}
+		before[key] = owners
+
+		addrs, local := r.OwnerAddrs(key)
+		require.Equal(t, local, r.Owns(key))
+		require.True(t, r.OwnedBy(key, owners...))
+		require.Equal(t, local, r.OwnedBy(key, "0", owners[1]))
+		if local {
+			require.Len(t, addrs, 1)
+		} else {
+			require.Equal(t, []string{"addr" + owners[0], "addr" + owners[1]}, addrs)
+		}
+	}
+	require.Len(t, held, 4)
+	require.False(t, r.HoldAll("0", "1"))
+	for _, n := range held {
+		require.Greater(t, n, 300, held)
+	}
+
+	// Only the keys on a node that leaves move, and never onto it again
+	require.NoError(t, r.Leave("3"))
+	for key, owners := range before {
+		after := r.Owners(key)
+		require.NotContains(t, after, "3")
+		if owners[0] != "3" && owners[1] != "3" {
+			require.Equal(t, owners, after)
+		}
+	}
+
+	// A node that fails is passed over until it joins again, and is still
+	// known to own its keys
+	placed := make(map[string][]string)
+	for key := range before {
+		placed[key] = r.Owners(key)
+	}
+	require.NoError(t, r.Fail("2"))
+	for key, owners := range placed {
+		require.NotContains(t, r.Owners(key), "2")
+		if owners[0] == "2" || owners[1] == "2" {
+			require.Equal(t, []string{"2"}, r.DownOwners(key))
+		} else {
+			require.Empty(t, r.DownOwners(key))
+		}
+	}
+	require.NoError(t, r.Join("2", "addr2"))
+	for key, owners := range placed {
+		require.Equal(t, owners, r.Owners(key))
+		require.Empty(t, r.DownOwners(key))
+	}
+
+	// The local node stays on its own ring, and a small cluster stores each
+	// key on every node it has
+	require.NoError(t, r.Leave("0"))
+	require.NoError(t, r.Leave("1"))
+	require.NoError(t, r.Leave("2"))
+	require.Equal(t, []string{"0"}, r.Owners("key"))
+	require.True(t, r.Owns("key"))
+
+	// Replicas own none of the keyspace, on their own ring or anyone else's
+	require.NoError(t, r.JoinReplica("1", "addr1"))
+	require.Equal(t, []string{"0"}, r.Owners("key"))
+	require.NoError(t, r.Join("1", "addr1"))
+	require.NoError(t, r.JoinReplica("1", "addr1"))
+	require.Equal(t, []string{"0"}, r.Owners("key"))
+	replica := ring.New(ring.Config{NodeName: "1", RPCAddr: "addr1", ReplicationFactor: 2, Replica: true})
+	require.NoError(t, replica.Join("0", "addr0"))
+	require.Equal(t, []string{"0"}, replica.Owners("key"))
+	require.False(t, replica.Owns("key"))
+
+	// With no replication factor, every key is stored on every node
+	r = ring.New(ring.Config{NodeName: "0", RPCAddr: "addr0"})
+	require.NoError(t, r.Join("1", "addr1"))
+	require.ElementsMatch(t, []string{"0", "1"}, r.Owners("key"))
+	addrs, local := r.OwnerAddrs("key")
+	require.Equal(t, []string{"addr1"}, addrs)
+	require.True(t, local)
+	require.True(t, r.OwnedBy("key", "0", "1"))
+	require.False(t, r.OwnedBy("key", "0", "2"))
+	require.True(t, r.HoldAll("0", "1"))
+	require.False(t, r.HoldAll("0", "2"))
+}
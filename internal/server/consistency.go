@@ -0,0 +1,225 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	api "github.com/jscottransom/distributed_godis/api"
+	store "github.com/jscottransom/distributed_godis/internal/kvstore"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Number of the n replicas of a key a request at the given consistency waits
+// on
+func required(level api.Consistency, n int) int {
+	switch level {
+	case api.Consistency_QUORUM:
+		return n/2 + 1
+	case api.Consistency_ALL:
+		return n
+	}
+	return 1
+}
+
+// The other replicas of the key a request at the given consistency has to
+// reach, and how many of them have to answer. This node counts as one of the
+// replicas.
+func (s *grpcServer) replicas(key string, level api.Consistency) ([]string, int) {
+	if s.Config.Router == nil || level == api.Consistency_ONE {
+		return nil, 0
+	}
+	addrs, _ := s.Config.Router.OwnerAddrs(key)
+	return addrs, required(level, len(addrs)+1) - 1
+}
+
+// Send the key's record, as written here, to the other replicas of the key,
+// returning once enough of them have taken it for the consistency asked for.
+// The write stays here whether or not they do, and replication carries it to
+// the rest in time.
+func (s *grpcServer) replicateWrite(ctx context.Context, key string, level api.Consistency) error {
+	addrs, need := s.replicas(key, level)
+	if need == 0 {
+		return nil
+	}
+	record, err := s.Config.Store.GetVersion(key)
+	if err != nil {
+		return err
+	}
+	req := &api.SetRequest{
+		Key:       record.Key,
+		Value:     record.Value,
+		ExpireAt:  store.UnixMilli(record.ExpireAt),
+		Origin:    record.Origin,
+		OriginSeq: record.OriginSeq,
+		Timestamp: record.Timestamp,
+		Context:   record.Clock.Context(),
+		Siblings:  store.APISiblings(record.Siblings),
+	}
+
+	return s.fanOut(ctx, addrs, need, func(ctx context.Context, addr string, client api.GodisServiceClient) error {
+		_, err := client.SetKey(ctx, req)
+		// A replica already holding a newer version has taken the write
+		// just the same
+		if status.Code(err) == codes.Aborted {
+			return nil
+		}
+		return err
+	})
+}
+
+// Queue the key's record, as written here, for its owners that are down. A
+// hint that cannot be queued is left to anti-entropy, as the write itself has
+// gone through.
+func (s *grpcServer) hint(key string) {
+	if s.Config.Hinter == nil {
+		return
+	}
+	record, err := s.Config.Store.GetVersion(key)
+	if err == nil {
+		err = s.Config.Hinter.Hint(record)
+	}
+	if err != nil {
+		log.Printf("Unable to queue hint for key %s: %v\n", key, err)
+	}
+}
+
+// Read the key here and from enough of its other replicas for the
+// consistency asked for, and return the newest version any of them holds. It
+// returns nil if none of them holds the key at all. Replicas found to be
+// behind are sent the newest version in the background.
+func (s *grpcServer) readReplicas(ctx context.Context, req *api.GetRequest) (*api.GetResponse, error) {
+	local, err := s.version(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	addrs, need := s.replicas(req.Key, req.Consistency)
+	if need == 0 {
+		return local, nil
+	}
+
+	var mu sync.Mutex
+	newest := local
+	replies := make(map[string]*api.GetResponse, len(addrs))
+	err = s.fanOut(ctx, addrs, need, func(ctx context.Context, addr string, client api.GodisServiceClient) error {
+		response, err := client.GetKey(ctx, &api.GetRequest{Key: req.Key, Deleted: true})
+		if status.Code(err) == codes.NotFound {
+			response, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		replies[addr] = response
+		if response != nil && newer(response, newest) {
+			newest = response
+		}
+		return nil
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil || newest == nil {
+		return newest, err
+	}
+
+	// Only the replicas that have answered by now are repaired
+	answered := make(map[string]*api.GetResponse, len(replies))
+	for addr, reply := range replies {
+		answered[addr] = reply
+	}
+	go s.readRepair(newest, local, answered)
+	return newest, nil
+}
+
+// The version of the key held here, deleted or not, or nil if the store holds
+// nothing for it
+func (s *grpcServer) version(key string) (*api.GetResponse, error) {
+	record, err := s.Config.Store.GetVersion(key)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	response := &api.GetResponse{
+		Key:       key,
+		Origin:    record.Origin,
+		OriginSeq: record.OriginSeq,
+		Timestamp: record.Timestamp,
+		Deleted:   record.Deleted,
+		Context:   record.Clock.Context()}
+	if !record.Deleted {
+		response.Value = record.Value
+		response.ExpireAt = store.UnixMilli(record.ExpireAt)
+		response.Siblings = store.APISiblings(record.Siblings)
+	}
+	return response, nil
+}
+
+// Whether a is a newer version of a key than b. A version whose vector clock
+// has seen the other's is newer; otherwise the later write wins, as it does
+// in the store.
+func newer(a, b *api.GetResponse) bool {
+	if b == nil {
+		return true
+	}
+	if len(a.Context) > 0 && len(b.Context) > 0 {
+		clockA, errA := store.ParseVectorClock(a.Context)
+		clockB, errB := store.ParseVectorClock(b.Context)
+		if errA == nil && errB == nil && !clockA.Equal(clockB) {
+			if clockA.Descends(clockB) {
+				return true
+			}
+			if clockB.Descends(clockA) {
+				return false
+			}
+		}
+	}
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp > b.Timestamp
+	}
+	return a.Origin > b.Origin
+}
+
+// Call fn on each of the nodes at once, returning as soon as need of them
+// have succeeded, or with codes.Unavailable once too many have failed for
+// that to happen. The nodes serve the requests themselves, rather than
+// forwarding them on.
+func (s *grpcServer) fanOut(ctx context.Context, addrs []string, need int, fn func(ctx context.Context, addr string, client api.GodisServiceClient) error) error {
+	if need > len(addrs) {
+		return status.Errorf(codes.Unavailable, "Need %d more replicas, only %d known", need, len(addrs))
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardedKey, "true")
+
+	results := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			client, err := s.client(addr)
+			if err == nil {
+				err = fn(ctx, addr, client)
+			}
+			results <- err
+		}(addr)
+	}
+
+	var succeeded, failed int
+	var errs []error
+	for range addrs {
+		err := <-results
+		if err == nil {
+			if succeeded++; succeeded == need {
+				return nil
+			}
+			continue
+		}
+		errs = append(errs, err)
+		if failed++; failed > len(addrs)-need {
+			break
+		}
+	}
+	return status.Errorf(codes.Unavailable, "Only %d of the %d more replicas needed answered: %v", succeeded, need, errors.Join(errs...))
+}
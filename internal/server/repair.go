@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	api "github.com/jscottransom/distributed_godis/api"
+	store "github.com/jscottransom/distributed_godis/internal/kvstore"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// How long to give a stale replica to take the newest version of a key
+const readRepairTimeout = 5 * time.Second
+
+var (
+	readRepairs = stats.Int64("godis/read_repairs", "Stale replicas sent the newest version of a key on a read", stats.UnitDimensionless)
+
+	readRepairViews = []*view.View{{
+		Name:        "godis/read_repairs",
+		Description: "Stale replicas sent the newest version of a key on a read",
+		Measure:     readRepairs,
+		Aggregation: view.Count(),
+	}}
+)
+
+// Write the newest version of a key a read found back to the replicas that
+// answered with an older one, or without the key at all. The local replica
+// is written to directly, and is stale if local is.
+func (s *grpcServer) readRepair(newest, local *api.GetResponse, replies map[string]*api.GetResponse) {
+	ctx, cancel := context.WithTimeout(context.Background(), readRepairTimeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardedKey, "true")
+
+	if stale(newest, local) {
+		if err := s.repairLocal(newest); err != nil {
+			log.Printf("Unable to repair key %s: %v\n", newest.Key, err)
+		} else {
+			stats.Record(ctx, readRepairs.M(1))
+		}
+	}
+	for addr, reply := range replies {
+		if !stale(newest, reply) {
+			continue
+		}
+		if err := s.repairReplica(ctx, addr, newest); err != nil {
+			log.Printf("Unable to repair key %s on %s: %v\n", newest.Key, addr, err)
+			continue
+		}
+		stats.Record(ctx, readRepairs.M(1))
+	}
+}
+
+// Whether a replica that answered a read with reply is behind newest
+func stale(newest, reply *api.GetResponse) bool {
+	return reply == nil || newer(newest, reply)
+}
+
+func (s *grpcServer) repairLocal(newest *api.GetResponse) error {
+	clock, err := store.ParseVectorClock(newest.Context)
+	if err != nil {
+		return err
+	}
+	record := store.Record{Key: newest.Key,
+		Origin:    newest.Origin,
+		OriginSeq: newest.OriginSeq,
+		Timestamp: newest.Timestamp,
+		Clock:     clock}
+	if newest.Deleted {
+		err = s.Config.Store.DeleteRecord(record)
+	} else {
+		record.Value = newest.Value
+		record.ExpireAt = expiry(0, newest.ExpireAt)
+		if record.Siblings, err = store.ParseSiblings(newest.Siblings); err != nil {
+			return err
+		}
+		err = s.Config.Store.Set(record)
+	}
+	// A newer write has reached the replica since
+	if errors.Is(err, store.ErrStaleRecord) {
+		return nil
+	}
+	return err
+}
+
+func (s *grpcServer) repairReplica(ctx context.Context, addr string, newest *api.GetResponse) error {
+	client, err := s.client(addr)
+	if err != nil {
+		return err
+	}
+	if newest.Deleted {
+		_, err = client.DeleteKey(ctx, &api.DeleteRequest{Key: newest.Key,
+			Origin:    newest.Origin,
+			OriginSeq: newest.OriginSeq,
+			Timestamp: newest.Timestamp,
+			Context:   newest.Context})
+	} else {
+		_, err = client.SetKey(ctx, &api.SetRequest{Key: newest.Key,
+			Value:     newest.Value,
+			ExpireAt:  newest.ExpireAt,
+			Origin:    newest.Origin,
+			OriginSeq: newest.OriginSeq,
+			Timestamp: newest.Timestamp,
+			Context:   newest.Context,
+			Siblings:  newest.Siblings})
+	}
+	if status.Code(err) == codes.Aborted {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	api "github.com/jscottransom/distributed_godis/api"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Reason given in the ErrorInfo of a write rejected by a read-only
+	// replica
+	ReasonReadOnlyReplica = "READ_ONLY_REPLICA"
+	// Key in the ErrorInfo metadata holding the RPC address of a node to
+	// make the write on instead
+	WriteAddrKey = "write_addr"
+	errorDomain  = "godis"
+)
+
+// Reject a write a client made on a read-only replica, telling it where to
+// make the write instead. Writes replicated or forwarded from other nodes,
+// which only peers may make, are taken as usual.
+func (s *grpcServer) readOnly(ctx context.Context, origin string) error {
+	if !s.Config.Replica || origin != "" || s.forwarded(ctx) {
+		return nil
+	}
+	st := status.New(codes.FailedPrecondition, "Read-only replica takes no writes")
+	info := &errdetails.ErrorInfo{Reason: ReasonReadOnlyReplica, Domain: errorDomain}
+	if addr := s.writeAddr(); addr != "" {
+		info.Metadata = map[string]string{WriteAddrKey: addr}
+	}
+	if detailed, err := st.WithDetails(info); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// The address of a node that takes writes: the leader if there is one, or
+// else any member that is not a replica. It returns "" if there is none.
+func (s *grpcServer) writeAddr() string {
+	if s.Config.ServerLister == nil {
+		return ""
+	}
+	servers, err := s.Config.ServerLister.GetServers()
+	if err != nil {
+		return ""
+	}
+	var addr string
+	for _, server := range servers {
+		switch server.Role {
+		case api.Role_LEADER:
+			return server.RpcAddr
+		case api.Role_REPLICA:
+		default:
+			if addr == "" {
+				addr = server.RpcAddr
+			}
+		}
+	}
+	return addr
+}
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -22,19 +24,116 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 type Config struct {
-	Store      *store.KVstore
+	Store      Store
 	Authorizer Authorizer
+	// Used to forward writes to the leader, when the store has one
+	DialOptions []grpc.DialOption
+	// Runs anti-entropy with the peers on demand, when replicas copy from
+	// each other
+	Repairer Repairer
+	// Used to forward requests for keys stored on other nodes, when the
+	// keyspace is partitioned across the cluster
+	Router Router
+	// Tells which nodes hold a key, so anti-entropy only compares the keys
+	// a peer shares
+	Placement Placement
+	// Keeps writes for the owners of a key that are down, to hand off once
+	// they are back
+	Hinter Hinter
+	// Lists the members of the cluster for clients
+	ServerLister ServerLister
+	// Serve as a read-only replica, which takes writes replicated from the
+	// other nodes but rejects those made by clients
+	Replica bool
+	// Reports how far the peers have been replicated, when replicas copy
+	// from each other
+	ReplicationReporter ReplicationReporter
+}
+
+// Store is the key value store the server serves, either a local
+// store.KVstore or a replicated store.DistributedKVstore
+type Store interface {
+	Set(record store.Record) error
+	Get(key string) ([]byte, error)
+	GetRecord(key string) (store.Record, error)
+	GetVersion(key string) (store.LogRecord, error)
+	Delete(key string) error
+	DeleteRecord(record store.Record) error
+	Keys() []string
+	Tombstones() []string
+	Merge() (uint64, error)
+	Expire(key string, at time.Time) error
+	Persist(key string) error
+	TTL(key string) (time.Duration, error)
+	NewLogReader(from uint64) *store.LogReader
+	LastOffset() uint64
+	Appended() <-chan struct{}
+	MerkleTree(keep func(key string) bool) (store.MerkleTree, error)
+	RangeRecords(buckets []uint32, keep func(key string) bool) ([]store.LogRecord, error)
+	Snapshot() (*store.Snapshot, error)
+}
+
+// Repairer brings the replicas back in line after they drift apart
+type Repairer interface {
+	AntiEntropy(ctx context.Context) (uint64, error)
+}
+
+// Router finds the nodes a key is stored on
+type Router interface {
+	// OwnerAddrs returns the RPC addresses of the nodes the key is stored
+	// on, and whether this node is one of them
+	OwnerAddrs(key string) ([]string, bool)
+}
+
+// Placement tells which nodes a key is stored on
+type Placement interface {
+	// OwnedBy reports whether the key is stored on every one of the nodes
+	OwnedBy(key string, names ...string) bool
+	// HoldAll reports whether every key is stored on every one of the nodes
+	HoldAll(names ...string) bool
+}
+
+// Hinter queues a write for the owners of its key that are down
+type Hinter interface {
+	Hint(record store.LogRecord) error
+}
+
+// ServerLister lists the members of the cluster clients can reach
+type ServerLister interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// ReplicationReporter reports how far the log of each peer has been
+// replicated
+type ReplicationReporter interface {
+	ReplicationStatus() []store.PeerStatus
+}
+
+// A store replicated through a leader, which only takes writes on the leader
+type leaderStore interface {
+	IsLeader() bool
+	Leader() string
 }
 
 const (
 	objectWildCard = "*"
 	setgetAction   = "setget"
 	listAction     = "list"
+
+	// Taken by peers, to make writes replicated from other nodes and to
+	// forward requests to the nodes that serve them, and to run the
+	// anti-entropy and merges that rewrite the store on demand
+	replicateAction = "replicate"
+
+	// Metadata marking a request forwarded from the node it was made on,
+	// which the owner serves itself rather than forwarding it again
+	forwardedKey = "godis-forwarded"
 )
 
 type Authorizer interface {
@@ -44,6 +143,9 @@ type Authorizer interface {
 type grpcServer struct {
 	api.UnimplementedGodisServiceServer
 	*Config
+	mu     sync.Mutex
+	leader *grpc.ClientConn // Connection to the leader writes are forwarded to
+	owners map[string]*grpc.ClientConn // Connections to the other nodes requests go to, by address
 }
 
 // Build a new grpc server
@@ -71,6 +173,9 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 	if err != nil {
 		return nil, err
 	}
+	if err := view.Register(readRepairViews...); err != nil {
+		return nil, err
+	}
 	opts = append(opts,
 		grpc.StreamInterceptor(
 			grpc_middleware.ChainStreamServer(
@@ -105,7 +210,7 @@ func InitGRPCServer(port string, dir string, filename string, uid uint64) (*grpc
 		return nil, err
 	}
 
-	kvstore, err := store.NewKVstore(dir, filename)
+	kvstore, err := store.NewKVstore(dir, filename, store.Config{})
 	if err != nil {
 		log.Fatalf("failed to create store: %s", err)
 	}
@@ -131,15 +236,72 @@ func (s *grpcServer) SetKey(ctx context.Context, req *api.SetRequest) (*api.SetR
 		return nil, err
 	}
 
+	if err := s.authorizeReplicated(ctx, req.Origin, req.Timestamp); err != nil {
+		return nil, err
+	}
+
+	// Siblings come from the node that kept them, along with the rest of the
+	// write they were replicated with, never from a client
+	if len(req.Siblings) > 0 && req.Origin == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Siblings for key %s sent without the write they belong to", req.Key)
+	}
+
+	if err := s.readOnly(ctx, req.Origin); err != nil {
+		return nil, err
+	}
+
+	// Replicated writes are only ever sent to owners
+	if req.Origin == "" {
+		if resp, routed, err := route(s, ctx, req.Key, func(ctx context.Context, owner api.GodisServiceClient) (*api.SetResponse, error) {
+			return owner.SetKey(ctx, req)
+		}); routed {
+			return resp, err
+		}
+	}
+
+	if leader, err := s.forward(); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.SetKey(ctx, req)
+	}
+
+	clock, err := store.ParseVectorClock(req.Context)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Bad context for key %s: %v", req.Key, err)
+	}
+	siblings, err := store.ParseSiblings(req.Siblings)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Bad siblings for key %s: %v", req.Key, err)
+	}
+
 	// Set the key in the store
 	record := store.Record{Key: req.Key,
-		Value: req.Value}
-
-	err := s.Config.Store.Set(record)
+		Value:     req.Value,
+		ExpireAt:  expiry(req.TtlMs, req.ExpireAt),
+		Origin:    req.Origin,
+		OriginSeq: req.OriginSeq,
+		Timestamp: req.Timestamp,
+		Clock:     clock,
+		Siblings:  siblings}
+
+	err = s.Config.Store.Set(record)
+	if errors.Is(err, store.ErrStaleRecord) {
+		return nil, status.Errorf(codes.Aborted, "Key %s has a newer version", req.Key)
+	}
+	if errors.Is(err, store.ErrRecordTooLarge) {
+		return nil, status.Errorf(codes.InvalidArgument, "Bad record for key %s: %v", req.Key, err)
+	}
 	if err != nil {
 		fmt.Printf("Unable to set key: %s", req.Key)
 		return nil, err
 	}
+	if req.Origin == "" {
+		s.hint(req.Key)
+	}
+	if err := s.replicateWrite(ctx, req.Key, req.Consistency); err != nil {
+		return nil, err
+	}
 
 	// Set the satisfactory message
 	msg := "OK"
@@ -153,33 +315,98 @@ func (s *grpcServer) GetKey(ctx context.Context, req *api.GetRequest) (*api.GetR
 		return nil, err
 	}
 
-	// Get the key in the store
-	val, err := s.Config.Store.Get(req.Key)
+	if resp, routed, err := route(s, ctx, req.Key, func(ctx context.Context, owner api.GodisServiceClient) (*api.GetResponse, error) {
+		return owner.GetKey(ctx, req)
+	}); routed {
+		return resp, err
+	}
+
+	// Get the key in the store, and its other replicas if asked to
+	response, err := s.readReplicas(ctx, req)
 	if err != nil {
 		fmt.Printf("Unable to get key: %s", req.Key)
+		if errors.Is(err, store.ErrCorruptRecord) {
+			return nil, status.Errorf(codes.DataLoss, "Failed to read key %s: %v", req.Key, err)
+		}
 		return nil, err
 	}
+	if response == nil || (response.Deleted && !req.Deleted) {
+		return nil, status.Errorf(codes.NotFound, "Key %s not found", req.Key)
+	}
 
-	return &api.GetResponse{
-		Key: req.Key,
-		Value: val}, nil
+	return response, nil
 
 }
 
-func (s *grpcServer) ListKeys(ctx context.Context, req *api.ListRequest) (*api.ListResponse, error) {
-	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, listAction); err != nil {
+func (s *grpcServer) DeleteKey(ctx context.Context, req *api.DeleteRequest) (*api.DeleteResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, setgetAction); err != nil {
 		log.Printf("Error is %s{}\n", err)
 		return nil, err
 	}
 
-	keylist := []string{}
+	if err := s.authorizeReplicated(ctx, req.Origin, req.Timestamp); err != nil {
+		return nil, err
+	}
+
+	if err := s.readOnly(ctx, req.Origin); err != nil {
+		return nil, err
+	}
+
+	if req.Origin == "" {
+		if resp, routed, err := route(s, ctx, req.Key, func(ctx context.Context, owner api.GodisServiceClient) (*api.DeleteResponse, error) {
+			return owner.DeleteKey(ctx, req)
+		}); routed {
+			return resp, err
+		}
+	}
+
+	if leader, err := s.forward(); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.DeleteKey(ctx, req)
+	}
+
+	clock, err := store.ParseVectorClock(req.Context)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Bad context for key %s: %v", req.Key, err)
+	}
+
+	// Delete the key from the store
+	err = s.Config.Store.DeleteRecord(store.Record{Key: req.Key,
+		Origin:    req.Origin,
+		OriginSeq: req.OriginSeq,
+		Timestamp: req.Timestamp,
+		Clock:     clock})
+	if errors.Is(err, store.ErrStaleRecord) {
+		return nil, status.Errorf(codes.Aborted, "Key %s has a newer version", req.Key)
+	}
+	if errors.Is(err, store.ErrRecordTooLarge) {
+		return nil, status.Errorf(codes.InvalidArgument, "Bad record for key %s: %v", req.Key, err)
+	}
+	if err != nil {
+		fmt.Printf("Unable to delete key: %s", req.Key)
+		return nil, err
+	}
+	if req.Origin == "" {
+		s.hint(req.Key)
+	}
+
+	msg := "OK"
+	return &api.DeleteResponse{Response: msg}, nil
+
+}
 
-	// Iterate through the list of keys
-	for k := range s.Config.Store.Keymap.Map {
-		keylist = append(keylist, k)
+func (s *grpcServer) ListKeys(ctx context.Context, req *api.ListRequest) (*api.ListResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, listAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return nil, err
 	}
 
-	return &api.ListResponse{Key: keylist}, nil
+	// Deleted keys are listed separately, so replicas can carry the delete
+	return &api.ListResponse{
+		Key:     s.Config.Store.Keys(),
+		Deleted: s.Config.Store.Tombstones()}, nil
 
 }
 
@@ -229,6 +456,9 @@ func (s *grpcServer) GetStream(req *api.MultiGetRequest, stream grpc.ServerStrea
 		
 		
 		if err != nil {
+			if _, ok := status.FromError(err); ok {
+				return err
+			}
             return status.Errorf(codes.Internal, "Failed to retrieve key %s: %v", key, err)
         }
         
@@ -240,6 +470,412 @@ func (s *grpcServer) GetStream(req *api.MultiGetRequest, stream grpc.ServerStrea
 	return nil
 }
 
+// Stream the store's log from the requested offset, then keep the stream
+// open and send records as they are appended
+func (s *grpcServer) ConsumeLog(req *api.ConsumeRequest, stream grpc.ServerStreamingServer[api.LogRecord]) error {
+	if err := s.Authorizer.Authorize(subject(stream.Context()), objectWildCard, setgetAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return err
+	}
+
+	reader := s.Config.Store.NewLogReader(req.FromOffset)
+	for {
+		// Watch for appends before reading, so none slip in between
+		appended := s.Config.Store.Appended()
+		records, err := reader.Read(1000)
+		if err != nil {
+			return status.Errorf(codes.Internal, "Failed to read log: %v", err)
+		}
+		last := s.Config.Store.LastOffset()
+		for _, record := range records {
+			out := store.APIRecord(record)
+			out.LastOffset = max(last, record.Offset)
+			if err := stream.Send(out); err != nil {
+				return err
+			}
+		}
+		if len(records) > 0 {
+			continue
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-appended:
+		}
+	}
+}
+
+// The Merkle tree over the store, for a peer to compare with its own
+func (s *grpcServer) GetMerkleTree(ctx context.Context, req *api.MerkleTreeRequest) (*api.MerkleTreeResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, setgetAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return nil, err
+	}
+
+	tree, err := s.Config.Store.MerkleTree(s.ownedBy(req.Owners))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to build merkle tree: %v", err)
+	}
+	return &api.MerkleTreeResponse{Nodes: tree}, nil
+}
+
+func (s *grpcServer) ConsumeRange(req *api.RangeRequest, stream grpc.ServerStreamingServer[api.LogRecord]) error {
+	if err := s.Authorizer.Authorize(subject(stream.Context()), objectWildCard, setgetAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return err
+	}
+
+	records, err := s.Config.Store.RangeRecords(req.Buckets, s.ownedBy(req.Owners))
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to read ranges: %v", err)
+	}
+	for _, record := range records {
+		if err := stream.Send(store.APIRecord(record)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pick out the keys stored on every one of the owners, or every key if none
+// are named, they all hold every key, or the server does not know where keys
+// are stored
+func (s *grpcServer) ownedBy(owners []string) func(key string) bool {
+	if len(owners) == 0 || s.Config.Placement == nil || s.Config.Placement.HoldAll(owners...) {
+		return nil
+	}
+	return func(key string) bool { return s.Config.Placement.OwnedBy(key, owners...) }
+}
+
+// Run anti-entropy with the peers now, rather than waiting for the next round
+func (s *grpcServer) AntiEntropy(ctx context.Context, req *api.AntiEntropyRequest) (*api.AntiEntropyResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, replicateAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return nil, err
+	}
+
+	if s.Config.Repairer == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Anti-entropy is not running on this server")
+	}
+	repaired, err := s.Config.Repairer.AntiEntropy(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "Failed to run anti-entropy: %v", err)
+	}
+	return &api.AntiEntropyResponse{Repaired: repaired}, nil
+}
+
+// Size of the pieces snapshots are sent in
+const snapshotChunkSize = 1 << 20
+
+// Send a point-in-time copy of the store's files, which a new node loads in
+// place of replaying the log
+func (s *grpcServer) StreamSnapshot(req *api.SnapshotRequest, stream grpc.ServerStreamingServer[api.SnapshotChunk]) error {
+	if err := s.Authorizer.Authorize(subject(stream.Context()), objectWildCard, setgetAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return err
+	}
+
+	// Taken before the snapshot, so every record the peers' cursors have
+	// passed is in it
+	cursors := s.replicationCursors()
+	snapshot, err := s.Config.Store.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	return snapshot.Chunks(snapshotChunkSize, func(name string, data []byte) error {
+		return stream.Send(&api.SnapshotChunk{File: name, Data: data, Seq: snapshot.Seq, Cursors: cursors})
+	})
+}
+
+// The offset to carry on replicating each peer from, past every record
+// applied from it so far
+func (s *grpcServer) replicationCursors() map[string]uint64 {
+	if s.Config.ReplicationReporter == nil {
+		return nil
+	}
+	cursors := make(map[string]uint64)
+	for _, peer := range s.Config.ReplicationReporter.ReplicationStatus() {
+		if peer.Applied > 0 {
+			cursors[peer.Name] = peer.Applied + 1
+		}
+	}
+	return cursors
+}
+
+// List the members of the cluster, for clients to spread requests across
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, listAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return nil, err
+	}
+
+	if s.Config.ServerLister == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "This server is not part of a cluster")
+	}
+	servers, err := s.Config.ServerLister.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+// Report how far the node has replicated each of its peers
+func (s *grpcServer) ReplicationStatus(ctx context.Context, req *api.ReplicationStatusRequest) (*api.ReplicationStatusResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, listAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return nil, err
+	}
+
+	if s.Config.ReplicationReporter == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "This server does not replicate from peers")
+	}
+	response := &api.ReplicationStatusResponse{}
+	for _, peer := range s.Config.ReplicationReporter.ReplicationStatus() {
+		out := &api.PeerReplication{
+			Name:          peer.Name,
+			RpcAddr:       peer.Addr,
+			State:         peer.State,
+			AppliedOffset: peer.Applied,
+			PeerOffset:    peer.PeerOffset,
+			Lag:           peer.Lag(),
+			Records:       peer.Records,
+			Bytes:         peer.Bytes,
+		}
+		if peer.LastError != nil {
+			out.LastError = peer.LastError.Error()
+			out.LastErrorAt = peer.LastErrorAt.UnixMilli()
+		}
+		response.Peers = append(response.Peers, out)
+	}
+	return response, nil
+}
+
+// Merge the store on demand, rather than waiting on its thresholds
+func (s *grpcServer) Compact(ctx context.Context, req *api.CompactRequest) (*api.CompactResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, replicateAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return nil, err
+	}
+
+	reclaimed, err := s.Config.Store.Merge()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to compact store: %v", err)
+	}
+
+	return &api.CompactResponse{Reclaimed: reclaimed}, nil
+}
+
+// Set when the key expires
+func (s *grpcServer) Expire(ctx context.Context, req *api.ExpireRequest) (*api.ExpireResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, setgetAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return nil, err
+	}
+
+	if err := s.readOnly(ctx, ""); err != nil {
+		return nil, err
+	}
+
+	at := expiry(req.TtlMs, req.ExpireAt)
+	if at.IsZero() {
+		return nil, status.Errorf(codes.InvalidArgument, "Expire needs a ttl or expiry time for key %s", req.Key)
+	}
+	if resp, routed, err := route(s, ctx, req.Key, func(ctx context.Context, owner api.GodisServiceClient) (*api.ExpireResponse, error) {
+		return owner.Expire(ctx, &api.ExpireRequest{Key: req.Key, ExpireAt: at.UnixMilli()})
+	}); routed {
+		return resp, err
+	}
+	if leader, err := s.forward(); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.Expire(ctx, &api.ExpireRequest{Key: req.Key, ExpireAt: at.UnixMilli()})
+	}
+	if err := s.Config.Store.Expire(req.Key, at); err != nil {
+		if errors.Is(err, store.ErrKeyNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Key %s not found", req.Key)
+		}
+		return nil, err
+	}
+	s.hint(req.Key)
+
+	return &api.ExpireResponse{Response: "OK"}, nil
+}
+
+// Remove the expiry from a key
+func (s *grpcServer) Persist(ctx context.Context, req *api.PersistRequest) (*api.PersistResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, setgetAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return nil, err
+	}
+
+	if err := s.readOnly(ctx, ""); err != nil {
+		return nil, err
+	}
+
+	if resp, routed, err := route(s, ctx, req.Key, func(ctx context.Context, owner api.GodisServiceClient) (*api.PersistResponse, error) {
+		return owner.Persist(ctx, req)
+	}); routed {
+		return resp, err
+	}
+
+	if leader, err := s.forward(); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.Persist(ctx, req)
+	}
+
+	if err := s.Config.Store.Persist(req.Key); err != nil {
+		if errors.Is(err, store.ErrKeyNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Key %s not found", req.Key)
+		}
+		return nil, err
+	}
+	s.hint(req.Key)
+
+	return &api.PersistResponse{Response: "OK"}, nil
+}
+
+// Get how long a key has left before it expires
+func (s *grpcServer) TTL(ctx context.Context, req *api.TTLRequest) (*api.TTLResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, setgetAction); err != nil {
+		log.Printf("Error is %s{}\n", err)
+		return nil, err
+	}
+
+	if resp, routed, err := route(s, ctx, req.Key, func(ctx context.Context, owner api.GodisServiceClient) (*api.TTLResponse, error) {
+		return owner.TTL(ctx, req)
+	}); routed {
+		return resp, err
+	}
+
+	ttl, err := s.Config.Store.TTL(req.Key)
+	if err != nil {
+		if errors.Is(err, store.ErrKeyNotFound) {
+			return nil, status.Errorf(codes.NotFound, "Key %s not found", req.Key)
+		}
+		return nil, err
+	}
+	if ttl == store.NoExpiry {
+		return &api.TTLResponse{TtlMs: -1}, nil
+	}
+
+	return &api.TTLResponse{TtlMs: ttl.Milliseconds()}, nil
+}
+
+// Get a client for the leader if writes have to be forwarded to it, or nil
+// if they can be made here
+func (s *grpcServer) forward() (api.GodisServiceClient, error) {
+	ls, ok := s.Config.Store.(leaderStore)
+	if !ok || ls.IsLeader() {
+		return nil, nil
+	}
+	addr := ls.Leader()
+	if addr == "" {
+		return nil, status.Errorf(codes.Unavailable, "No leader to take writes")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leader == nil || s.leader.Target() != addr {
+		if s.leader != nil {
+			s.leader.Close()
+		}
+		conn, err := grpc.Dial(addr, s.Config.DialOptions...)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "Failed to reach leader %s: %v", addr, err)
+		}
+		s.leader = conn
+	}
+	return api.NewGodisServiceClient(s.leader), nil
+}
+
+// Send the request to an owner of the key if the key is stored on other
+// nodes, and report whether it was. The owners are tried in ring order,
+// moving on while one cannot be reached. Requests forwarded from another node
+// are always served here, so a request is never forwarded twice.
+func route[T any](s *grpcServer, ctx context.Context, key string, call func(ctx context.Context, owner api.GodisServiceClient) (T, error)) (T, bool, error) {
+	var resp T
+	if s.Config.Router == nil || s.forwarded(ctx) {
+		return resp, false, nil
+	}
+	addrs, local := s.Config.Router.OwnerAddrs(key)
+	if local {
+		return resp, false, nil
+	}
+	if len(addrs) == 0 {
+		return resp, true, status.Errorf(codes.Unavailable, "No owner for key %s", key)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardedKey, "true")
+	var err error
+	for _, addr := range addrs {
+		var owner api.GodisServiceClient
+		if owner, err = s.client(addr); err != nil {
+			err = status.Errorf(codes.Unavailable, "Failed to reach owner %s of key %s: %v", addr, key, err)
+			continue
+		}
+		if resp, err = call(ctx, owner); status.Code(err) != codes.Unavailable {
+			return resp, true, err
+		}
+	}
+	return resp, true, err
+}
+
+// Whether the request was forwarded from another node. Only peers may
+// forward requests, so the mark is ignored on a request from anyone else.
+func (s *grpcServer) forwarded(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(forwardedKey)) == 0 {
+		return false
+	}
+	return s.Authorizer.Authorize(subject(ctx), objectWildCard, replicateAction) == nil
+}
+
+// A write carrying the origin and timestamp it was first made with is
+// replicated from another node, which only peers may do: the version decides
+// which write to a key wins everywhere.
+func (s *grpcServer) authorizeReplicated(ctx context.Context, origin string, timestamp int64) error {
+	if origin == "" && timestamp == 0 {
+		return nil
+	}
+	return s.Authorizer.Authorize(subject(ctx), objectWildCard, replicateAction)
+}
+
+// Get a client for another node, over a connection kept open for the
+// requests to come
+func (s *grpcServer) client(addr string) (api.GodisServiceClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn, ok := s.owners[addr]
+	if !ok {
+		var err error
+		if conn, err = grpc.Dial(addr, s.Config.DialOptions...); err != nil {
+			return nil, err
+		}
+		if s.owners == nil {
+			s.owners = make(map[string]*grpc.ClientConn)
+		}
+		s.owners[addr] = conn
+	}
+	return api.NewGodisServiceClient(conn), nil
+}
+
+// The expiry for a relative ttl or absolute time in Unix milliseconds,
+// preferring the absolute time. The zero time means no expiry.
+func expiry(ttlMs, expireAt int64) time.Time {
+	if expireAt > 0 {
+		return time.UnixMilli(expireAt)
+	}
+	if ttlMs > 0 {
+		return time.Now().Add(time.Duration(ttlMs) * time.Millisecond)
+	}
+	return time.Time{}
+}
+
 func authenticate(ctx context.Context) (context.Context, error) {
 	peer, ok := peer.FromContext(ctx)
 	if !ok {
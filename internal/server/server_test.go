@@ -15,10 +15,14 @@ import (
 	store "github.com/jscottransom/distributed_godis/internal/kvstore"
 	"github.com/stretchr/testify/require"
 	"go.opencensus.io/examples/exporter"
+	"go.opencensus.io/stats/view"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -47,6 +51,11 @@ func TestServer(t *testing.T) {
 		"List all keys from store succeeds": testListKey,
 		"Unauthorized Fails":                testUnauthorized,
 		"Set and Get Stream": testSetGetStream,
+		"Delete a Key from store succeeds":  testDeleteKey,
+		"Compact the store succeeds":        testCompact,
+		"Keys expire after their TTL":       testExpire,
+		"Consume the log as it grows":       testConsumeLog,
+		"Compare replicas by merkle tree":   testMerkleTree,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient,
@@ -60,7 +69,7 @@ func TestServer(t *testing.T) {
 	}
 }
 
-func setupTest(t *testing.T, fn func(*Config)) (
+func setupTest(t *testing.T, fn func(config *Config, addr string)) (
 	rootClient api.GodisServiceClient,
 	nobodyClient api.GodisServiceClient,
 	cfg *Config,
@@ -118,7 +127,8 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	}
 
 	var rootConn *grpc.ClientConn
-	rootConn, rootClient, _ = newClient(
+	var rootOpts []grpc.DialOption
+	rootConn, rootClient, rootOpts = newClient(
 		config.RootClientCertFile,
 		config.RootClientKeyFile,
 	)
@@ -146,14 +156,16 @@ func setupTest(t *testing.T, fn func(*Config)) (
 
 	t.Log(dir)
 
-	kvstore, err := store.NewKVstore(dir, "testStore")
+	kvstore, err := store.NewKVstore(dir, "testStore", store.Config{})
 	require.NoError(t, err)
 
+	// Other servers are reached as root
 	cfg = &Config{Store: kvstore,
-		Authorizer: authorizer}
+		Authorizer:  authorizer,
+		DialOptions: rootOpts}
 
 	if fn != nil {
-		fn(cfg)
+		fn(cfg, l.Addr().String())
 	}
 
 	server, err := NewGRPCServer(cfg, grpc.Creds(serverCreds))
@@ -277,6 +289,130 @@ func testSetGetStream(
 }
 
 
+func testDeleteKey(t *testing.T, client, _ api.GodisServiceClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.SetKey(ctx, &api.SetRequest{Key: "hello",
+		Value: []byte("world")})
+	require.NoError(t, err)
+
+	_, err = client.DeleteKey(ctx, &api.DeleteRequest{Key: "hello"})
+	require.NoError(t, err)
+
+	get, err := client.GetKey(ctx, &api.GetRequest{Key: "hello"})
+	require.Nil(t, get)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.ListKeys(ctx, &api.ListRequest{})
+	require.NoError(t, err)
+	require.Empty(t, list.Key)
+	require.Equal(t, []string{"hello"}, list.Deleted)
+}
+func testCompact(t *testing.T, client, _ api.GodisServiceClient, config *Config) {
+	ctx := context.Background()
+
+	for _, value := range []string{"world", "again"} {
+		_, err := client.SetKey(ctx, &api.SetRequest{Key: "hello",
+			Value: []byte(value)})
+		require.NoError(t, err)
+	}
+
+	compact, err := client.Compact(ctx, &api.CompactRequest{})
+	require.NoError(t, err)
+	require.NotZero(t, compact.Reclaimed)
+
+	get, err := client.GetKey(ctx, &api.GetRequest{Key: "hello"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("again"), get.Value)
+}
+
+func testExpire(t *testing.T, client, _ api.GodisServiceClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.SetKey(ctx, &api.SetRequest{Key: "session",
+		Value: []byte("token"),
+		TtlMs: 100})
+	require.NoError(t, err)
+	_, err = client.SetKey(ctx, &api.SetRequest{Key: "hello",
+		Value: []byte("world")})
+	require.NoError(t, err)
+
+	get, err := client.GetKey(ctx, &api.GetRequest{Key: "session"})
+	require.NoError(t, err)
+	require.NotZero(t, get.ExpireAt)
+	ttl, err := client.TTL(ctx, &api.TTLRequest{Key: "session"})
+	require.NoError(t, err)
+	require.True(t, ttl.TtlMs > 0 && ttl.TtlMs <= 100)
+	ttl, err = client.TTL(ctx, &api.TTLRequest{Key: "hello"})
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), ttl.TtlMs)
+
+	// An expiry can be added to a key and taken away again
+	_, err = client.Expire(ctx, &api.ExpireRequest{Key: "hello", TtlMs: 60000})
+	require.NoError(t, err)
+	ttl, err = client.TTL(ctx, &api.TTLRequest{Key: "hello"})
+	require.NoError(t, err)
+	require.True(t, ttl.TtlMs > 0)
+	_, err = client.Persist(ctx, &api.PersistRequest{Key: "hello"})
+	require.NoError(t, err)
+	ttl, err = client.TTL(ctx, &api.TTLRequest{Key: "hello"})
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), ttl.TtlMs)
+
+	_, err = client.Expire(ctx, &api.ExpireRequest{Key: "hello"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Expire(ctx, &api.ExpireRequest{Key: "missing", TtlMs: 100})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Expired keys are hidden straight away
+	time.Sleep(150 * time.Millisecond)
+	get, err = client.GetKey(ctx, &api.GetRequest{Key: "session"})
+	require.Nil(t, get)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.TTL(ctx, &api.TTLRequest{Key: "session"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	list, err := client.ListKeys(ctx, &api.ListRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"hello"}, list.Key)
+}
+
+func testConsumeLog(t *testing.T, client, _ api.GodisServiceClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := client.SetKey(ctx, &api.SetRequest{Key: "hello",
+		Value: []byte("world")})
+	require.NoError(t, err)
+	_, err = client.DeleteKey(ctx, &api.DeleteRequest{Key: "hello"})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeLog(ctx, &api.ConsumeRequest{FromOffset: 0})
+	require.NoError(t, err)
+	record, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+	require.Equal(t, []byte("world"), record.Value)
+	record, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+	require.True(t, record.Deleted)
+
+	// The stream stays open for records appended later
+	_, err = client.SetKey(ctx, &api.SetRequest{Key: "strange",
+		Value: []byte("fruits")})
+	require.NoError(t, err)
+	record, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), record.Offset)
+	require.Equal(t, "strange", record.Key)
+
+	// And can start part way through
+	stream, err = client.ConsumeLog(ctx, &api.ConsumeRequest{FromOffset: 3})
+	require.NoError(t, err)
+	record, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), record.Offset)
+}
 
 func testUnauthorized(t *testing.T, _, client api.GodisServiceClient, config *Config) {
 
@@ -302,3 +438,312 @@ func testUnauthorized(t *testing.T, _, client api.GodisServiceClient, config *Co
 		t.Fatalf("got cod: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+func testMerkleTree(t *testing.T, client, _ api.GodisServiceClient, config *Config) {
+	ctx := context.Background()
+
+	empty, err := client.GetMerkleTree(ctx, &api.MerkleTreeRequest{})
+	require.NoError(t, err)
+	_, err = client.SetKey(ctx, &api.SetRequest{Key: "hello", Value: []byte("world")})
+	require.NoError(t, err)
+	tree, err := client.GetMerkleTree(ctx, &api.MerkleTreeRequest{})
+	require.NoError(t, err)
+	require.Equal(t, len(empty.Nodes), len(tree.Nodes))
+
+	// Only the range holding the new key differs
+	buckets := store.MerkleTree(tree.Nodes).Diff(empty.Nodes)
+	require.Equal(t, []uint32{store.Bucket("hello")}, buckets)
+	stream, err := client.ConsumeRange(ctx, &api.RangeRequest{Buckets: buckets})
+	require.NoError(t, err)
+	record, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "hello", record.Key)
+	require.Equal(t, []byte("world"), record.Value)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// There are no peers to repair from without a replicator
+	_, err = client.AntiEntropy(ctx, &api.AntiEntropyRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+// Places every key here and on the other replicas
+type replicaRouter []string
+
+func (r replicaRouter) OwnerAddrs(key string) ([]string, bool) {
+	return r, true
+}
+
+// Places every key on the other nodes, in order
+type remoteRouter []string
+
+func (r remoteRouter) OwnerAddrs(key string) ([]string, bool) {
+	return r, false
+}
+
+func TestRouteFallback(t *testing.T) {
+	var addr string
+	_, _, owner, teardown := setupTest(t, func(_ *Config, a string) {
+		addr = a
+	})
+	defer teardown()
+
+	// The first owner is down, so requests go on to the next
+	client, _, config, teardown := setupTest(t, func(config *Config, _ string) {
+		config.Router = remoteRouter{"127.0.0.1:1", addr}
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.SetKey(ctx, &api.SetRequest{Key: "key", Value: []byte("value")})
+	require.NoError(t, err)
+	value, err := owner.Store.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	require.Empty(t, config.Store.Keys())
+	get, err := client.GetKey(ctx, &api.GetRequest{Key: "key"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), get.Value)
+}
+
+// Places the keys it holds on every node, and the rest elsewhere
+type placement map[string]bool
+
+func (p placement) OwnedBy(key string, names ...string) bool {
+	return p[key]
+}
+
+func (p placement) HoldAll(names ...string) bool {
+	return false
+}
+
+func TestSharedMerkleTree(t *testing.T) {
+	client, _, config, teardown := setupTest(t, func(config *Config, _ string) {
+		config.Placement = placement{"shared": true}
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	empty, err := client.GetMerkleTree(ctx, &api.MerkleTreeRequest{Owners: []string{"a", "b"}})
+	require.NoError(t, err)
+	require.NoError(t, config.Store.Set(store.Record{Key: "shared", Value: []byte("value")}))
+	require.NoError(t, config.Store.Set(store.Record{Key: "other", Value: []byte("value")}))
+
+	// Only the keys both nodes hold are compared, and sent
+	tree, err := client.GetMerkleTree(ctx, &api.MerkleTreeRequest{Owners: []string{"a", "b"}})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{store.Bucket("shared")}, store.MerkleTree(tree.Nodes).Diff(empty.Nodes))
+	buckets := []uint32{store.Bucket("shared"), store.Bucket("other")}
+	stream, err := client.ConsumeRange(ctx, &api.RangeRequest{Buckets: buckets, Owners: []string{"a", "b"}})
+	require.NoError(t, err)
+	record, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "shared", record.Key)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// Without owners, every key is
+	tree, err = client.GetMerkleTree(ctx, &api.MerkleTreeRequest{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, buckets, store.MerkleTree(tree.Nodes).Diff(empty.Nodes))
+}
+
+func TestConsistency(t *testing.T) {
+	// The only other replica is down
+	client, _, _, teardown := setupTest(t, func(config *Config, _ string) {
+		config.Router = replicaRouter{"127.0.0.1:1"}
+		config.DialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.SetKey(ctx, &api.SetRequest{Key: "key", Value: []byte("value")})
+	require.NoError(t, err)
+	_, err = client.SetKey(ctx, &api.SetRequest{Key: "key", Value: []byte("value"), Consistency: api.Consistency_QUORUM})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = client.SetKey(ctx, &api.SetRequest{Key: "key", Value: []byte("value"), Consistency: api.Consistency_ALL})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	get, err := client.GetKey(ctx, &api.GetRequest{Key: "key"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), get.Value)
+	_, err = client.GetKey(ctx, &api.GetRequest{Key: "key", Consistency: api.Consistency_QUORUM})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// Deleted keys are only answered with their version when asked for
+	_, err = client.DeleteKey(ctx, &api.DeleteRequest{Key: "key"})
+	require.NoError(t, err)
+	_, err = client.GetKey(ctx, &api.GetRequest{Key: "key"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	get, err = client.GetKey(ctx, &api.GetRequest{Key: "key", Deleted: true})
+	require.NoError(t, err)
+	require.True(t, get.Deleted)
+	require.Greater(t, get.Timestamp, int64(0))
+
+	require.Equal(t, 1, required(api.Consistency_ONE, 3))
+	require.Equal(t, 2, required(api.Consistency_QUORUM, 3))
+	require.Equal(t, 3, required(api.Consistency_QUORUM, 4))
+	require.Equal(t, 3, required(api.Consistency_ALL, 3))
+}
+
+func TestNewerVersion(t *testing.T) {
+	older := &api.GetResponse{Timestamp: 1, Origin: "b"}
+	later := &api.GetResponse{Timestamp: 2, Origin: "a"}
+	require.True(t, newer(later, older))
+	require.False(t, newer(older, later))
+	require.True(t, newer(older, nil))
+	require.True(t, newer(&api.GetResponse{Timestamp: 1, Origin: "c"}, older))
+
+	// A clock that has seen the other wins, whatever the timestamps
+	seen := &api.GetResponse{Timestamp: 1, Context: store.VectorClock{"a": 2, "b": 1}.Bytes()}
+	unseen := &api.GetResponse{Timestamp: 2, Context: store.VectorClock{"a": 1, "b": 1}.Bytes()}
+	require.True(t, newer(seen, unseen))
+	require.False(t, newer(unseen, seen))
+}
+
+func TestReadRepair(t *testing.T) {
+	var addr string
+	_, _, replica, teardown := setupTest(t, func(_ *Config, a string) {
+		addr = a
+	})
+	defer teardown()
+	client, _, config, teardown := setupTest(t, func(config *Config, _ string) {
+		config.Router = replicaRouter{addr}
+	})
+	defer teardown()
+	ctx := context.Background()
+	repairs := readRepairCount(t)
+
+	// The replica holds a newer version of one key, and misses another
+	require.NoError(t, config.Store.Set(store.Record{Key: "behind", Value: []byte("old")}))
+	require.NoError(t, replica.Store.Set(store.Record{Key: "behind", Value: []byte("new")}))
+	require.NoError(t, config.Store.Set(store.Record{Key: "missing", Value: []byte("value")}))
+
+	// Reads at quorum answer with the newest version, and bring the stale
+	// replicas up to it
+	get, err := client.GetKey(ctx, &api.GetRequest{Key: "behind", Consistency: api.Consistency_QUORUM})
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), get.Value)
+	get, err = client.GetKey(ctx, &api.GetRequest{Key: "missing", Consistency: api.Consistency_QUORUM})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), get.Value)
+	require.Eventually(t, func() bool {
+		local, err := config.Store.Get("behind")
+		if err != nil || string(local) != "new" {
+			return false
+		}
+		remote, err := replica.Store.Get("missing")
+		return err == nil && string(remote) == "value"
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return readRepairCount(t) == repairs+2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Replicas that agree are left alone
+	_, err = client.GetKey(ctx, &api.GetRequest{Key: "behind", Consistency: api.Consistency_QUORUM})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, repairs+2, readRepairCount(t))
+}
+
+// Number of read repairs made so far
+func readRepairCount(t *testing.T) int64 {
+	rows, err := view.RetrieveData("godis/read_repairs")
+	require.NoError(t, err)
+	if len(rows) == 0 {
+		return 0
+	}
+	return rows[0].Data.(*view.CountData).Value
+}
+
+// A cluster of fixed members
+type servers []*api.Server
+
+func (s servers) GetServers() ([]*api.Server, error) {
+	return s, nil
+}
+
+func TestReplica(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(config *Config, addr string) {
+		config.Replica = true
+		config.ServerLister = servers{
+			{Id: "replica", RpcAddr: addr, Role: api.Role_REPLICA},
+			{Id: "primary", RpcAddr: "127.0.0.1:1", Role: api.Role_PEER},
+		}
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// Writes from clients are turned away, pointing at a node that takes them
+	_, err := client.SetKey(ctx, &api.SetRequest{Key: "key", Value: []byte("value")})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	details := status.Convert(err).Details()
+	require.Len(t, details, 1)
+	info := details[0].(*errdetails.ErrorInfo)
+	require.Equal(t, ReasonReadOnlyReplica, info.Reason)
+	require.Equal(t, "127.0.0.1:1", info.Metadata[WriteAddrKey])
+
+	stream, err := client.SetStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.SetRequest{Key: "key", Value: []byte("value")}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = client.DeleteKey(ctx, &api.DeleteRequest{Key: "key"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.Expire(ctx, &api.ExpireRequest{Key: "key", TtlMs: 1000})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Writes replicated or forwarded from other nodes are taken, and served
+	_, err = client.SetKey(ctx, &api.SetRequest{Key: "key", Value: []byte("value"), Origin: "primary", OriginSeq: 1})
+	require.NoError(t, err)
+	forwardedCtx := metadata.AppendToOutgoingContext(ctx, forwardedKey, "true")
+	_, err = client.SetKey(forwardedCtx, &api.SetRequest{Key: "other", Value: []byte("value")})
+	require.NoError(t, err)
+	get, err := client.GetKey(ctx, &api.GetRequest{Key: "key"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), get.Value)
+}
+
+// Lets through everything the wrapped authorizer does, but replicating
+type clientsOnly struct {
+	Authorizer
+}
+
+func (a clientsOnly) Authorize(subject, object, action string) error {
+	if action == replicateAction {
+		return status.Error(codes.PermissionDenied, "not a peer")
+	}
+	return a.Authorizer.Authorize(subject, object, action)
+}
+
+func TestReplicatedWritesNeedPeers(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(config *Config, addr string) {
+		config.Authorizer = clientsOnly{config.Authorizer}
+		config.Replica = true
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// Clients cannot pass their writes off as replicated
+	_, err := client.SetKey(ctx, &api.SetRequest{Key: "key", Value: []byte("value"), Origin: "primary", OriginSeq: 1})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.SetKey(ctx, &api.SetRequest{Key: "key", Value: []byte("value"), Timestamp: time.Now().UnixNano()})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.DeleteKey(ctx, &api.DeleteRequest{Key: "key", Origin: "primary", OriginSeq: 2})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.SetKey(ctx, &api.SetRequest{Key: "key", Value: []byte("value"),
+		Siblings: []*api.Sibling{{Value: []byte("other")}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Nor run the repairs and merges that rewrite the store
+	_, err = client.AntiEntropy(ctx, &api.AntiEntropyRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Compact(ctx, &api.CompactRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Nor as forwarded, which the replica would take
+	forwardedCtx := metadata.AppendToOutgoingContext(ctx, forwardedKey, "true")
+	_, err = client.SetKey(forwardedCtx, &api.SetRequest{Key: "key", Value: []byte("value")})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}